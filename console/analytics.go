@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dimensionColumns maps breakdown dimensions to their columns. Only these
+// fixed identifiers are written into SQL.
+var dimensionColumns = map[string]string{
+	"path":     "path",
+	"referrer": "referrer",
+	"country":  "country",
+	"region":   "region",
+	"city":     "city",
+	"device":   "device",
+	"browser":  "browser",
+	"os":       "os",
+	"screen":   "screen",
+	"event":    "event_type",
+}
+
+// metricExprs maps metrics to the aggregate computing them.
+var metricExprs = map[string]string{
+	"views":    "COUNT(*)",
+	"visitors": "COUNT(DISTINCT visitor_hash)",
+	"events":   "COUNT(*)",
+	"sessions": "COUNT(DISTINCT visitor_hash || ' ' || session)",
+}
+
+// sessionGap is the inactivity that ends a session.
+const sessionGap = 30 * time.Minute
+
+const (
+	maxBreakdownLimit = 1000
+	maxSeriesBuckets  = 5000
+)
+
+// AnalyticsQuery is one aggregate over raw page views or events, grouped
+// by zero or more keys. It backs both the breakdown and timeseries APIs.
+type AnalyticsQuery struct {
+	Range  TimeRange
+	Filter Filter
+	Metric string
+}
+
+// table is the raw table the metric is counted over.
+func (a AnalyticsQuery) table() string {
+	if a.Metric == "events" {
+		return "events"
+	}
+	return "page_views"
+}
+
+// checkDimension reports whether dim can be grouped by under a's metric:
+// events only have an event type, page views everything else.
+func (a AnalyticsQuery) checkDimension(dim string) error {
+	if _, ok := dimensionColumns[dim]; !ok {
+		return fmt.Errorf("unknown dimension %q", dim)
+	}
+	if (dim == "event") != (a.table() == "events") {
+		if dim == "event" {
+			return fmt.Errorf("dimension event requires metric events")
+		}
+		return fmt.Errorf("metric events can only be broken down by event")
+	}
+	return nil
+}
+
+// grouped returns SQL selecting keys (as k0, k1, ...) and the metric (as
+// value) grouped by the keys, with the arguments for keyArgs first. With
+// withVisitors each group's distinct visitors are selected too, as
+// visitors.
+//
+// Sessions are split on sessionGap within the range only, so a session
+// that started before From is counted from its first view inside it.
+func (a AnalyticsQuery) grouped(keys []string, keyArgs []any, withVisitors bool) (string, []any) {
+	from, to := a.Range.From.Unix(), a.Range.To.Unix()
+	table := a.table()
+	fw, fargs := a.Filter.where(table, from, to)
+
+	args := append([]any{}, keyArgs...)
+	source := table
+	if a.Metric == "sessions" {
+		source = `(
+			SELECT *, SUM(new_session) OVER (PARTITION BY visitor_hash ORDER BY ts, id ROWS UNBOUNDED PRECEDING) AS session
+			FROM (
+				SELECT *, CASE WHEN ts - LAG(ts) OVER (PARTITION BY visitor_hash ORDER BY ts, id) <= ? THEN 0 ELSE 1 END AS new_session
+				FROM page_views WHERE ts >= ? AND ts < ?
+			)
+		)`
+		args = append(args, int64(sessionGap.Seconds()), from, to)
+	}
+	args = append(append(args, from, to), fargs...)
+
+	selects := make([]string, 0, len(keys)+1)
+	groups := make([]string, len(keys))
+	for i, k := range keys {
+		groups[i] = "k" + strconv.Itoa(i)
+		selects = append(selects, k+" AS "+groups[i])
+	}
+	selects = append(selects, metricExprs[a.Metric]+" AS value")
+	if withVisitors {
+		selects = append(selects, "COUNT(DISTINCT visitor_hash) AS visitors")
+	}
+
+	query := `SELECT ` + strings.Join(selects, ", ") + ` FROM ` + source + ` WHERE ts >= ? AND ts < ?` + fw
+	if len(groups) > 0 {
+		query += ` GROUP BY ` + strings.Join(groups, ", ")
+	}
+	return query, args
+}
+
+// folded is grouped with the groups seen by fewer than minVisitors
+// visitors folded into one "Other" row, as breakdowns are served.
+func (a AnalyticsQuery) folded(keys []string) (string, []any) {
+	k := setting(&minVisitors)
+	if k <= 1 {
+		return a.grouped(keys, nil, false)
+	}
+	inner, args := a.grouped(keys, nil, true)
+	return foldGroups(inner, args, len(keys), k)
+}
+
+// breakdownSorts maps the sort parameter to ORDER BY clauses; ties are
+// broken by name so pages are stable.
+var breakdownSorts = map[string]string{
+	"-value": "value DESC, k0",
+	"value":  "value, k0",
+	"name":   "k0, value DESC",
+	"-name":  "k0 DESC, value DESC",
+}
+
+// QueryBreakdownContext groups a's metric by one dimension, or two for a
+// pivot, and returns the requested page. Groups seen by fewer than
+// minVisitors visitors fold into one "Other" row.
+func QueryBreakdownContext(ctx context.Context, a AnalyticsQuery, dims []string, sort string, limit, offset int) (*BreakdownResult, error) {
+	keys := make([]string, len(dims))
+	for i, d := range dims {
+		keys[i] = dimensionColumns[d]
+	}
+	inner, args := a.folded(keys)
+
+	result := &BreakdownResult{
+		From:       a.Range.From.In(a.Range.Loc).Format(time.RFC3339),
+		To:         a.Range.To.In(a.Range.Loc).Format(time.RFC3339),
+		Metric:     a.Metric,
+		Dimensions: dims,
+		Sort:       sort,
+		Limit:      limit,
+		Offset:     offset,
+		Rows:       []BreakdownRow{},
+	}
+	q := &statsQuery{ctx: ctx}
+	q.scalar(&result.Total, `SELECT COUNT(*) FROM (`+inner+`)`, args...)
+
+	order := breakdownSorts[sort]
+	if len(dims) > 1 {
+		order += ", k1"
+	}
+	q.rows(inner+` ORDER BY `+order+` LIMIT ? OFFSET ?`, append(args, limit, offset), func(rows *sql.Rows) error {
+		row := BreakdownRow{Keys: make([]string, len(dims))}
+		dest := make([]any, 0, len(dims)+1)
+		for i := range row.Keys {
+			dest = append(dest, &row.Keys[i])
+		}
+		if err := rows.Scan(append(dest, &row.Value)...); err != nil {
+			return err
+		}
+		result.Rows = append(result.Rows, row)
+		return nil
+	})
+
+	if q.err != nil {
+		return nil, q.err
+	}
+	return result, nil
+}
+
+// QueryTimeseriesContext buckets a's metric by granularity in the range's
+// time zone. Buckets seen by fewer than minVisitors visitors read zero.
+func QueryTimeseriesContext(ctx context.Context, a AnalyticsQuery, granularity string) (*TimeseriesResult, error) {
+	labels, err := a.Range.bucketLabels(granularity, maxSeriesBuckets)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int, len(labels))
+
+	k := setting(&minVisitors)
+	bucket, bucketArgs := a.Range.bucketAt(granularity)
+	query, args := a.grouped([]string{bucket}, bucketArgs, k > 1)
+	q := &statsQuery{ctx: ctx}
+	q.rows(query, args, func(rows *sql.Rows) error {
+		var label string
+		var n, visitors int
+		dest := []any{&label, &n}
+		if k > 1 {
+			dest = append(dest, &visitors)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if k <= 1 || visitors >= k {
+			values[label] = n
+		}
+		return nil
+	})
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	result := &TimeseriesResult{
+		From:        a.Range.From.In(a.Range.Loc).Format(time.RFC3339),
+		To:          a.Range.To.In(a.Range.Loc).Format(time.RFC3339),
+		Timezone:    a.Range.Loc.String(),
+		Metric:      a.Metric,
+		Granularity: granularity,
+		Points:      make([]SeriesPoint, len(labels)),
+	}
+	for i, l := range labels {
+		result.Points[i] = SeriesPoint{Time: l, Value: values[l]}
+	}
+	return result, nil
+}
+
+// parseAnalyticsQuery reads the range, filters and metric shared by the
+// breakdown and timeseries endpoints.
+func parseAnalyticsQuery(q url.Values) (AnalyticsQuery, error) {
+	rng, err := ParseTimeRange(q, time.Now())
+	if err != nil {
+		return AnalyticsQuery{}, err
+	}
+	f, err := ParseFilter(q)
+	if err != nil {
+		return AnalyticsQuery{}, err
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "views"
+	}
+	if _, ok := metricExprs[metric]; !ok {
+		return AnalyticsQuery{}, fmt.Errorf("metric must be views, visitors, events or sessions")
+	}
+	return AnalyticsQuery{Range: rng, Filter: f, Metric: metric}, nil
+}
+
+// handleBreakdown serves /api/analytics/breakdown:
+//
+//	dimension  path, referrer, country, region, city, device, browser, os,
+//	           screen or event (required)
+//	pivot      optional second dimension
+//	metric     views (default), visitors, events or sessions
+//	sort       -value (default), value, name or -name
+//	limit      1-1000, default 20
+//	offset     default 0
+//
+// plus the time range and filter parameters of /api/analytics/stats.
+func handleBreakdown(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	a, err := parseAnalyticsQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dims := []string{params.Get("dimension")}
+	if p := params.Get("pivot"); p != "" {
+		dims = append(dims, p)
+	}
+	for _, d := range dims {
+		if d == "" {
+			http.Error(w, "dimension is required", http.StatusBadRequest)
+			return
+		}
+		if err := a.checkDimension(d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(dims) == 2 && dims[0] == dims[1] {
+		http.Error(w, "pivot must differ from dimension", http.StatusBadRequest)
+		return
+	}
+
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = "-value"
+	}
+	if _, ok := breakdownSorts[sort]; !ok {
+		http.Error(w, "sort must be -value, value, name or -name", http.StatusBadRequest)
+		return
+	}
+	limit, offset := 20, 0
+	if s := params.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxBreakdownLimit {
+			http.Error(w, fmt.Sprintf("limit must be 1-%d", maxBreakdownLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := params.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "breakdown", a.table(), a.Range, a.Filter) {
+		return
+	}
+	result, err := QueryBreakdownContext(ctx, a, dims, sort, limit, offset)
+	if err != nil {
+		queryFailed(w, ctx, "breakdown", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleTimeseries serves /api/analytics/timeseries:
+//
+//	granularity  minute, hour, day, week or month (default hour for
+//	             ranges up to two days, else day)
+//	metric       views (default), visitors, events or sessions
+//
+// plus the time range and filter parameters of /api/analytics/stats.
+func handleTimeseries(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	a, err := parseAnalyticsQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	granularity := params.Get("granularity")
+	if granularity == "" {
+		granularity = a.Range.Interval()
+	}
+	if !slices.Contains(granularities, granularity) {
+		http.Error(w, "granularity must be minute, hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+	if _, err := a.Range.bucketLabels(granularity, maxSeriesBuckets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "timeseries", a.table(), a.Range, a.Filter) {
+		return
+	}
+	result, err := QueryTimeseriesContext(ctx, a, granularity)
+	if err != nil {
+		queryFailed(w, ctx, "timeseries", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step matches page views or events. It defines a goal and each step of a
+// funnel.
+type Step struct {
+	Type     string            `json:"type"`               // "pageview" or "event"
+	Path     string            `json:"path,omitempty"`     // pageview: path to match
+	Match    string            `json:"match,omitempty"`    // pageview: exact (default), prefix or regex
+	Event    string            `json:"event,omitempty"`    // event: event type
+	Metadata string            `json:"metadata,omitempty"` // event: exact metadata value
+	Props    map[string]string `json:"props,omitempty"`    // event: properties of JSON metadata
+}
+
+var propKeyRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// Validate checks s and fills in the default match.
+func (s *Step) Validate() error {
+	switch s.Type {
+	case "pageview":
+		if s.Path == "" {
+			return errors.New("pageview step needs a path")
+		}
+		if s.Event != "" || s.Metadata != "" || len(s.Props) > 0 {
+			return errors.New("pageview step cannot match event fields")
+		}
+		switch s.Match {
+		case "":
+			s.Match = "exact"
+		case "exact", "prefix":
+		case "regex":
+			if _, err := regexp.Compile(s.Path); err != nil {
+				return fmt.Errorf("path: %v", err)
+			}
+		default:
+			return fmt.Errorf("match must be exact, prefix or regex")
+		}
+	case "event":
+		if s.Event == "" {
+			return errors.New("event step needs an event type")
+		}
+		if s.Path != "" || s.Match != "" {
+			return errors.New("event step cannot match a path")
+		}
+		for k := range s.Props {
+			if !propKeyRe.MatchString(k) {
+				return fmt.Errorf("invalid property name %q", k)
+			}
+		}
+	default:
+		return errors.New(`type must be "pageview" or "event"`)
+	}
+	return nil
+}
+
+// Goal is a named outcome: any page view or event matching its step.
+type Goal struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Step
+}
+
+// Validate checks g and fills in defaults.
+func (g *Goal) Validate() error {
+	if g.Name = strings.TrimSpace(g.Name); g.Name == "" {
+		return errors.New("name is required")
+	}
+	return g.Step.Validate()
+}
+
+// Funnel is an ordered list of steps a visitor completes within Window:
+// "session" (each step within 30 minutes of the previous one) or a
+// duration from the first step such as "30m", "2h" or "7d".
+//
+// Visitor hashes rotate with the daily salt, so steps are only linked
+// within one UTC day however long the window is.
+type Funnel struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Steps  []Step `json:"steps"`
+	Window string `json:"window"`
+}
+
+// MaxFunnelSteps is the most steps a funnel may have.
+const MaxFunnelSteps = 10
+
+// WindowDuration returns the funnel window, or 0 for "session".
+func (fn *Funnel) WindowDuration() (time.Duration, error) {
+	if fn.Window == "" || fn.Window == "session" {
+		return 0, nil
+	}
+	var d time.Duration
+	if days, ok := strings.CutSuffix(fn.Window, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", fn.Window)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(fn.Window); err != nil {
+			return 0, fmt.Errorf("invalid window %q", fn.Window)
+		}
+	}
+	if d <= 0 || d > 30*24*time.Hour {
+		return 0, fmt.Errorf("window must be between 1s and 30d")
+	}
+	return d, nil
+}
+
+// Validate checks fn and fills in defaults.
+func (fn *Funnel) Validate() error {
+	if fn.Name = strings.TrimSpace(fn.Name); fn.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(fn.Steps) < 2 || len(fn.Steps) > MaxFunnelSteps {
+		return fmt.Errorf("a funnel needs 2-%d steps", MaxFunnelSteps)
+	}
+	for i := range fn.Steps {
+		if err := fn.Steps[i].Validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	if fn.Window == "" {
+		fn.Window = "session"
+	}
+	_, err := fn.WindowDuration()
+	return err
+}
+
+// GoalReport is one goal's results over a range.
+type GoalReport struct {
+	Goal
+	Conversions int     `json:"conversions"` // matching page views or events
+	Visitors    int     `json:"visitors"`    // distinct visitors who converted
+	Rate        float64 `json:"conversion_rate"`
+}
+
+// GoalsResult reports every goal against the range's unique visitors.
+type GoalsResult struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Visitors int          `json:"visitors"`
+	Goals    []GoalReport `json:"goals"`
+}
+
+// FunnelStepReport is how many visitors reached one step of a funnel.
+type FunnelStepReport struct {
+	Step
+	Visitors    int     `json:"visitors"`
+	Rate        float64 `json:"conversion_rate"` // of visitors entering the funnel
+	DropOff     int     `json:"drop_off"`        // lost since the previous step
+	DropOffRate float64 `json:"drop_off_rate"`
+}
+
+// FunnelResult reports a funnel over a range.
+type FunnelResult struct {
+	Funnel
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Entered   int                `json:"entered"`
+	Converted int                `json:"converted"`
+	Rate      float64            `json:"conversion_rate"`
+	Report    []FunnelStepReport `json:"report"`
+}
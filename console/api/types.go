@@ -0,0 +1,335 @@
+// Package api defines the JSON documents of the console's HTTP API. The
+// server encodes these types and the client package decodes them, so the
+// two cannot drift apart.
+package api
+
+import "fmt"
+
+// Version is the version of the API described by /api/openapi.json.
+const Version = "1.0.0"
+
+// Beacon is the body of POST /api/analytics/event.
+type Beacon struct {
+	Type     string `json:"type"`     // "pageview" or event type (pwa_install, pwa_prompt, file_download)
+	Path     string `json:"path"`     // page path
+	Referrer string `json:"referrer"` // document.referrer
+	Screen   string `json:"screen"`   // e.g. "1920x1080"
+	Metadata string `json:"metadata"` // extra info for events (e.g. filename)
+}
+
+// BeaconResponse acknowledges a stored beacon.
+type BeaconResponse struct {
+	OK bool `json:"ok"`
+}
+
+// StatsResult holds dashboard data.
+type StatsResult struct {
+	From           string         `json:"from"`
+	To             string         `json:"to"`
+	Timezone       string         `json:"timezone"`
+	Interval       string         `json:"interval"`
+	TotalViews     int            `json:"total_views"`
+	UniqueVisitors int            `json:"unique_visitors"`
+	ActiveNow      int            `json:"active_now"`
+	TimeSeries     []TimePoint    `json:"time_series"`
+	TopPages       []PathCount    `json:"top_pages"`
+	TopReferrers   []PathCount    `json:"top_referrers"`
+	Browsers       []PathCount    `json:"browsers"`
+	Devices        []PathCount    `json:"devices"`
+	OSStats        []PathCount    `json:"os_stats"`
+	Countries      []PathCount    `json:"countries"`
+	Events         []EventSummary `json:"events"`
+	Screens        []PathCount    `json:"screens"`
+	Comparison     *Comparison    `json:"comparison,omitempty"`
+}
+
+// TimePoint is one time series bucket. Date is a local day ("2006-01-02")
+// or, for hourly series, a local hour ("2006-01-02 15:00").
+//
+// PrevViews and PrevUniq are set when the stats are compared with another
+// window, for the comparison bucket aligned with this one.
+type TimePoint struct {
+	Date      string `json:"date"`
+	Views     int    `json:"views"`
+	Uniq      int    `json:"uniq"`
+	PrevViews *int   `json:"prev_views,omitempty"`
+	PrevUniq  *int   `json:"prev_uniq,omitempty"`
+}
+
+// PathCount is a count for one value of a dimension (a page, referrer,
+// browser, ...). Change is set when the stats are compared.
+type PathCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	*Change
+}
+
+// EventSummary is a count for one event type.
+type EventSummary struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+	*Change
+}
+
+// Change compares a count with the same count in the comparison window.
+type Change struct {
+	Previous int      `json:"previous"`
+	Delta    int      `json:"delta"`
+	Percent  *float64 `json:"change_pct"` // nil when Previous is 0
+}
+
+// Comparison describes the window a StatsResult was compared against.
+type Comparison struct {
+	Mode           string  `json:"mode"`
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	TotalViews     *Change `json:"total_views"`
+	UniqueVisitors *Change `json:"unique_visitors"`
+}
+
+// RealtimeResult holds active visitors data.
+type RealtimeResult struct {
+	ActiveVisitors int         `json:"active_visitors"`
+	ActivePages    []PathCount `json:"active_pages"`
+}
+
+// RecentVisit represents a single page view for the live log.
+type RecentVisit struct {
+	Timestamp   string `json:"timestamp"`
+	Path        string `json:"path"`
+	IPAddress   string `json:"ip_address"`
+	VisitorHash string `json:"visitor_hash"`
+	Country     string `json:"country"`
+	Region      string `json:"region"`
+	City        string `json:"city"`
+	Browser     string `json:"browser"`
+	OS          string `json:"os"`
+	Device      string `json:"device"`
+	Referrer    string `json:"referrer"`
+	Screen      string `json:"screen"`
+}
+
+// LiveEvent is one accepted beacon as streamed to dashboards: the fields
+// stored for it, minus the IP address.
+type LiveEvent struct {
+	Type        string `json:"type"` // "pageview" or the event type
+	Timestamp   string `json:"timestamp"`
+	VisitorHash string `json:"visitor_hash"`
+	Path        string `json:"path,omitempty"`
+	Referrer    string `json:"referrer,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Region      string `json:"region,omitempty"`
+	City        string `json:"city,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Browser     string `json:"browser,omitempty"`
+	OS          string `json:"os,omitempty"`
+	Screen      string `json:"screen,omitempty"`
+	Metadata    string `json:"metadata,omitempty"`
+}
+
+// BreakdownRow is one group of a breakdown: one key per dimension.
+type BreakdownRow struct {
+	Keys  []string `json:"keys"`
+	Value int      `json:"value"`
+}
+
+// BreakdownResult is a page of a breakdown. Total counts all groups.
+type BreakdownResult struct {
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	Metric     string         `json:"metric"`
+	Dimensions []string       `json:"dimensions"`
+	Sort       string         `json:"sort"`
+	Limit      int            `json:"limit"`
+	Offset     int            `json:"offset"`
+	Total      int            `json:"total"`
+	Rows       []BreakdownRow `json:"rows"`
+}
+
+// SeriesPoint is one bucket of a timeseries.
+type SeriesPoint struct {
+	Time  string `json:"time"`
+	Value int    `json:"value"`
+}
+
+// TimeseriesResult is a metric per bucket, with empty buckets as zero.
+type TimeseriesResult struct {
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	Timezone    string        `json:"timezone"`
+	Metric      string        `json:"metric"`
+	Granularity string        `json:"granularity"`
+	Points      []SeriesPoint `json:"points"`
+}
+
+// Transition is one observed move from a page to the next.
+type Transition struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// PathSequence is one observed run of consecutive pages.
+type PathSequence struct {
+	Paths []string `json:"paths"`
+	Count int      `json:"count"`
+}
+
+// PathsResult reports how visitors move through the site.
+type PathsResult struct {
+	From        string         `json:"from"`
+	To          string         `json:"to"`
+	EntryPages  []PathCount    `json:"entry_pages"`
+	ExitPages   []PathCount    `json:"exit_pages"`
+	Transitions []Transition   `json:"transitions"`
+	TopPaths    []PathSequence `json:"top_paths"`
+}
+
+// User is a dashboard account.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"` // viewer, analyst or admin
+}
+
+// APIKey is a revocable credential for scripts, sent as a bearer token.
+// The secret itself is only returned once, when the key is created.
+type APIKey struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`                 // read:stats, read:raw, write:annotations or admin
+	ExpiresAt  string   `json:"expires_at,omitempty"`   // RFC 3339; when creating, also YYYY-MM-DD or a duration such as 90d
+	Prefix     string   `json:"prefix,omitempty"`       // start of the key, to tell keys apart
+	LastUsedAt string   `json:"last_used_at,omitempty"` // accurate to a minute
+	CreatedAt  string   `json:"created_at,omitempty"`
+	Key        string   `json:"key,omitempty"` // the secret, in the creation response only
+}
+
+// ShareLink is a public, read-only view of aggregate stats. Anyone with
+// its URL can see the chosen sections until it expires or is revoked.
+type ShareLink struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Sections    []string `json:"sections"` // totals, timeseries, pages, referrers, browsers, devices, os, countries, events or screens
+	PathPrefix  string   `json:"path_prefix,omitempty"`
+	MinVisitors int      `json:"min_visitors,omitempty"` // rows seen by fewer visitors fold into "Other"; default 5
+	ExpiresAt   string   `json:"expires_at,omitempty"`   // RFC 3339; when creating, also YYYY-MM-DD or a duration such as 30d
+	CreatedAt   string   `json:"created_at,omitempty"`
+	URL         string   `json:"url,omitempty"` // path of the signed link, /share/<token>
+}
+
+// SharedStats is what a share link shows: StatsResult with only the
+// link's sections filled in.
+type SharedStats struct {
+	Name        string      `json:"name"`
+	Sections    []string    `json:"sections"`
+	PathPrefix  string      `json:"path_prefix,omitempty"`
+	MinVisitors int         `json:"min_visitors"`
+	Stats       StatsResult `json:"stats"`
+}
+
+// PublicStats is an openly published, differentially private summary of
+// the last complete day, week or month. Each window is released once;
+// asking again returns the same numbers.
+type PublicStats struct {
+	Period     string        `json:"period"` // day, week or month, in UTC
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Visitors   int           `json:"visitors"`
+	Views      int           `json:"views"`
+	TopPages   []PathCount   `json:"top_pages"` // visitors per page, noisy
+	Privacy    PublicPrivacy `json:"privacy"`
+	ReleasedAt string        `json:"released_at"`
+}
+
+// PublicPrivacy documents the noise in a PublicStats release.
+type PublicPrivacy struct {
+	Mechanism       string  `json:"mechanism"`         // laplace or gaussian
+	Epsilon         float64 `json:"epsilon"`           // spent by this release, split evenly over visitors, views and top pages
+	Delta           float64 `json:"delta"`             // total for this release
+	EpsilonPerDay   float64 `json:"epsilon_per_day"`   // budget of each day of data, shared by the day, week and month covering it
+	ViewsPerVisitor int     `json:"views_per_visitor"` // views counted per visitor at most
+	PagesPerVisitor int     `json:"pages_per_visitor"` // pages a visitor is counted on at most
+	VisitorsPerUser int     `json:"visitors_per_user"` // visitors one person can be, one per day as visitor hashes are salted daily; the noise covers them all
+	MinPageCount    int     `json:"min_page_count"`    // noisy count a page needs to be listed
+}
+
+// Readiness is the result of /readyz. Each check is "ok", "disabled" or
+// why it failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // database, migrations, geoip, aggregation
+}
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`            // module version, (devel) for a local build
+	Revision  string `json:"revision,omitempty"` // VCS commit built
+	Time      string `json:"time,omitempty"`     // commit time, RFC 3339
+	Modified  bool   `json:"modified"`           // built with uncommitted changes
+	GoVersion string `json:"go_version"`
+}
+
+// BackupResult describes a database snapshot.
+type BackupResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// PurgeReport counts the rows a purge removed, or would remove in a dry run.
+type PurgeReport struct {
+	DryRun      bool   `json:"dry_run"`
+	PageViews   int64  `json:"page_views"`
+	Events      int64  `json:"events"`
+	IPAddresses int64  `json:"ip_addresses"`
+	Salts       int64  `json:"salts"`
+	Aggregates  int64  `json:"aggregates"`
+	Audit       int64  `json:"audit"`
+	Duration    string `json:"duration"`
+}
+
+func (r PurgeReport) String() string {
+	verb := "purged"
+	if r.DryRun {
+		verb = "would purge"
+	}
+	return fmt.Sprintf("%s %d page views, %d events, %d ip addresses, %d salts, %d aggregates, %d audit entries in %s",
+		verb, r.PageViews, r.Events, r.IPAddresses, r.Salts, r.Aggregates, r.Audit, r.Duration)
+}
+
+// AuditEntry is one record of the audit log: an authenticated request,
+// an admin action, or both when a request performed one. Hash covers the
+// entry and PrevHash, chaining it to the entry before.
+type AuditEntry struct {
+	ID         int64  `json:"id"`
+	Time       string `json:"time"`      // RFC 3339
+	Principal  string `json:"principal"` // username, key:<name>, token, anonymous, cli:<user> or system
+	Action     string `json:"action"`    // request, or e.g. purge, export, key.create, login.failed
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Params     string `json:"params,omitempty"` // the query string
+	Status     int    `json:"status,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"` // response body size
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	PrevHash   string `json:"prev_hash"`
+	Hash       string `json:"hash"`
+}
+
+// AuditPage is a page of the audit log, newest first. Pass NextBefore as
+// before to fetch the next page; it is omitted on the last one.
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextBefore int64        `json:"next_before,omitempty"`
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+// The chain starts at the oldest entry retention has kept.
+type AuditVerification struct {
+	OK       bool   `json:"ok"`
+	Checked  int64  `json:"checked"`
+	FirstID  int64  `json:"first_id,omitempty"`
+	LastID   int64  `json:"last_id,omitempty"`
+	BrokenAt int64  `json:"broken_at,omitempty"` // first entry that fails to verify
+	Problem  string `json:"problem,omitempty"`
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API key scopes. Each route needs one; admin grants every scope.
+const (
+	scopeReadStats        = "read:stats"        // aggregate reports
+	scopeReadRaw          = "read:raw"          // individual visits, the live feed and exports
+	scopeWriteAnnotations = "write:annotations" // reserved for chart annotations
+	scopeAdmin            = "admin"             // goals, funnels, backups, purges and keys
+)
+
+var apiScopes = []string{scopeReadStats, scopeReadRaw, scopeWriteAnnotations, scopeAdmin}
+
+// apiKeyPrefix starts every key so that leaked keys are easy to spot.
+const apiKeyPrefix = "nmk_"
+
+// keyAllows reports whether an API key with scopes may use a route
+// needing scope. An empty scope admits any key.
+func keyAllows(scopes []string, scope string) bool {
+	return scope == "" || slices.Contains(scopes, scope) || slices.Contains(scopes, scopeAdmin)
+}
+
+// parseExpiry reads an RFC 3339 time, a YYYY-MM-DD date (the key expires
+// as that day starts, UTC), or a duration from now such as 90d or 12h.
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q: use RFC 3339, YYYY-MM-DD or a duration such as 90d", s)
+}
+
+// validateAPIKey checks a key to be created and normalises its scopes and
+// expiry.
+func validateAPIKey(k *APIKey, now time.Time) error {
+	if k.Name = strings.TrimSpace(k.Name); k.Name == "" || len(k.Name) > 64 {
+		return errors.New("name must be 1-64 characters")
+	}
+	if len(k.Scopes) == 0 {
+		return fmt.Errorf("at least one scope is required: %s", strings.Join(apiScopes, ", "))
+	}
+	for _, s := range k.Scopes {
+		if !slices.Contains(apiScopes, s) {
+			return fmt.Errorf("unknown scope %q: use %s", s, strings.Join(apiScopes, ", "))
+		}
+	}
+	slices.Sort(k.Scopes)
+	k.Scopes = slices.Compact(k.Scopes)
+	if k.ExpiresAt != "" {
+		t, err := parseExpiry(k.ExpiresAt, now)
+		if err != nil {
+			return err
+		}
+		if !t.After(now) {
+			return errors.New("expiry is in the past")
+		}
+		k.ExpiresAt = t.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// CreateAPIKey stores a new key, which validateAPIKey has accepted, and
+// sets k.Key to its secret, which is not kept.
+func CreateAPIKey(k *APIKey) error {
+	now := time.Now()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	var expires sql.NullInt64
+	if k.ExpiresAt != "" {
+		t, _ := time.Parse(time.RFC3339, k.ExpiresAt)
+		expires = sql.NullInt64{Int64: t.Unix(), Valid: true}
+	}
+	k.Prefix = secret[:len(apiKeyPrefix)+6]
+	res, err := db.Exec(`INSERT INTO api_keys (name, prefix, key_hash, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.Name, k.Prefix, hashToken(secret), strings.Join(k.Scopes, " "), expires, now.Unix())
+	if err != nil {
+		return err
+	}
+	k.ID, _ = res.LastInsertId()
+	k.CreatedAt = now.UTC().Format(time.RFC3339)
+	k.LastUsedAt = ""
+	k.Key = secret
+	return nil
+}
+
+const apiKeyColumns = `id, name, prefix, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expires, lastUsed sql.NullInt64
+	var created int64
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &expires, &lastUsed, &created); err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	format := func(n sql.NullInt64) string {
+		if !n.Valid {
+			return ""
+		}
+		return time.Unix(n.Int64, 0).UTC().Format(time.RFC3339)
+	}
+	k.ExpiresAt, k.LastUsedAt = format(expires), format(lastUsed)
+	k.CreatedAt = format(sql.NullInt64{Int64: created, Valid: true})
+	return &k, nil
+}
+
+// ListAPIKeys returns every key, without secrets, by name.
+func ListAPIKeys() ([]APIKey, error) {
+	rows, err := db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey deletes a key by ID, reporting whether it existed.
+func RevokeAPIKey(id int64) (bool, error) {
+	res, err := db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// apiKeyDetail describes a key for the audit log.
+func apiKeyDetail(k APIKey) string {
+	return fmt.Sprintf("%s (id %d, %s) scopes %s", k.Name, k.ID, k.Prefix, strings.Join(k.Scopes, ","))
+}
+
+// lookupAPIKey returns the unexpired key with this secret, or nil, and
+// records its use at most once a minute.
+func lookupAPIKey(r *http.Request, secret string) (*APIKey, error) {
+	row := readDB.QueryRowContext(r.Context(), `SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE key_hash = ? AND (expires_at IS NULL OR expires_at > unixepoch())`, hashToken(secret))
+	k, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if last, err := time.Parse(time.RFC3339, k.LastUsedAt); err != nil || now.Sub(last) >= time.Minute {
+		if _, err := db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now.Unix(), k.ID); err != nil {
+			slog.Error("api key last use", "err", err)
+		}
+	}
+	return k, nil
+}
+
+// handleListAPIKeys returns every key without its secret.
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := ListAPIKeys()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list api keys", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleCreateAPIKey creates a key from a JSON body and returns it with
+// its secret.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var k APIKey
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&k); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	k.ID, k.Key = 0, ""
+	if err := validateAPIKey(&k, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CreateAPIKey(&k); err != nil {
+		definitionFailed(w, r, "api key", err)
+		return
+	}
+	noteAudit(r, "key.create", apiKeyDetail(k))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+// handleRevokeAPIKey deletes a key.
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := RevokeAPIKey(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoke api key", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	noteAudit(r, "key.revoke", "id "+strconv.FormatInt(id, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
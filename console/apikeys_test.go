@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{[]string{scopeReadStats}, scopeReadStats, true},
+		{[]string{scopeReadStats}, scopeReadRaw, false},
+		{[]string{scopeReadStats}, scopeAdmin, false},
+		{[]string{scopeReadStats}, "", true},
+		{[]string{scopeReadRaw}, scopeReadStats, false},
+		{[]string{scopeReadRaw}, scopeReadRaw, true},
+		{[]string{scopeReadStats, scopeReadRaw}, scopeAdmin, false},
+		{[]string{scopeWriteAnnotations}, scopeReadStats, false},
+		{[]string{scopeAdmin}, scopeReadStats, true},
+		{[]string{scopeAdmin}, scopeReadRaw, true},
+		{[]string{scopeAdmin}, scopeWriteAnnotations, true},
+		{[]string{scopeAdmin}, scopeAdmin, true},
+		{nil, scopeReadStats, false},
+	}
+	for _, tt := range tests {
+		if got := keyAllows(tt.scopes, tt.scope); got != tt.want {
+			t.Errorf("keyAllows(%v, %q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+// createTestKey stores a key with scopes and returns its secret.
+func createTestKey(t *testing.T, name string, scopes ...string) string {
+	t.Helper()
+	k := APIKey{Name: name, Scopes: scopes}
+	if err := validateAPIKey(&k, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateAPIKey(&k); err != nil {
+		t.Fatal(err)
+	}
+	return k.Key
+}
+
+// TestStatsKeyRefusedRaw sends every documented route needing read:raw or
+// admin a request with a read:stats key, and expects it to be refused
+// before its handler runs.
+func TestStatsKeyRefusedRaw(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	secret := createTestKey(t, "stats", scopeReadStats)
+	mux := http.NewServeMux()
+	SetupRoutes(mux)
+
+	checked := 0
+	for _, op := range apiOperations() {
+		if op.public || op.scope != scopeReadRaw && op.scope != scopeAdmin {
+			continue
+		}
+		r := httptest.NewRequest(op.method, strings.ReplaceAll(op.path, "{id}", "1"), nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a read:stats key: status %d, want %d", op.method, op.path, w.Code, http.StatusForbidden)
+		}
+		checked++
+	}
+	if checked == 0 {
+		t.Fatal("no route needs read:raw or admin")
+	}
+}
+
+func TestLookupAPIKey(t *testing.T) {
+	openTestDB(t)
+	lookup := func(secret string) *APIKey {
+		t.Helper()
+		k, err := lookupAPIKey(httptest.NewRequest("GET", "/api/analytics/stats", nil), secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	secret := createTestKey(t, "live", scopeReadRaw, scopeReadStats, scopeReadRaw)
+	k := lookup(secret)
+	if k == nil || k.Name != "live" || strings.Join(k.Scopes, " ") != "read:raw read:stats" {
+		t.Fatalf("lookup of a live key: %+v", k)
+	}
+	if k := lookup(secret + "x"); k != nil {
+		t.Errorf("unknown key accepted as %q", k.Name)
+	}
+	if k := lookup(apiKeyPrefix); k != nil {
+		t.Errorf("bare prefix accepted as %q", k.Name)
+	}
+
+	expired := createTestKey(t, "expired", scopeReadStats)
+	if _, err := db.Exec(`UPDATE api_keys SET expires_at = unixepoch() - 1 WHERE name = 'expired'`); err != nil {
+		t.Fatal(err)
+	}
+	if k := lookup(expired); k != nil {
+		t.Errorf("expired key accepted as %q", k.Name)
+	}
+
+	if found, err := RevokeAPIKey(k.ID); !found || err != nil {
+		t.Fatalf("revoke: %v, %v", found, err)
+	}
+	if k := lookup(secret); k != nil {
+		t.Errorf("revoked key accepted as %q", k.Name)
+	}
+}
+
+// TestAPIKeyLastUsed checks that a key's last use is recorded on first
+// use, and then at most once a minute.
+func TestAPIKeyLastUsed(t *testing.T) {
+	openTestDB(t)
+	secret := createTestKey(t, "throttled", scopeReadStats)
+	lastUsed := func() int64 {
+		t.Helper()
+		var ts int64
+		if err := db.QueryRow(`SELECT COALESCE(last_used_at, 0) FROM api_keys`).Scan(&ts); err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	use := func() {
+		t.Helper()
+		if k, err := lookupAPIKey(httptest.NewRequest("GET", "/api/analytics/stats", nil), secret); k == nil || err != nil {
+			t.Fatalf("lookup: %v, %v", k, err)
+		}
+	}
+
+	use()
+	if lastUsed() == 0 {
+		t.Fatal("first use not recorded")
+	}
+	recent := time.Now().Add(-30 * time.Second).Unix()
+	db.Exec(`UPDATE api_keys SET last_used_at = ?`, recent)
+	use()
+	if got := lastUsed(); got != recent {
+		t.Errorf("use 30s after the last was recorded: last_used_at %d, want %d", got, recent)
+	}
+	stale := time.Now().Add(-2 * time.Minute).Unix()
+	db.Exec(`UPDATE api_keys SET last_used_at = ?`, stale)
+	use()
+	if got := lastUsed(); got <= stale {
+		t.Errorf("use 2m after the last was not recorded: last_used_at %d", got)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time // zero for an error
+	}{
+		{"90d", now.AddDate(0, 0, 90)},
+		{"1d", now.AddDate(0, 0, 1)},
+		{"12h", now.Add(12 * time.Hour)},
+		{"90m", now.Add(90 * time.Minute)},
+		{"2026-06-01", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"2026-06-01T12:00:00+02:00", time.Date(2026, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"0d", time.Time{}},
+		{"-5d", time.Time{}},
+		{"0h", time.Time{}},
+		{"-1h", time.Time{}},
+		{"d", time.Time{}},
+		{"1.5d", time.Time{}},
+		{"90", time.Time{}},
+		{"2026-13-01", time.Time{}},
+		{"next week", time.Time{}},
+		{"", time.Time{}},
+	}
+	for _, tt := range tests {
+		got, err := parseExpiry(tt.in, now)
+		switch {
+		case tt.want.IsZero() && err == nil:
+			t.Errorf("parseExpiry(%q) = %v, want an error", tt.in, got)
+		case !tt.want.IsZero() && err != nil:
+			t.Errorf("parseExpiry(%q): %v", tt.in, err)
+		case !got.Equal(tt.want):
+			t.Errorf("parseExpiry(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "noblemind-console/api"
+
+// The JSON documents of the HTTP API live in package api so that clients
+// can import them; these aliases keep the server code unqualified.
+type (
+	BeaconPayload    = api.Beacon
+	StatsResult      = api.StatsResult
+	TimePoint        = api.TimePoint
+	PathCount        = api.PathCount
+	EventSummary     = api.EventSummary
+	Change           = api.Change
+	Comparison       = api.Comparison
+	RealtimeResult   = api.RealtimeResult
+	RecentVisit      = api.RecentVisit
+	LiveEvent        = api.LiveEvent
+	BreakdownRow     = api.BreakdownRow
+	BreakdownResult  = api.BreakdownResult
+	SeriesPoint      = api.SeriesPoint
+	TimeseriesResult = api.TimeseriesResult
+	Transition       = api.Transition
+	PathSequence     = api.PathSequence
+	PathsResult      = api.PathsResult
+	Step             = api.Step
+	Goal             = api.Goal
+	Funnel           = api.Funnel
+	GoalReport       = api.GoalReport
+	GoalsResult      = api.GoalsResult
+	FunnelStepReport = api.FunnelStepReport
+	FunnelResult     = api.FunnelResult
+	PurgeReport      = api.PurgeReport
+	User             = api.User
+	APIKey           = api.APIKey
+	AuditEntry       = api.AuditEntry
+	ShareLink        = api.ShareLink
+)
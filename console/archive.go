@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archiveDir is where raw rows are written before they are purged.
+// Archiving is disabled when it is empty.
+var archiveDir string
+
+// ArchivedPageView is one page_views row as written to the archive.
+// The raw IP address is deliberately left out.
+type ArchivedPageView struct {
+	ID          int64  `json:"id"`
+	Timestamp   string `json:"timestamp"`
+	Path        string `json:"path"`
+	Referrer    string `json:"referrer"`
+	VisitorHash string `json:"visitor_hash"`
+	Country     string `json:"country"`
+	Region      string `json:"region"`
+	City        string `json:"city"`
+	Device      string `json:"device"`
+	Browser     string `json:"browser"`
+	OS          string `json:"os"`
+	Screen      string `json:"screen"`
+}
+
+// ArchivedEvent is one events row as written to the archive.
+type ArchivedEvent struct {
+	ID          int64  `json:"id"`
+	Timestamp   string `json:"timestamp"`
+	EventType   string `json:"event_type"`
+	VisitorHash string `json:"visitor_hash"`
+	Metadata    string `json:"metadata"`
+}
+
+// ArchiveEntry describes one archived day of one table.
+type ArchiveEntry struct {
+	Table     string `json:"table"`
+	Date      string `json:"date"`
+	File      string `json:"file"`
+	Rows      int    `json:"rows"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ArchiveManifest indexes every file in the archive directory.
+type ArchiveManifest struct {
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+const manifestName = "manifest.json"
+
+var archiveMu sync.Mutex
+
+// ArchiveBefore writes every full day of table (page_views or events) older
+// than cutoffDate (YYYY-MM-DD) to gzip NDJSON files under dir and records
+// them in the manifest. Days that are already in the manifest are skipped.
+func ArchiveBefore(dir, table, cutoffDate string) error {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		done[e.Table+"/"+e.Date] = true
+	}
+
+	days, err := archivableDays(table, cutoffDate)
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if done[table+"/"+day] {
+			continue
+		}
+		entry, err := archiveDay(dir, table, day)
+		if err != nil {
+			return fmt.Errorf("archive %s %s: %w", table, day, err)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		if err := saveManifest(dir, manifest); err != nil {
+			return err
+		}
+		slog.Info("archive written", "table", table, "day", day, "rows", entry.Rows)
+	}
+	return nil
+}
+
+func archivableDays(table, cutoffDate string) ([]string, error) {
+	cutoff, _ := time.Parse("2006-01-02", cutoffDate)
+	rows, err := readDB.Query(`SELECT DISTINCT date(ts, 'unixepoch') FROM `+table+` WHERE ts < ? ORDER BY 1`,
+		cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []string
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func archiveDay(dir, table, day string) (ArchiveEntry, error) {
+	rel := filepath.Join(table, day+".ndjson.gz")
+	dest := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return ArchiveEntry{}, err
+	}
+
+	t, _ := time.Parse("2006-01-02", day)
+	start, end := t.Unix(), t.AddDate(0, 0, 1).Unix()
+
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+
+	var n int
+	if table == "page_views" {
+		n, err = writePageViews(enc, start, end)
+	} else {
+		n, err = writeEvents(enc, start, end)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	// The source rows are deleted once this returns, so the file must be
+	// on disk first
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(dest))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return ArchiveEntry{}, err
+	}
+
+	return ArchiveEntry{
+		Table:     table,
+		Date:      day,
+		File:      filepath.ToSlash(rel),
+		Rows:      n,
+		CreatedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}, nil
+}
+
+// writePageViews and writeEvents read through readDB, so that beacons are
+// not held up while a day is written out.
+func writePageViews(enc *json.Encoder, start, end int64) (int, error) {
+	rows, err := readDB.Query(`
+		SELECT id, strftime('%Y-%m-%dT%H:%M:%SZ', ts, 'unixepoch'), path, referrer, visitor_hash, country, region, city, device, browser, os, screen
+		FROM page_views WHERE ts >= ? AND ts < ? ORDER BY ts, id`, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var pv ArchivedPageView
+		if err := rows.Scan(&pv.ID, &pv.Timestamp, &pv.Path, &pv.Referrer, &pv.VisitorHash, &pv.Country,
+			&pv.Region, &pv.City, &pv.Device, &pv.Browser, &pv.OS, &pv.Screen); err != nil {
+			return n, err
+		}
+		if err := enc.Encode(pv); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func writeEvents(enc *json.Encoder, start, end int64) (int, error) {
+	rows, err := readDB.Query(`
+		SELECT id, strftime('%Y-%m-%dT%H:%M:%SZ', ts, 'unixepoch'), event_type, visitor_hash, metadata
+		FROM events WHERE ts >= ? AND ts < ? ORDER BY ts, id`, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var ev ArchivedEvent
+		if err := rows.Scan(&ev.ID, &ev.Timestamp, &ev.EventType, &ev.VisitorHash, &ev.Metadata); err != nil {
+			return n, err
+		}
+		if err := enc.Encode(ev); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func loadManifest(dir string) (*ArchiveManifest, error) {
+	m := &ArchiveManifest{}
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse archive manifest: %w", err)
+	}
+	return m, nil
+}
+
+func saveManifest(dir string, m *ArchiveManifest) error {
+	sort.Slice(m.Entries, func(i, j int) bool {
+		if m.Entries[i].Date != m.Entries[j].Date {
+			return m.Entries[i].Date < m.Entries[j].Date
+		}
+		return m.Entries[i].Table < m.Entries[j].Table
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, manifestName)
+	if err := os.WriteFile(path+".tmp", data, 0o640); err != nil {
+		return err
+	}
+	if err := syncFile(path + ".tmp"); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// ArchiveFilter selects archived rows of Table on the days From to To,
+// inclusive, that match Filter. Filter has the API's syntax and meaning:
+// conditions on the other table match through visitor_hash against its
+// archived rows for the same days.
+type ArchiveFilter struct {
+	Table  string
+	From   string // YYYY-MM-DD, or empty for the first day
+	To     string // YYYY-MM-DD, or empty for the last day
+	Filter Filter
+}
+
+// archivedRow is a decoded archive line.
+type archivedRow interface {
+	column(name string) string
+}
+
+func (pv *ArchivedPageView) column(name string) string {
+	switch name {
+	case "path":
+		return pv.Path
+	case "referrer":
+		return pv.Referrer
+	case "country":
+		return pv.Country
+	case "region":
+		return pv.Region
+	case "city":
+		return pv.City
+	case "device":
+		return pv.Device
+	case "browser":
+		return pv.Browser
+	case "os":
+		return pv.OS
+	case "screen":
+		return pv.Screen
+	case "visitor_hash":
+		return pv.VisitorHash
+	}
+	return ""
+}
+
+func (ev *ArchivedEvent) column(name string) string {
+	switch name {
+	case "event_type":
+		return ev.EventType
+	case "visitor_hash":
+		return ev.VisitorHash
+	}
+	return ""
+}
+
+// matchAll reports whether row satisfies every condition in conds.
+func matchAll(conds []filterCond, row archivedRow) bool {
+	for _, c := range conds {
+		if !c.match(row.column(c.column)) {
+			return false
+		}
+	}
+	return true
+}
+
+// visitorMatcher applies the conditions on the other table, which need the
+// visitors that have rows there: the filter's include conditions must all
+// hold for one row, and no row may match an exclude condition.
+type visitorMatcher struct {
+	include  map[string]bool // nil when there are no include conditions
+	excluded map[string]bool
+}
+
+func (m *visitorMatcher) match(hash string) bool {
+	return (m.include == nil || m.include[hash]) && !m.excluded[hash]
+}
+
+// QueryArchive streams every archived row matching f to w as NDJSON and
+// returns the number of rows written.
+func QueryArchive(dir string, f ArchiveFilter, w io.Writer) (int, error) {
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	own, other := f.Filter.split(f.Table)
+	var visitors *visitorMatcher
+	if len(other) > 0 {
+		otherTable := "events"
+		if f.Table == "events" {
+			otherTable = "page_views"
+		}
+		if visitors, err = matchVisitors(dir, manifest, otherTable, f, other); err != nil {
+			return 0, err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+
+	total := 0
+	err = eachArchiveFile(dir, manifest, f.Table, f, func(row archivedRow) error {
+		if !matchAll(own, row) {
+			return nil
+		}
+		if visitors != nil && !visitors.match(row.column("visitor_hash")) {
+			return nil
+		}
+		total++
+		return enc.Encode(row)
+	})
+	return total, err
+}
+
+// matchVisitors scans table's archives in f's days for the visitors that
+// conds, the filter's conditions on that table, admit or rule out.
+func matchVisitors(dir string, manifest *ArchiveManifest, table string, f ArchiveFilter, conds []filterCond) (*visitorMatcher, error) {
+	m := &visitorMatcher{excluded: map[string]bool{}}
+	var include, exclude []filterCond
+	for _, c := range conds {
+		if c.exclude {
+			c.exclude = false
+			exclude = append(exclude, c)
+		} else {
+			include = append(include, c)
+		}
+	}
+	if len(include) > 0 {
+		m.include = map[string]bool{}
+	}
+	err := eachArchiveFile(dir, manifest, table, f, func(row archivedRow) error {
+		hash := row.column("visitor_hash")
+		if m.include != nil && matchAll(include, row) {
+			m.include[hash] = true
+		}
+		for _, c := range exclude {
+			if c.match(row.column(c.column)) {
+				m.excluded[hash] = true
+			}
+		}
+		return nil
+	})
+	return m, err
+}
+
+// eachArchiveFile calls fn with every row archived for table in f's days.
+func eachArchiveFile(dir string, manifest *ArchiveManifest, table string, f ArchiveFilter, fn func(archivedRow) error) error {
+	for _, e := range manifest.Entries {
+		if e.Table != table {
+			continue
+		}
+		if (f.From != "" && e.Date < f.From) || (f.To != "" && e.Date > f.To) {
+			continue
+		}
+		if err := scanArchiveFile(filepath.Join(dir, filepath.FromSlash(e.File)), table, fn); err != nil {
+			return fmt.Errorf("%s: %w", e.File, err)
+		}
+	}
+	return nil
+}
+
+func scanArchiveFile(path, table string, fn func(archivedRow) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	for {
+		var row archivedRow = &ArchivedPageView{}
+		if table == "events" {
+			row = &ArchivedEvent{}
+		}
+		if err := dec.Decode(row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	osuser "os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// auditMu serialises appends within this process; the immediate
+// transaction in appendAudit keeps a CLI command running alongside the
+// server from forking the chain.
+var auditMu sync.Mutex
+
+type auditKey struct{}
+
+// auditHash chains an entry to the one before it. The fields are hashed as
+// a JSON array so that no choice of values can collide with another.
+func auditHash(prev string, ts int64, e *AuditEntry) string {
+	fields, _ := json.Marshal([]any{ts, e.Principal, e.Action, e.Method, e.Path,
+		e.Params, e.Status, e.Bytes, e.DurationMS, e.Detail})
+	sum := sha256.Sum256(append([]byte(prev+"\n"), fields...))
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAudit adds an entry to the end of the chain, setting its ID,
+// time and hashes.
+func appendAudit(e *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	// BEGIN IMMEDIATE takes the write lock before the head of the chain is
+	// read, so another process appending waits out busy_timeout. A deferred
+	// transaction, as db.Begin starts, would read first and then fail with
+	// SQLITE_BUSY_SNAPSHOT when the other process wrote in between.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, `ROLLBACK`)
+		}
+	}()
+
+	err = conn.QueryRowContext(ctx, `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		e.PrevHash, err = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e.Time = now.UTC().Format(time.RFC3339)
+	e.Hash = auditHash(e.PrevHash, now.Unix(), e)
+	res, err := conn.ExecContext(ctx, `INSERT INTO audit_log (ts, principal, action, method, path, params, status, bytes, duration_ms, detail, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		now.Unix(), e.Principal, e.Action, e.Method, e.Path, e.Params, e.Status, e.Bytes, e.DurationMS, e.Detail, e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Audit records an action taken outside an authenticated request: a login,
+// a CLI command or a scheduled job. Failures are logged, not returned, so
+// that auditing never blocks the action itself.
+func Audit(principal, action, detail string) {
+	if err := appendAudit(&AuditEntry{Principal: principal, Action: action, Detail: detail}); err != nil {
+		slog.Error("audit", "action", action, "err", err)
+	}
+}
+
+// noteAudit marks the request's audit entry as an admin action. Without
+// it the entry's action is "request".
+func noteAudit(r *http.Request, action, detail string) {
+	if e, _ := r.Context().Value(auditKey{}).(*AuditEntry); e != nil {
+		e.Action, e.Detail = action, detail
+	}
+}
+
+// auditRequest runs next and records the request under principal, with
+// its status, response size and duration. The query is redacted as the
+// access log's is, so that no credential in it is kept.
+func auditRequest(w http.ResponseWriter, r *http.Request, principal string, next http.HandlerFunc) {
+	// redact only matches parameters after a "?" or "&"
+	params := redact("?" + r.URL.RawQuery)[1:]
+	e := &AuditEntry{Principal: principal, Action: "request", Method: r.Method, Path: r.URL.Path, Params: params}
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	// Deferred so that streams and aborted exports are recorded too
+	defer func() {
+		e.Status, e.Bytes = rec.status, rec.bytes
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.DurationMS = time.Since(start).Milliseconds()
+		if err := appendAudit(e); err != nil {
+			slog.ErrorContext(r.Context(), "audit", "method", r.Method, "path", r.URL.Path, "err", err)
+		}
+	}()
+	next(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, e)))
+}
+
+// cliPrincipal names the operator of a CLI command.
+func cliPrincipal() string {
+	if u, err := osuser.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return "cli:" + name
+	}
+	return "cli"
+}
+
+const auditColumns = `id, ts, principal, action, method, path, params, status, bytes, duration_ms, detail, prev_hash, hash`
+
+func scanAudit(rows *sql.Rows) (AuditEntry, int64, error) {
+	var e AuditEntry
+	var ts int64
+	err := rows.Scan(&e.ID, &ts, &e.Principal, &e.Action, &e.Method, &e.Path, &e.Params,
+		&e.Status, &e.Bytes, &e.DurationMS, &e.Detail, &e.PrevHash, &e.Hash)
+	e.Time = time.Unix(ts, 0).UTC().Format(time.RFC3339)
+	return e, ts, err
+}
+
+// AuditQuery selects a page of the audit log.
+type AuditQuery struct {
+	Range     *TimeRange // nil for the whole log
+	Principal string     // exact match, empty for all
+	Action    string     // exact match, empty for all
+	Before    int64      // only entries with a lower ID, 0 for the newest
+	Limit     int
+}
+
+// QueryAudit returns matching entries, newest first.
+func QueryAudit(ctx context.Context, q AuditQuery) (api.AuditPage, error) {
+	where, args := []string{"1"}, []any{}
+	if q.Range != nil {
+		where, args = append(where, "ts >= ?", "ts < ?"), append(args, q.Range.From.Unix(), q.Range.To.Unix())
+	}
+	if q.Principal != "" {
+		where, args = append(where, "principal = ?"), append(args, q.Principal)
+	}
+	if q.Action != "" {
+		where, args = append(where, "action = ?"), append(args, q.Action)
+	}
+	if q.Before > 0 {
+		where, args = append(where, "id < ?"), append(args, q.Before)
+	}
+	// One extra row tells whether there is another page
+	rows, err := readDB.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id DESC LIMIT ?`, append(args, q.Limit+1)...)
+	if err != nil {
+		return api.AuditPage{}, err
+	}
+	defer rows.Close()
+
+	page := api.AuditPage{Entries: []AuditEntry{}}
+	for rows.Next() {
+		e, _, err := scanAudit(rows)
+		if err != nil {
+			return page, err
+		}
+		if len(page.Entries) == q.Limit {
+			page.NextBefore = page.Entries[q.Limit-1].ID
+			break
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	return page, rows.Err()
+}
+
+// VerifyAudit walks the chain from the oldest entry kept, recomputing each
+// hash and checking that it links to the entry before.
+func VerifyAudit(ctx context.Context) (api.AuditVerification, error) {
+	var v api.AuditVerification
+	rows, err := readDB.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log ORDER BY id`)
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+
+	var prev string
+	for rows.Next() {
+		e, ts, err := scanAudit(rows)
+		if err != nil {
+			return v, err
+		}
+		switch {
+		case v.Checked > 0 && e.PrevHash != prev:
+			v.Problem = fmt.Sprintf("entry %d does not link to entry %d", e.ID, v.LastID)
+		case auditHash(e.PrevHash, ts, &e) != e.Hash:
+			v.Problem = fmt.Sprintf("entry %d does not match its hash", e.ID)
+		}
+		if v.Problem != "" {
+			v.BrokenAt = e.ID
+			return v, nil
+		}
+		if v.Checked == 0 {
+			v.FirstID = e.ID
+		}
+		v.Checked++
+		v.LastID = e.ID
+		prev = e.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return v, err
+	}
+	v.OK = true
+	return v, nil
+}
+
+// pruneAudit deletes entries older than days, oldest first, and records
+// where the chain now starts so that verification from there can be
+// trusted. The newest entry is always kept, as the delete trigger demands.
+func pruneAudit(days, chunk int, dryRun bool) (int64, error) {
+	const prunable = `ts < ? AND id < (SELECT MAX(id) FROM audit_log)`
+	cutoff := dayStart(days)
+	if dryRun {
+		return countRows("audit_log", prunable, cutoff)
+	}
+	var lastID int64
+	var lastHash string
+	err := db.QueryRow(`SELECT id, hash FROM audit_log WHERE `+prunable+` ORDER BY id DESC LIMIT 1`, cutoff).Scan(&lastID, &lastHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("purge audit_log: %w", err)
+	}
+	n, err := chunked(`DELETE FROM audit_log WHERE id IN
+		(SELECT id FROM audit_log WHERE id <= ? ORDER BY id LIMIT ?)`, lastID, chunk)
+	if err != nil {
+		return n, fmt.Errorf("purge audit_log: %w", err)
+	}
+	Audit("system", "audit.prune", fmt.Sprintf("removed %d entries up to id %d, hash %s", n, lastID, lastHash))
+	return n, nil
+}
+
+// handleAuditLog returns a page of the audit log, newest first, with
+// optional principal and action filters. The whole log is searched unless
+// a time range is given.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := AuditQuery{Principal: params.Get("principal"), Action: params.Get("action"), Limit: 100}
+	var err error
+	if params.Has("preset") || params.Has("from") || params.Has("period") {
+		rng, err := ParseTimeRange(params, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Range = &rng
+	}
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > 1000 {
+			http.Error(w, "limit must be 1-1000", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := params.Get("before"); s != "" {
+		if q.Before, err = strconv.ParseInt(s, 10, 64); err != nil || q.Before < 1 {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := QueryAudit(r.Context(), q)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "audit log", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleVerifyAudit checks the audit log's hash chain.
+func handleVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	v, err := VerifyAudit(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "audit verify", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// appendOldAudit adds an entry dated ts to the end of the chain, as
+// appendAudit would have at the time.
+func appendOldAudit(t *testing.T, ts int64, detail string) {
+	t.Helper()
+	var prev string
+	db.QueryRow(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&prev)
+	e := &AuditEntry{Principal: "test", Action: "old", Detail: detail}
+	_, err := db.Exec(`INSERT INTO audit_log (ts, principal, action, method, path, params, status, bytes, duration_ms, detail, prev_hash, hash)
+		VALUES (?, ?, ?, '', '', '', 0, 0, 0, ?, ?, ?)`, ts, e.Principal, e.Action, e.Detail, prev, auditHash(prev, ts, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verifyAudit(t *testing.T) api.AuditVerification {
+	t.Helper()
+	v, err := VerifyAudit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// TestAuditPrune appends entries, prunes the old ones and checks that the
+// rest of the chain still verifies from its new start.
+func TestAuditPrune(t *testing.T) {
+	openTestDB(t)
+	old := time.Now().AddDate(0, 0, -100).Unix()
+	for _, detail := range []string{"a", "b", "c"} {
+		appendOldAudit(t, old, detail)
+	}
+	Audit("test", "recent", "d")
+	Audit("test", "recent", "e")
+	if v := verifyAudit(t); !v.OK || v.Checked != 5 || v.FirstID != 1 || v.LastID != 5 {
+		t.Fatalf("before pruning: %+v", v)
+	}
+
+	if n, err := pruneAudit(90, 3, true); n != 3 || err != nil {
+		t.Fatalf("dry run: %d, %v; want 3", n, err)
+	}
+	// A chunk of 1 deletes one entry at a time, each the oldest left
+	if n, err := pruneAudit(90, 1, false); n != 3 || err != nil {
+		t.Fatalf("prune: %d, %v; want 3", n, err)
+	}
+	v := verifyAudit(t)
+	if !v.OK || v.FirstID != 4 || v.Checked != 3 {
+		t.Errorf("after pruning: %+v; want 3 entries from 4, the last the prune's own", v)
+	}
+	page, err := QueryAudit(context.Background(), AuditQuery{Action: "audit.prune", Limit: 1})
+	if err != nil || len(page.Entries) != 1 || !strings.Contains(page.Entries[0].Detail, "up to id 3") {
+		t.Errorf("prune entry: %+v, %v", page.Entries, err)
+	}
+
+	if n, err := pruneAudit(90, 1, false); n != 0 || err != nil {
+		t.Errorf("second prune: %d, %v; want nothing to do", n, err)
+	}
+}
+
+// TestAuditNewestKept checks that pruning keeps the newest entry even when
+// it is old, as the chain would otherwise lose its head.
+func TestAuditNewestKept(t *testing.T) {
+	openTestDB(t)
+	old := time.Now().AddDate(0, 0, -100).Unix()
+	appendOldAudit(t, old, "a")
+	appendOldAudit(t, old, "b")
+	if n, err := pruneAudit(90, 10, false); n != 1 || err != nil {
+		t.Fatalf("prune: %d, %v; want 1", n, err)
+	}
+	if v := verifyAudit(t); !v.OK || v.FirstID != 2 {
+		t.Errorf("after pruning: %+v", v)
+	}
+}
+
+// TestAuditTriggers checks that entries cannot be changed, nor deleted but
+// from the start of the chain.
+func TestAuditTriggers(t *testing.T) {
+	openTestDB(t)
+	for _, detail := range []string{"a", "b", "c", "d"} {
+		Audit("test", "entry", detail)
+	}
+
+	refused := []string{
+		`UPDATE audit_log SET detail = 'x' WHERE id = 2`,
+		`UPDATE audit_log SET principal = 'x'`,
+		`DELETE FROM audit_log WHERE id = 2`,
+		`DELETE FROM audit_log WHERE id = 4`,
+		`DELETE FROM audit_log WHERE id >= 3`,
+		`DELETE FROM audit_log`,
+	}
+	for _, stmt := range refused {
+		if _, err := db.Exec(stmt); err == nil {
+			t.Errorf("%s: allowed", stmt)
+		}
+	}
+	if v := verifyAudit(t); !v.OK || v.Checked != 4 {
+		t.Fatalf("after refused changes: %+v", v)
+	}
+
+	if _, err := db.Exec(`DELETE FROM audit_log WHERE id = 1`); err != nil {
+		t.Errorf("deleting the oldest entry: %v", err)
+	}
+	if v := verifyAudit(t); !v.OK || v.FirstID != 2 {
+		t.Errorf("after deleting the oldest entry: %+v", v)
+	}
+}
+
+// TestAuditBrokenAt tampers with the chain past the triggers, as someone
+// with the database file could, and checks that verification finds where.
+func TestAuditBrokenAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper string
+		broken int64
+	}{
+		{"modified", `UPDATE audit_log SET detail = 'forged' WHERE id = 3`, 3},
+		{"removed", `DELETE FROM audit_log WHERE id = 3`, 4},
+		{"rehashed", `UPDATE audit_log SET hash = 'x' WHERE id = 2`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			for _, detail := range []string{"a", "b", "c", "d", "e"} {
+				Audit("test", "entry", detail)
+			}
+			if _, err := db.Exec(`DROP TRIGGER audit_log_append_only; DROP TRIGGER audit_log_prune_only`); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(tt.tamper); err != nil {
+				t.Fatal(err)
+			}
+			v := verifyAudit(t)
+			if v.OK || v.BrokenAt != tt.broken || v.Problem == "" {
+				t.Errorf("verification: %+v; want broken at %d", v, tt.broken)
+			}
+		})
+	}
+}
+
+// TestAuditRequestRedacts checks that credentials in a request's query are
+// not stored in its audit entry.
+func TestAuditRequestRedacts(t *testing.T) {
+	openTestDB(t)
+	r := httptest.NewRequest("GET", "/api/analytics/stats?period=30d&token=t0ken&code=c0de&state=st4te&path=/a", nil)
+	w := httptest.NewRecorder()
+	auditRequest(w, r, "alice", func(w http.ResponseWriter, r *http.Request) {
+		noteAudit(r, "stats.read", "detail")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("body"))
+	})
+
+	page, err := QueryAudit(context.Background(), AuditQuery{Limit: 10})
+	if err != nil || len(page.Entries) != 1 {
+		t.Fatalf("entries: %+v, %v", page.Entries, err)
+	}
+	e := page.Entries[0]
+	for _, secret := range []string{"t0ken", "c0de", "st4te"} {
+		if strings.Contains(e.Params, secret) {
+			t.Errorf("params %q keep %q", e.Params, secret)
+		}
+	}
+	if want := "period=30d&token=[redacted]&code=[redacted]&state=[redacted]&path=/a"; e.Params != want {
+		t.Errorf("params %q, want %q", e.Params, want)
+	}
+	if e.Principal != "alice" || e.Action != "stats.read" || e.Detail != "detail" ||
+		e.Method != "GET" || e.Path != "/api/analytics/stats" || e.Status != http.StatusTeapot || e.Bytes != 4 {
+		t.Errorf("entry %+v", e)
+	}
+	if v := verifyAudit(t); !v.OK {
+		t.Errorf("verification: %+v", v)
+	}
+}
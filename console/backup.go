@@ -0,0 +1,365 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// BackupConfig controls where snapshots are written and how many are kept.
+type BackupConfig struct {
+	Dir      string
+	Gzip     bool
+	Keep     int
+	Interval time.Duration
+}
+
+var backupCfg = BackupConfig{Dir: "backups", Keep: 7}
+
+const backupPrefix = "analytics-"
+
+// BackupDatabase writes a consistent snapshot of the live database into dir
+// using VACUUM INTO, which is safe to run while the server is writing in
+// WAL mode. Returns the path of the finished file.
+func BackupDatabase(dir string, compress bool) (string, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", fmt.Errorf("create backup dir: %w", err)
+	}
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	dest := filepath.Join(dir, name)
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+
+	if _, err := db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("vacuum into: %w", err)
+	}
+
+	if compress {
+		dest += ".gz"
+		if err := gzipFile(tmp, dest); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		os.Remove(tmp)
+		return dest, syncDir(dir)
+	}
+
+	if err := syncFile(tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("sync backup: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("finalize backup: %w", err)
+	}
+	return dest, syncDir(dir)
+}
+
+// RotateBackups deletes all but the keep most recent snapshots in dir.
+func RotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasPrefix(n, backupPrefix) {
+			continue
+		}
+		if strings.HasSuffix(n, ".db") || strings.HasSuffix(n, ".db.gz") {
+			names = append(names, n)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+
+	// Timestamped names sort chronologically
+	sort.Strings(names)
+	for _, n := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, n)); err != nil {
+			return err
+		}
+		slog.Info("backup rotated out", "file", n)
+	}
+	return nil
+}
+
+// errDatabaseInUse refuses a restore over a database another process,
+// such as the running server, has open.
+var errDatabaseInUse = errors.New("database is in use; stop the server before restoring")
+
+// RestoreDatabase verifies a snapshot and swaps it in place of dbPath. It
+// refuses if another process has dbPath open.
+func RestoreDatabase(src, dbPath string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		lock, err := lockDatabase(dbPath)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+	}
+
+	staged := dbPath + ".restore"
+	os.Remove(staged)
+
+	if strings.HasSuffix(src, ".gz") {
+		if err := gunzipFile(src, staged); err != nil {
+			return err
+		}
+	} else if err := copyFile(src, staged); err != nil {
+		return err
+	}
+
+	if err := verifySnapshot(staged); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	// Keep the database being replaced, and drop its WAL so SQLite does
+	// not replay stale pages over the restored file.
+	if _, err := os.Stat(dbPath); err == nil {
+		prev := dbPath + ".pre-restore"
+		if err := os.Rename(dbPath, prev); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("move current database aside: %w", err)
+		}
+		slog.Info("restore: previous database kept", "path", prev)
+	}
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+
+	if err := os.Rename(staged, dbPath); err != nil {
+		return fmt.Errorf("install restored database: %w", err)
+	}
+	return nil
+}
+
+// lockDatabase opens path in exclusive locking mode and takes the lock,
+// which fails at once while any other connection has the database open:
+// in WAL mode each one holds a shared lock until it closes. The lock is
+// kept until the returned handle is closed. The WAL is checkpointed, so
+// the file alone holds every committed write.
+func lockDatabase(path string) (*sql.DB, error) {
+	lock, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(0)&_pragma=locking_mode(EXCLUSIVE)")
+	if err != nil {
+		return nil, err
+	}
+	lock.SetMaxOpenConns(1)
+	if _, err := lock.Exec(`BEGIN EXCLUSIVE`); err != nil {
+		lock.Close()
+		if strings.Contains(err.Error(), "SQLITE_BUSY") || strings.Contains(err.Error(), "locked") {
+			return nil, errDatabaseInUse
+		}
+		return nil, fmt.Errorf("lock database: %w", err)
+	}
+	if _, err := lock.Exec(`COMMIT`); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("lock database: %w", err)
+	}
+	if _, err := lock.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("checkpoint database: %w", err)
+	}
+	return lock, nil
+}
+
+// verifySnapshot runs PRAGMA integrity_check and checks the schema version
+// of a standalone database file.
+func verifySnapshot(path string) error {
+	snap, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer snap.Close()
+
+	var result string
+	if err := snap.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	var version int
+	if err := snap.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("snapshot schema version %d is newer than supported version %d", version, schemaVersion)
+	}
+
+	var n int
+	snap.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type IN ('table', 'view') AND name IN ('page_views', 'events')`).Scan(&n)
+	if n != 2 {
+		return fmt.Errorf("snapshot is not an analytics database")
+	}
+	return nil
+}
+
+// StartBackupLoop takes a snapshot every backupCfg.Interval and rotates old ones.
+func StartBackupLoop() {
+	if backupCfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(backupCfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if path, err := runBackup(); err == nil {
+				Audit("system", "backup", path)
+			}
+		}
+	}()
+}
+
+func runBackup() (string, error) {
+	cfg := setting(&backupCfg)
+	path, err := BackupDatabase(cfg.Dir, cfg.Gzip)
+	if err != nil {
+		slog.Error("backup failed", "err", err)
+		return "", err
+	}
+	slog.Info("backup written", "path", path)
+	if err := RotateBackups(cfg.Dir, cfg.Keep); err != nil {
+		slog.Error("backup rotation", "err", err)
+	}
+	return path, nil
+}
+
+// handleBackup takes an on-demand snapshot.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	path, err := runBackup()
+	if err != nil {
+		http.Error(w, "backup failed", http.StatusInternalServerError)
+		return
+	}
+
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+	}
+	noteAudit(r, "backup", path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.BackupResult{Path: path, Size: size})
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Compress into a temporary name, so that a crash never leaves a
+	// partial file that rotation would count as a snapshot
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compress backup: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("finalize backup: %w", err)
+	}
+	return nil
+}
+
+func gunzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("decompress backup: %w", err)
+	}
+	defer zr.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, zr); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("decompress backup: %w", err)
+	}
+	return out.Close()
+}
+
+// syncFile flushes the file at path to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir flushes dir's entries to disk, making renames into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
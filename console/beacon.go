@@ -5,15 +5,6 @@ import (
 	"strings"
 )
 
-// BeaconPayload represents the JSON body from the client beacon.
-type BeaconPayload struct {
-	Type     string `json:"type"`     // "pageview" or event type (pwa_install, pwa_prompt, file_download)
-	Path     string `json:"path"`     // page path
-	Referrer string `json:"referrer"` // document.referrer
-	Screen   string `json:"screen"`   // e.g. "1920x1080"
-	Metadata string `json:"metadata"` // extra info for events (e.g. filename)
-}
-
 // ParseBeacon parses and validates a beacon JSON payload.
 func ParseBeacon(body []byte) (*BeaconPayload, error) {
 	var bp BeaconPayload
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// benchQuery is one dashboard query in the legacy TEXT-timestamp form and
+// the integer-epoch form.
+type benchQuery struct {
+	name   string
+	legacy string
+	epoch  string
+}
+
+var benchQueries = []benchQuery{
+	{
+		"total views",
+		`SELECT COUNT(*) FROM page_views WHERE timestamp >= ?`,
+		`SELECT COUNT(*) FROM page_views WHERE ts >= ?`,
+	},
+	{
+		"unique visitors",
+		`SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE timestamp >= ?`,
+		`SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ?`,
+	},
+	{
+		"time series",
+		`SELECT date(timestamp) AS d, COUNT(*), COUNT(DISTINCT visitor_hash) FROM page_views
+		 WHERE timestamp >= ? GROUP BY d ORDER BY d`,
+		`SELECT date(ts, 'unixepoch') AS d, COUNT(*), COUNT(DISTINCT visitor_hash) FROM page_views
+		 WHERE ts >= ? GROUP BY d ORDER BY d`,
+	},
+	{
+		"top pages",
+		`SELECT path, COUNT(*) AS c FROM page_views WHERE timestamp >= ? GROUP BY path ORDER BY c DESC LIMIT 20`,
+		`SELECT path, COUNT(*) AS c FROM page_views WHERE ts >= ? GROUP BY path ORDER BY c DESC LIMIT 20`,
+	},
+	{
+		"browsers",
+		`SELECT browser, COUNT(*) AS c FROM page_views WHERE timestamp >= ? AND browser != ''
+		 GROUP BY browser ORDER BY c DESC LIMIT 10`,
+		`SELECT browser, COUNT(*) AS c FROM page_views WHERE ts >= ? AND browser != ''
+		 GROUP BY browser ORDER BY c DESC LIMIT 10`,
+	},
+}
+
+// RunBenchmark builds a synthetic database of n page views spread over 90
+// days in both the legacy TEXT-timestamp layout and the current integer
+// layout, then times the dashboard queries against each, and the whole
+// stats request against the current layout, and writes a table to out.
+//
+// Results on a 10M-row database (pure-Go SQLite driver, one core, best of 3):
+//
+//	query            window  before   after      speedup
+//	total views      7d      28ms     24ms       1.1x
+//	unique visitors  7d      9.644s   4.053s     2.4x
+//	time series      7d      7.557s   3.61s      2.1x
+//	top pages        7d      4.001s   951ms      4.2x
+//	browsers         7d      4.532s   5.214s     0.9x
+//	stats request    7d      -        41.967s    -
+//	total views      30d     163ms    176ms      0.9x
+//	unique visitors  30d     53.078s  19.572s    2.7x
+//	time series      30d     33.461s  18.037s    1.9x
+//	top pages        30d     36.167s  4.722s     7.7x
+//	browsers         30d     19.317s  3.045s     6.3x
+//	stats request    30d     -        1m54.055s  -
+//
+// Browsers, like the other device breakdowns, reads the (ts, device,
+// browser, os) index rather than the table rows, though its 7d time has
+// varied from 0.7s to 5.2s between runs. Total views is a count over the
+// ts index either way; its difference is noise.
+//
+// The integer layout does not make a database this size servable: the
+// distinct-visitor counts still sort every view in the window, and the
+// stats request runs well past queryTimeouts.Stats (8s). On 2M rows it
+// takes 3.7s for 7 days and 19s for 30, so the supported scale is about
+// 300,000 page views in the requested window, e.g. 10,000 a day for a
+// 30-day dashboard. Beyond that the dashboard answers 503, and raising
+// -stats-timeout does not help past the server's fixed 10s WriteTimeout.
+func RunBenchmark(dir string, n int, out io.Writer) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	legacyPath := filepath.Join(dir, "bench-legacy.db")
+	epochPath := filepath.Join(dir, "bench-epoch.db")
+	for _, p := range []string{legacyPath, epochPath} {
+		os.Remove(p)
+		os.Remove(p + "-wal")
+		os.Remove(p + "-shm")
+	}
+
+	slog.Info("bench: generating legacy rows", "rows", n)
+	legacy, err := openBenchDB(legacyPath)
+	if err != nil {
+		return err
+	}
+	defer legacy.Close()
+	if err := generateLegacy(legacy, n); err != nil {
+		return fmt.Errorf("generate legacy: %w", err)
+	}
+
+	slog.Info("bench: converting to integer layout")
+	saved, savedRead := db, readDB
+	defer func() { db, readDB = saved, savedRead }()
+	db, err = openBenchDB(epochPath)
+	if err != nil {
+		return err
+	}
+	epoch := db
+	readDB = epoch
+	defer epoch.Close()
+	if err := createSchema(); err != nil {
+		return err
+	}
+	if _, err := epoch.Exec(`ATTACH DATABASE ? AS legacy`, legacyPath); err != nil {
+		return err
+	}
+	if _, err := epoch.Exec(`
+		INSERT INTO page_views (id, ts, path, referrer, visitor_hash, country, device, browser, os, screen)
+		SELECT id, CAST(strftime('%s', timestamp) AS INTEGER), path, referrer, visitor_hash, country, device, browser, os, screen
+		FROM legacy.page_views`); err != nil {
+		return err
+	}
+	epoch.Exec(`DETACH DATABASE legacy`)
+	if err := createIndexes(); err != nil {
+		return err
+	}
+	epoch.Exec(`ANALYZE`)
+
+	// Fold both WALs into the main files so neither side pays for WAL lookups
+	for _, d := range []*sql.DB{legacy, epoch} {
+		if _, err := d.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "query\twindow\tbefore\tafter\tspeedup")
+	now := time.Now().UTC()
+	for _, days := range []int{7, 30} {
+		since := now.AddDate(0, 0, -days)
+		for _, q := range benchQueries {
+			before, err := timeQuery(legacy, q.legacy, since.Format("2006-01-02T15:04:05Z"))
+			if err != nil {
+				return fmt.Errorf("%s (legacy): %w", q.name, err)
+			}
+			after, err := timeQuery(epoch, q.epoch, since.Unix())
+			if err != nil {
+				return fmt.Errorf("%s: %w", q.name, err)
+			}
+			fmt.Fprintf(tw, "%s\t%dd\t%s\t%s\t%.1fx\n", q.name, days,
+				before.Round(time.Millisecond), after.Round(time.Millisecond),
+				float64(before)/float64(after))
+		}
+		stats, err := timeStats(TimeRange{From: since, To: now, Loc: time.UTC})
+		if err != nil {
+			return fmt.Errorf("stats request: %w", err)
+		}
+		fmt.Fprintf(tw, "stats request\t%dd\t-\t%s\t-\n", days, stats.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// timeStats runs the whole /api/analytics/stats query three times and
+// returns the fastest run.
+func timeStats(rng TimeRange) (time.Duration, error) {
+	best := time.Duration(-1)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, err := QueryStatsContext(context.Background(), rng, Filter{}); err != nil {
+			return 0, err
+		}
+		if elapsed := time.Since(start); best < 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best, nil
+}
+
+func openBenchDB(path string) (*sql.DB, error) {
+	d, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=OFF", "PRAGMA cache_size=-20000"} {
+		if _, err := d.Exec(p); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// generateLegacy fills the pre-epoch schema with synthetic traffic.
+func generateLegacy(d *sql.DB, n int) error {
+	stmts := []string{
+		`CREATE TABLE page_views (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp TEXT NOT NULL,
+			path TEXT NOT NULL,
+			referrer TEXT NOT NULL DEFAULT '',
+			visitor_hash TEXT NOT NULL,
+			country TEXT NOT NULL DEFAULT '',
+			device TEXT NOT NULL DEFAULT '',
+			browser TEXT NOT NULL DEFAULT '',
+			os TEXT NOT NULL DEFAULT '',
+			screen TEXT NOT NULL DEFAULT ''
+		)`,
+	}
+	for _, s := range stmts {
+		if _, err := d.Exec(s); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now().UTC().AddDate(0, 0, -90).Unix()
+	const batch = 500000
+	for done := 0; done < n; done += batch {
+		size := min(batch, n-done)
+		_, err := d.Exec(`
+			WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+			INSERT INTO page_views (timestamp, path, referrer, visitor_hash, country, device, browser, os, screen)
+			SELECT
+				strftime('%Y-%m-%dT%H:%M:%SZ', ? + abs(random()) % (90 * 86400), 'unixepoch'),
+				'/lesson-' || (abs(random()) % 500),
+				CASE abs(random()) % 4 WHEN 0 THEN 'google.com' WHEN 1 THEN 'facebook.com' ELSE '' END,
+				printf('%016x', abs(random()) % 2000000),
+				CASE abs(random()) % 5 WHEN 0 THEN 'KE' WHEN 1 THEN 'GB' ELSE 'US' END,
+				CASE abs(random()) % 3 WHEN 0 THEN 'Mobile' WHEN 1 THEN 'Tablet' ELSE 'Desktop' END,
+				CASE abs(random()) % 4 WHEN 0 THEN 'Chrome' WHEN 1 THEN 'Safari' WHEN 2 THEN 'Firefox' ELSE 'Edge' END,
+				CASE abs(random()) % 4 WHEN 0 THEN 'Windows' WHEN 1 THEN 'iOS' WHEN 2 THEN 'Android' ELSE 'macOS' END,
+				'1920x1080'
+			FROM seq`, size, start)
+		if err != nil {
+			return err
+		}
+	}
+
+	indexes := []string{
+		`CREATE INDEX idx_pv_timestamp ON page_views(timestamp)`,
+		`CREATE INDEX idx_pv_visitor ON page_views(visitor_hash)`,
+		`CREATE INDEX idx_pv_path ON page_views(path)`,
+		`ANALYZE`,
+	}
+	for _, s := range indexes {
+		if _, err := d.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeQuery runs query three times and returns the fastest run.
+func timeQuery(d *sql.DB, query string, arg any) (time.Duration, error) {
+	best := time.Duration(-1)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		rows, err := d.Query(query, arg)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if elapsed := time.Since(start); best < 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,194 @@
+// Package client is a Go client for the noblemind-console HTTP API.
+//
+//	c := client.New("https://console.example.org", os.Getenv("CONSOLE_API_KEY"))
+//	stats, err := c.Stats(ctx, client.Query{Preset: "last_week"}, "previous")
+//
+// Idempotent requests (GET and DELETE) are retried on network errors and
+// on 429, 502, 503 and 504 responses, honouring Retry-After.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of one console.
+type Client struct {
+	BaseURL    string // e.g. https://console.example.org
+	Token      string // an API key, or the server's legacy -token
+	HTTPClient *http.Client
+
+	MaxRetries int           // retries of idempotent requests
+	Backoff    time.Duration // delay before the first retry, doubled after each
+	MaxBackoff time.Duration // longest delay between retries
+}
+
+// New returns a client for the console at baseURL.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// Error is a non-2xx response.
+type Error struct {
+	StatusCode int
+	Message    string // the response body, as sent by the server
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("console: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Query selects a reporting window and segment. Zero fields are left to
+// the server's defaults (the last 7 days, unfiltered).
+type Query struct {
+	Preset string // today, yesterday, this_week, ...
+	From   string // YYYY-MM-DD or RFC 3339
+	To     string // YYYY-MM-DD (inclusive) or RFC 3339
+	Period string // e.g. "30d"
+	TZ     string // IANA zone name
+
+	// Filter holds segment filters such as "country" or "path_prefix".
+	// Prefix a value with "!" to exclude it.
+	Filter url.Values
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	for k, vs := range q.Filter {
+		v[k] = append([]string(nil), vs...)
+	}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	set("preset", q.Preset)
+	set("from", q.From)
+	set("to", q.To)
+	set("period", q.Period)
+	set("tz", q.TZ)
+	return v
+}
+
+// retryable reports whether a response status is worth retrying.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// send performs a request, retrying idempotent ones, and returns the
+// response of the final attempt. Non-2xx responses are returned as *Error.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	idempotent := method == http.MethodGet || method == http.MethodDelete
+
+	delay := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		last := !idempotent || attempt >= c.MaxRetries
+		if err != nil {
+			if last || ctx.Err() != nil {
+				return nil, err
+			}
+		} else if resp.StatusCode < 300 {
+			return resp, nil
+		} else {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			apiErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+			if last || !retryable(resp.StatusCode) {
+				return nil, apiErr
+			}
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+				delay = time.Duration(s) * time.Second
+			}
+		}
+
+		wait := min(delay, c.MaxBackoff)
+		wait += time.Duration(rand.Int64N(int64(wait)/4 + 1)) // jitter
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// do sends a request and decodes a JSON response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("console: decode %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// get is do for GET requests returning a T.
+func get[T any](ctx context.Context, c *Client, path string, query url.Values) (*T, error) {
+	out := new(T)
+	if err := c.do(ctx, http.MethodGet, path, query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OpenAPI returns the server's OpenAPI document.
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	doc, err := get[json.RawMessage](ctx, c, "/api/openapi.json", nil)
+	if err != nil {
+		return nil, err
+	}
+	return *doc, nil
+}
+
+var errStreamClosed = errors.New("console: stream closed by server")
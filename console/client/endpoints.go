@@ -0,0 +1,385 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"noblemind-console/api"
+)
+
+// SendBeacon records a page view or event, as the site's tracking script
+// does. It is not retried, since a repeated beacon would be counted twice.
+func (c *Client) SendBeacon(ctx context.Context, b api.Beacon) error {
+	return c.do(ctx, http.MethodPost, "/api/analytics/event", nil, b, nil)
+}
+
+// Stats returns dashboard totals, time series and top lists. compare, if
+// set, is "previous" or "year".
+func (c *Client) Stats(ctx context.Context, q Query, compare string) (*api.StatsResult, error) {
+	v := q.values()
+	if compare != "" {
+		v.Set("compare", compare)
+	}
+	return get[api.StatsResult](ctx, c, "/api/analytics/stats", v)
+}
+
+// Realtime returns the visitors active in the last 30 minutes within the
+// segment filter.
+func (c *Client) Realtime(ctx context.Context, filter url.Values) (*api.RealtimeResult, error) {
+	return get[api.RealtimeResult](ctx, c, "/api/analytics/realtime", Query{Filter: filter}.values())
+}
+
+// Recent returns the latest page views, at most limit (1-200).
+func (c *Client) Recent(ctx context.Context, limit int) ([]api.RecentVisit, error) {
+	visits, err := get[[]api.RecentVisit](ctx, c, "/api/analytics/recent", url.Values{"limit": {strconv.Itoa(limit)}})
+	if err != nil {
+		return nil, err
+	}
+	return *visits, nil
+}
+
+// BreakdownOptions configures a breakdown; zero fields use the server's
+// defaults.
+type BreakdownOptions struct {
+	Dimension string // required
+	Pivot     string
+	Metric    string // views, visitors, events or sessions
+	Sort      string // -value, value, name or -name
+	Limit     int
+	Offset    int
+}
+
+// Breakdown returns a metric grouped by one or two dimensions.
+func (c *Client) Breakdown(ctx context.Context, q Query, opt BreakdownOptions) (*api.BreakdownResult, error) {
+	v := q.values()
+	setAll(v, "dimension", opt.Dimension, "pivot", opt.Pivot, "metric", opt.Metric, "sort", opt.Sort)
+	setInt(v, "limit", opt.Limit)
+	setInt(v, "offset", opt.Offset)
+	return get[api.BreakdownResult](ctx, c, "/api/analytics/breakdown", v)
+}
+
+// Timeseries returns metric per bucket of granularity (minute, hour, day,
+// week or month); empty values use the server's defaults.
+func (c *Client) Timeseries(ctx context.Context, q Query, metric, granularity string) (*api.TimeseriesResult, error) {
+	v := q.values()
+	setAll(v, "metric", metric, "granularity", granularity)
+	return get[api.TimeseriesResult](ctx, c, "/api/analytics/timeseries", v)
+}
+
+// Paths returns entry and exit pages, transitions (leaving pages under
+// after, if set) and common sequences, at most limit of each.
+func (c *Client) Paths(ctx context.Context, q Query, after string, limit int) (*api.PathsResult, error) {
+	v := q.values()
+	setAll(v, "after", after)
+	setInt(v, "limit", limit)
+	return get[api.PathsResult](ctx, c, "/api/analytics/paths", v)
+}
+
+// Goals reports conversions of every goal.
+func (c *Client) Goals(ctx context.Context, q Query) (*api.GoalsResult, error) {
+	return get[api.GoalsResult](ctx, c, "/api/analytics/goals", q.values())
+}
+
+// Funnel reports how many visitors reached each step of funnel id.
+func (c *Client) Funnel(ctx context.Context, id int64, q Query) (*api.FunnelResult, error) {
+	return get[api.FunnelResult](ctx, c, "/api/analytics/funnels/"+strconv.FormatInt(id, 10), q.values())
+}
+
+// ListGoals returns the configured goals.
+func (c *Client) ListGoals(ctx context.Context) ([]api.Goal, error) {
+	goals, err := get[[]api.Goal](ctx, c, "/api/admin/goals", nil)
+	if err != nil {
+		return nil, err
+	}
+	return *goals, nil
+}
+
+// CreateGoal stores g and returns it with its ID.
+func (c *Client) CreateGoal(ctx context.Context, g api.Goal) (*api.Goal, error) {
+	out := new(api.Goal)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/goals", nil, g, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteGoal removes goal id.
+func (c *Client) DeleteGoal(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/api/admin/goals/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// ListFunnels returns the configured funnels.
+func (c *Client) ListFunnels(ctx context.Context) ([]api.Funnel, error) {
+	funnels, err := get[[]api.Funnel](ctx, c, "/api/admin/funnels", nil)
+	if err != nil {
+		return nil, err
+	}
+	return *funnels, nil
+}
+
+// CreateFunnel stores fn and returns it with its ID.
+func (c *Client) CreateFunnel(ctx context.Context, fn api.Funnel) (*api.Funnel, error) {
+	out := new(api.Funnel)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/funnels", nil, fn, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteFunnel removes funnel id.
+func (c *Client) DeleteFunnel(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/api/admin/funnels/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// ListAPIKeys returns the API keys, without their secrets.
+func (c *Client) ListAPIKeys(ctx context.Context) ([]api.APIKey, error) {
+	keys, err := get[[]api.APIKey](ctx, c, "/api/admin/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	return *keys, nil
+}
+
+// CreateAPIKey creates a key with k's name, scopes and expiry. The
+// returned key's Key field holds the only copy of its secret.
+func (c *Client) CreateAPIKey(ctx context.Context, k api.APIKey) (*api.APIKey, error) {
+	out := new(api.APIKey)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/keys", nil, k, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevokeAPIKey deletes API key id.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/api/admin/keys/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// ListShareLinks returns the public share links with their URLs.
+func (c *Client) ListShareLinks(ctx context.Context) ([]api.ShareLink, error) {
+	links, err := get[[]api.ShareLink](ctx, c, "/api/admin/shares", nil)
+	if err != nil {
+		return nil, err
+	}
+	return *links, nil
+}
+
+// CreateShareLink creates a link from l's name, sections, path prefix,
+// threshold and expiry. The returned link's URL is relative to BaseURL.
+func (c *Client) CreateShareLink(ctx context.Context, l api.ShareLink) (*api.ShareLink, error) {
+	out := new(api.ShareLink)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/shares", nil, l, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevokeShareLink deletes share link id.
+func (c *Client) RevokeShareLink(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/api/admin/shares/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// SharedStats returns what the share link with token shows; it needs no
+// credentials. Only the range fields of q are used.
+func (c *Client) SharedStats(ctx context.Context, token string, q Query) (*api.SharedStats, error) {
+	return get[api.SharedStats](ctx, c, "/api/share/"+url.PathEscape(token)+"/stats", Query{
+		Preset: q.Preset, From: q.From, To: q.To, Period: q.Period, TZ: q.TZ}.values())
+}
+
+// PublicStats returns the differentially private release for period: day,
+// week or month, empty for week. It needs no credentials.
+func (c *Client) PublicStats(ctx context.Context, period string) (*api.PublicStats, error) {
+	q := url.Values{}
+	if period != "" {
+		q.Set("period", period)
+	}
+	return get[api.PublicStats](ctx, c, "/api/public/stats", q)
+}
+
+// Ready runs the server's readiness checks. A server that is not ready
+// answers with an *Error of status 503 whose message lists the checks.
+func (c *Client) Ready(ctx context.Context) (*api.Readiness, error) {
+	return get[api.Readiness](ctx, c, "/readyz", nil)
+}
+
+// Version describes the server's binary.
+func (c *Client) Version(ctx context.Context) (*api.BuildInfo, error) {
+	return get[api.BuildInfo](ctx, c, "/version", nil)
+}
+
+// Backup snapshots the database on the server.
+func (c *Client) Backup(ctx context.Context) (*api.BackupResult, error) {
+	out := new(api.BackupResult)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/backup", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Purge applies the retention policy now, or with dryRun only counts what
+// it would remove.
+func (c *Client) Purge(ctx context.Context, dryRun bool) (*api.PurgeReport, error) {
+	var v url.Values
+	if dryRun {
+		v = url.Values{"dry_run": {"1"}}
+	}
+	out := new(api.PurgeReport)
+	if err := c.do(ctx, http.MethodPost, "/api/admin/purge", v, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AuditOptions filters the audit log; zero fields match everything.
+type AuditOptions struct {
+	Principal string
+	Action    string
+	Before    int64 // the NextBefore of the previous page
+	Limit     int
+}
+
+// Audit returns a page of the audit log, newest first.
+func (c *Client) Audit(ctx context.Context, q Query, opt AuditOptions) (*api.AuditPage, error) {
+	v := q.values()
+	setAll(v, "principal", opt.Principal, "action", opt.Action)
+	if opt.Before > 0 {
+		v.Set("before", strconv.FormatInt(opt.Before, 10))
+	}
+	setInt(v, "limit", opt.Limit)
+	return get[api.AuditPage](ctx, c, "/api/admin/audit", v)
+}
+
+// VerifyAudit checks the audit log's hash chain on the server.
+func (c *Client) VerifyAudit(ctx context.Context) (*api.AuditVerification, error) {
+	return get[api.AuditVerification](ctx, c, "/api/admin/audit/verify", nil)
+}
+
+// ExportOptions configures an export; zero fields use the server's
+// defaults (page views as CSV).
+type ExportOptions struct {
+	Dataset   string // pageviews, events, sessions or breakdown
+	Format    string // csv, ndjson or parquet
+	Gzip      bool
+	IncludeIP bool
+	Dimension string // breakdown only
+	Pivot     string
+	Metric    string
+}
+
+// ExportFile is a download in progress. The caller must close Body.
+type ExportFile struct {
+	Name        string // suggested file name, including the range
+	ContentType string
+	Body        io.ReadCloser
+}
+
+// Export starts a download of raw rows, sessions or a breakdown.
+func (c *Client) Export(ctx context.Context, q Query, opt ExportOptions) (*ExportFile, error) {
+	v := q.values()
+	setAll(v, "dataset", opt.Dataset, "format", opt.Format, "dimension", opt.Dimension, "pivot", opt.Pivot, "metric", opt.Metric)
+	if opt.Gzip {
+		v.Set("gzip", "1")
+	}
+	if opt.IncludeIP {
+		v.Set("include_ip", "1")
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/api/analytics/export", v, nil)
+	if err != nil {
+		return nil, err
+	}
+	f := &ExportFile{ContentType: resp.Header.Get("Content-Type"), Body: resp.Body}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		f.Name = params["filename"]
+	}
+	return f, nil
+}
+
+// LiveMessage is one message of the live stream.
+type LiveMessage struct {
+	Event    string              // snapshot, pageview, event or dropped
+	Snapshot *api.RealtimeResult // snapshot
+	Beacon   *api.LiveEvent      // pageview and event
+	Dropped  int                 // dropped: messages skipped because the client fell behind
+}
+
+// Live streams beacons and active-visitor snapshots to fn until ctx is
+// done, fn returns an error, or the server closes the stream. Only the
+// initial connection is retried; reconnecting after a dropped stream is
+// left to the caller.
+func (c *Client) Live(ctx context.Context, fn func(LiveMessage) error) error {
+	// The stream outlives any client-wide timeout
+	hc := *c.HTTPClient
+	hc.Timeout = 0
+	streaming := *c
+	streaming.HTTPClient = &hc
+
+	resp, err := streaming.send(ctx, http.MethodGet, "/api/analytics/live", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var event string
+	var data []byte
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(line[len("data:"):])...)
+		case line == "" && event != "":
+			msg := LiveMessage{Event: event}
+			var err error
+			switch event {
+			case "snapshot":
+				msg.Snapshot = new(api.RealtimeResult)
+				err = json.Unmarshal(data, msg.Snapshot)
+			case "pageview", "event":
+				msg.Beacon = new(api.LiveEvent)
+				err = json.Unmarshal(data, msg.Beacon)
+			case "dropped":
+				var d struct{ Count int }
+				err = json.Unmarshal(data, &d)
+				msg.Dropped = d.Count
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+			event, data = "", data[:0]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return errStreamClosed
+}
+
+func setAll(v url.Values, kv ...string) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			v.Set(kv[i], kv[i+1])
+		}
+	}
+}
+
+func setInt(v url.Values, k string, n int) {
+	if n != 0 {
+		v.Set(k, strconv.Itoa(n))
+	}
+}
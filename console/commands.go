@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// runCommand dispatches CLI subcommands. It returns false when args do not
+// name a subcommand, in which case main starts the server. Commands log
+// through the server's handler, with its redaction, in text.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	setupLogging()
+	switch args[0] {
+	case "backup":
+		cmdBackup(args[1:])
+	case "restore":
+		cmdRestore(args[1:])
+	case "archive":
+		cmdArchive(args[1:])
+	case "purge":
+		cmdPurge(args[1:])
+	case "bench":
+		cmdBench(args[1:])
+	case "export":
+		cmdExport(args[1:])
+	case "user":
+		cmdUser(args[1:])
+	case "key":
+		cmdKey(args[1:])
+	case "share":
+		cmdShare(args[1:])
+	case "audit":
+		cmdAudit(args[1:])
+	case "config":
+		cmdConfig(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+func cmdBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	dir := fs.String("out", backupCfg.Dir, "directory to write the snapshot into")
+	compress := fs.Bool("gzip", false, "gzip-compress the snapshot")
+	keep := fs.Int("keep", 0, "keep only the N most recent snapshots (0 = keep all)")
+	fs.Parse(args)
+
+	// Opening a mistyped path would create and back up an empty database
+	if _, err := os.Stat(*dbPath); err != nil {
+		fatal("database not found", "err", err)
+	}
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	path, err := BackupDatabase(*dir, *compress)
+	if err != nil {
+		fatal("backup failed", "err", err)
+	}
+	Audit(cliPrincipal(), "backup", path)
+	if err := RotateBackups(*dir, *keep); err != nil {
+		slog.Warn("backup rotation", "err", err)
+	}
+	fmt.Println(path)
+}
+
+func cmdRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fs.String("db", "analytics.db", "SQLite database path to replace")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: noblemind-console restore [-db analytics.db] <snapshot>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := RestoreDatabase(fs.Arg(0), *dbPath); err != nil {
+		fatal("restore failed", "err", err)
+	}
+	slog.Info("restored", "db", *dbPath, "snapshot", fs.Arg(0))
+
+	// Record the restore in the restored database's own audit log, which
+	// must be the file just written rather than a new one
+	if _, err := os.Stat(*dbPath); err != nil {
+		fatal("restored database not found", "err", err)
+	}
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+	Audit(cliPrincipal(), "restore", fs.Arg(0))
+}
+
+func cmdArchive(args []string) {
+	if len(args) == 0 || args[0] != "query" {
+		fmt.Fprintln(os.Stderr, "usage: noblemind-console archive query -dir <archive-dir> [filters]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("archive query", flag.ExitOnError)
+	dir := fs.String("dir", "archive", "archive directory")
+	var f ArchiveFilter
+	fs.StringVar(&f.Table, "table", "page_views", "table to scan: page_views or events")
+	fs.StringVar(&f.From, "from", "", "first day to include (YYYY-MM-DD)")
+	fs.StringVar(&f.To, "to", "", "last day to include (YYYY-MM-DD)")
+	// One flag per API filter parameter, with the same syntax: repeatable,
+	// comma-separated alternatives, and "!" to exclude
+	q := url.Values{}
+	for _, p := range filterParams {
+		fs.Func(p.param, p.column+" filter, as the API's "+p.param+" parameter", func(v string) error {
+			q.Add(p.param, v)
+			return nil
+		})
+	}
+	fs.Func("type", "alias for -event", func(v string) error {
+		q.Add("event", v)
+		return nil
+	})
+	fs.Parse(args[1:])
+
+	if f.Table != "page_views" && f.Table != "events" {
+		fatal("unknown table", "table", f.Table)
+	}
+	var err error
+	if f.Filter, err = ParseFilter(q); err != nil {
+		fatal("invalid filter", "err", err)
+	}
+
+	n, err := QueryArchive(*dir, f, os.Stdout)
+	if err != nil {
+		fatal("archive query failed", "err", err)
+	}
+	slog.Info("archive query", "rows", n)
+}
+
+func cmdPurge(args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	dryRun := fs.Bool("dry-run", false, "report what would be purged without deleting")
+	p := retention
+	fs.IntVar(&p.PageViews, "retain-pageviews", p.PageViews, "days to keep raw page views (0 = forever)")
+	fs.IntVar(&p.Events, "retain-events", p.Events, "days to keep raw events (0 = forever)")
+	fs.IntVar(&p.IPAddress, "retain-ip", p.IPAddress, "days to keep raw IP addresses (0 = forever)")
+	fs.IntVar(&p.Salts, "retain-salts", p.Salts, "days to keep daily salts (0 = forever)")
+	fs.IntVar(&p.Aggregates, "retain-aggregates", p.Aggregates, "days to keep daily aggregates (0 = forever)")
+	fs.IntVar(&p.Audit, "retain-audit", p.Audit, "days to keep the audit log (0 = forever)")
+	fs.IntVar(&p.ChunkSize, "purge-chunk", p.ChunkSize, "rows deleted per statement")
+	fs.StringVar(&archiveDir, "archive-dir", "", "archive raw rows here before purging (empty disables)")
+	fs.Parse(args)
+
+	if err := p.Validate(); err != nil {
+		fatal("invalid retention policy", "err", err)
+	}
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	report, err := PurgeOldData(p, *dryRun)
+	if err != nil {
+		Audit(cliPrincipal(), "purge", "failed: "+err.Error())
+		fatal("purge failed", "err", err)
+	}
+	Audit(cliPrincipal(), "purge", report.String())
+	fmt.Println(report)
+}
+
+func cmdBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	dir := fs.String("dir", "bench", "directory for the synthetic databases")
+	rows := fs.Int("rows", 10_000_000, "number of synthetic page views")
+	fs.Parse(args)
+
+	if err := RunBenchmark(*dir, *rows, os.Stdout); err != nil {
+		fatal("benchmark failed", "err", err)
+	}
+}
+
+func cmdExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	out := fs.String("out", ".", "directory to write the export into, or - for stdout")
+	filter := fs.String("filter", "", "filter parameters as a query string, e.g. country=DE&path_prefix=/blog")
+	q := url.Values{}
+	for _, name := range []string{"dataset", "format", "from", "to", "preset", "period", "tz", "dimension", "pivot", "metric"} {
+		fs.Func(name, "same as the "+name+" parameter of /api/analytics/export", func(s string) error {
+			q.Set(name, s)
+			return nil
+		})
+	}
+	compress := fs.Bool("gzip", false, "gzip-compress the export")
+	rawIP := fs.Bool("include-ip", false, "export IP addresses unmasked")
+	fs.Parse(args)
+
+	params, err := url.ParseQuery(*filter)
+	if err != nil {
+		fatal("invalid -filter", "err", err)
+	}
+	for k, v := range q {
+		params[k] = v
+	}
+	if *compress {
+		params.Set("gzip", "1")
+	}
+	if *rawIP {
+		params.Set("include_ip", "1")
+	}
+	e, err := parseExport(params)
+	if err != nil {
+		fatal("invalid export", "err", err)
+	}
+
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	rows, cols, err := openExport(context.Background(), e)
+	if err != nil {
+		fatal("export failed", "err", err)
+	}
+	w, path := os.Stdout, "-"
+	if *out != "-" {
+		path = filepath.Join(*out, e.Filename())
+		if w, err = os.Create(path); err != nil {
+			fatal("export failed", "err", err)
+		}
+	}
+	n, err := writeExport(w, e, rows, cols)
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	Audit(cliPrincipal(), "export", exportDetail(e, n, err))
+	if err != nil {
+		fatal("export failed", "err", err)
+	}
+	slog.Info("export", "rows", n)
+	if path != "-" {
+		fmt.Println(path)
+	}
+}
+
+func cmdUser(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, `usage: noblemind-console user add [-db analytics.db] [-role viewer|analyst|admin] <username>
+       noblemind-console user passwd [-db analytics.db] <username>
+       noblemind-console user delete [-db analytics.db] <username>
+       noblemind-console user list [-db analytics.db]
+
+Passwords are prompted for, or read from the first line of stdin when it
+is not a terminal.`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	fs.Usage = usage
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	role := roleViewer
+	if args[0] == "add" {
+		fs.StringVar(&role, "role", role, "viewer, analyst or admin")
+	}
+	fs.Parse(args[1:])
+	if (args[0] == "list") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		usage()
+	}
+	username := fs.Arg(0)
+
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	switch args[0] {
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			fatal("reading password", "err", err)
+		}
+		u, err := CreateUser(username, password, role)
+		if err != nil {
+			fatal("user add", "err", err)
+		}
+		Audit(cliPrincipal(), "user.create", fmt.Sprintf("%s %s", u.Role, u.Username))
+		slog.Info("created user", "user", u.Username, "role", u.Role)
+	case "passwd":
+		password, err := readPassword()
+		if err != nil {
+			fatal("reading password", "err", err)
+		}
+		if err := SetPassword(username, password); err != nil {
+			fatal("user passwd", "err", err)
+		}
+		Audit(cliPrincipal(), "user.passwd", username)
+		slog.Info("password changed and sessions signed out", "user", username)
+	case "delete":
+		ok, err := DeleteUser(username)
+		if err != nil {
+			fatal("user delete", "err", err)
+		}
+		if !ok {
+			fatal("no such user", "user", username)
+		}
+		Audit(cliPrincipal(), "user.delete", username)
+		slog.Info("deleted user", "user", username)
+	case "list":
+		users, err := ListUsers()
+		if err != nil {
+			fatal("user list", "err", err)
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\n", u.Username, u.Role)
+		}
+	default:
+		usage()
+	}
+}
+
+func cmdKey(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, `usage: noblemind-console key create [-db analytics.db] -scopes read:stats,read:raw [-expires 90d] <name>
+       noblemind-console key revoke [-db analytics.db] <name>
+       noblemind-console key list [-db analytics.db]
+
+Scopes: `+strings.Join(apiScopes, ", ")+`. The key is printed once and
+cannot be shown again.`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	fs.Usage = usage
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	var scopes, expires string
+	if args[0] == "create" {
+		fs.StringVar(&scopes, "scopes", "", "comma-separated scopes")
+		fs.StringVar(&expires, "expires", "", "expiry: RFC 3339, YYYY-MM-DD or a duration such as 90d (default never)")
+	}
+	fs.Parse(args[1:])
+	if (args[0] == "list") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		usage()
+	}
+
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	switch args[0] {
+	case "create":
+		k := APIKey{Name: fs.Arg(0), ExpiresAt: expires}
+		if scopes != "" {
+			k.Scopes = strings.Split(scopes, ",")
+		}
+		if err := validateAPIKey(&k, time.Now()); err != nil {
+			fatal("key create", "err", err)
+		}
+		if err := CreateAPIKey(&k); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				err = fmt.Errorf("a key named %q already exists", k.Name)
+			}
+			fatal("key create", "err", err)
+		}
+		Audit(cliPrincipal(), "key.create", apiKeyDetail(k))
+		slog.Info("created key", "name", k.Name, "scopes", strings.Join(k.Scopes, ","))
+		fmt.Println(k.Key)
+	case "revoke":
+		keys, err := ListAPIKeys()
+		if err != nil {
+			fatal("key revoke", "err", err)
+		}
+		i := slices.IndexFunc(keys, func(k APIKey) bool { return k.Name == fs.Arg(0) })
+		if i < 0 {
+			fatal("no such key", "name", fs.Arg(0))
+		}
+		if _, err := RevokeAPIKey(keys[i].ID); err != nil {
+			fatal("key revoke", "err", err)
+		}
+		Audit(cliPrincipal(), "key.revoke", apiKeyDetail(keys[i]))
+		slog.Info("revoked key", "name", fs.Arg(0))
+	case "list":
+		keys, err := ListAPIKeys()
+		if err != nil {
+			fatal("key list", "err", err)
+		}
+		orNever := func(s, never string) string {
+			if s == "" {
+				return never
+			}
+			return s
+		}
+		for _, k := range keys {
+			fmt.Printf("%s\t%s…\t%s\texpires %s\tlast used %s\n", k.Name, k.Prefix,
+				strings.Join(k.Scopes, ","), orNever(k.ExpiresAt, "never"), orNever(k.LastUsedAt, "never"))
+		}
+	default:
+		usage()
+	}
+}
+
+func cmdShare(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, `usage: noblemind-console share create [-db analytics.db] -sections totals,pages [-path-prefix /blog] [-min-visitors 5] [-expires 30d] <name>
+       noblemind-console share revoke [-db analytics.db] <name>
+       noblemind-console share list [-db analytics.db]
+
+Sections: `+strings.Join(shareSections, ", ")+`. Links are printed as
+paths; append them to the console's address.`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("share "+args[0], flag.ExitOnError)
+	fs.Usage = usage
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	var l ShareLink
+	var sections string
+	if args[0] == "create" {
+		fs.StringVar(&sections, "sections", "", "comma-separated sections to show")
+		fs.StringVar(&l.PathPrefix, "path-prefix", "", "only count pages under this path")
+		fs.IntVar(&l.MinVisitors, "min-visitors", defaultShareMinVisitors, "fold rows seen by fewer visitors into Other")
+		fs.StringVar(&l.ExpiresAt, "expires", "", "expiry: RFC 3339, YYYY-MM-DD or a duration such as 30d (default never)")
+	}
+	fs.Parse(args[1:])
+	if (args[0] == "list") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		usage()
+	}
+
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	switch args[0] {
+	case "create":
+		l.Name = fs.Arg(0)
+		if sections != "" {
+			l.Sections = strings.Split(sections, ",")
+		}
+		if err := CreateShareLink(&l); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				err = fmt.Errorf("a share link named %q already exists", l.Name)
+			}
+			fatal("share create", "err", err)
+		}
+		Audit(cliPrincipal(), "share.create", shareLinkDetail(l))
+		slog.Info("created share link", "name", l.Name)
+		fmt.Println(l.URL)
+	case "revoke":
+		links, err := ListShareLinks()
+		if err != nil {
+			fatal("share revoke", "err", err)
+		}
+		i := slices.IndexFunc(links, func(l ShareLink) bool { return l.Name == fs.Arg(0) })
+		if i < 0 {
+			fatal("no such share link", "name", fs.Arg(0))
+		}
+		if _, err := RevokeShareLink(links[i].ID); err != nil {
+			fatal("share revoke", "err", err)
+		}
+		Audit(cliPrincipal(), "share.revoke", shareLinkDetail(links[i]))
+		slog.Info("revoked share link", "name", fs.Arg(0))
+	case "list":
+		links, err := ListShareLinks()
+		if err != nil {
+			fatal("share list", "err", err)
+		}
+		for _, l := range links {
+			expires := l.ExpiresAt
+			if expires == "" {
+				expires = "never"
+			}
+			fmt.Printf("%s\t%s\t%s\tprefix %q\tk=%d\texpires %s\n", l.Name, l.URL,
+				strings.Join(l.Sections, ","), l.PathPrefix, l.MinVisitors, expires)
+		}
+	default:
+		usage()
+	}
+}
+
+func cmdAudit(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: noblemind-console audit verify [-db analytics.db]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	dbPath := fs.String("db", "analytics.db", "SQLite database path")
+	fs.Parse(args[1:])
+
+	if err := initDB(*dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+
+	v, err := VerifyAudit(context.Background())
+	if err != nil {
+		fatal("audit verify", "err", err)
+	}
+	if !v.OK {
+		fatal("audit log broken", "entry", v.BrokenAt, "problem", v.Problem, "verified", v.Checked)
+	}
+	fmt.Printf("audit log intact: %d entries, ids %d-%d\n", v.Checked, v.FirstID, v.LastID)
+}
+
+// cmdConfig prints the documented example config, or checks a config file
+// together with the environment as the server would at startup.
+func cmdConfig(args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "example":
+		fmt.Print(exampleConfig)
+		return
+	case len(args) == 2 && args[0] == "check":
+	default:
+		fmt.Fprintln(os.Stderr, "usage: noblemind-console config example | config check <file>")
+		os.Exit(2)
+	}
+
+	defineFlags()
+	if err := loadConfig(args[1]); err != nil {
+		fatal("config", "err", err)
+	}
+	if err := validateSettings(); err != nil {
+		fatal("config", "err", err)
+	}
+	if err := oidcCfg.Validate(); err != nil {
+		fatal("invalid OpenID Connect config", "err", err)
+	}
+	fmt.Printf("%s is valid\n", args[1])
+}
+
+// readPassword prompts twice for a new password on a terminal, or reads
+// one line from piped stdin.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(p1) != string(p2) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(p1), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+func newChange(cur, prev int) *Change {
+	c := &Change{Previous: prev, Delta: cur - prev}
+	if prev != 0 {
+		pct := math.Round(float64(cur-prev)/float64(prev)*1000) / 10
+		c.Percent = &pct
+	}
+	return c
+}
+
+// ComparisonRange returns the window to compare rng against: "previous" is
+// the equally long window just before it, "year" is the same dates a year
+// earlier.
+func ComparisonRange(rng TimeRange, mode string) (TimeRange, error) {
+	switch mode {
+	case "previous":
+		return TimeRange{From: rng.From.Add(-rng.To.Sub(rng.From)), To: rng.From, Loc: rng.Loc}, nil
+	case "year":
+		return TimeRange{From: rng.From.AddDate(-1, 0, 0), To: rng.To.AddDate(-1, 0, 0), Loc: rng.Loc}, nil
+	}
+	return TimeRange{}, fmt.Errorf("compare must be previous or year")
+}
+
+// CompareStatsContext fills in the comparison fields of result, which was
+// computed for rng, using the same metrics over comp.
+func CompareStatsContext(ctx context.Context, result *StatsResult, rng, comp TimeRange, mode string, f Filter) error {
+	from, to := comp.From.Unix(), comp.To.Unix()
+	q := &statsQuery{ctx: ctx}
+	fw, fargs := f.where("page_views", from, to)
+	args := append([]any{from, to}, fargs...)
+
+	var views, visitors int
+	q.scalar(&views, `SELECT COUNT(*) FROM page_views WHERE ts >= ? AND ts < ?`+fw, args...)
+	q.scalar(&visitors, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ? AND ts < ?`+fw, args...)
+	result.Comparison = &Comparison{
+		Mode:           mode,
+		From:           comp.From.In(comp.Loc).Format(time.RFC3339),
+		To:             comp.To.In(comp.Loc).Format(time.RFC3339),
+		TotalViews:     newChange(result.TotalViews, views),
+		UniqueVisitors: newChange(result.UniqueVisitors, visitors),
+	}
+
+	for _, b := range []struct {
+		column string
+		counts []PathCount
+	}{
+		{"path", result.TopPages},
+		{"referrer", result.TopReferrers},
+		{"browser", result.Browsers},
+		{"device", result.Devices},
+		{"os", result.OSStats},
+		{"country", result.Countries},
+		{"screen", result.Screens},
+	} {
+		names := make([]string, len(b.counts))
+		for i, pc := range b.counts {
+			names[i] = pc.Name
+		}
+		prev := q.countsFor("page_views", b.column, names, from, to, f)
+		for i := range b.counts {
+			b.counts[i].Change = newChange(b.counts[i].Count, prev[b.counts[i].Name])
+		}
+	}
+
+	types := make([]string, len(result.Events))
+	for i, es := range result.Events {
+		types[i] = es.Type
+	}
+	prev := q.countsFor("events", "event_type", types, from, to, f)
+	for i := range result.Events {
+		result.Events[i].Change = newChange(result.Events[i].Count, prev[result.Events[i].Type])
+	}
+
+	q.overlaySeries(result, rng, comp, mode, f)
+	return q.err
+}
+
+// countsFor counts rows per value of column, restricted to names and to
+// the segment f. column is always one of the fixed identifiers above, never
+// user input.
+func (q *statsQuery) countsFor(table, column string, names []string, from, to int64, f Filter) map[string]int {
+	counts := make(map[string]int)
+	if len(names) == 0 {
+		return counts
+	}
+	fw, args := f.where(table, from, to)
+	args = append([]any{from, to}, args...)
+	for _, n := range names {
+		args = append(args, n)
+	}
+	q.rows(`
+		SELECT `+column+`, COUNT(*) FROM `+table+`
+		WHERE ts >= ? AND ts < ?`+fw+` AND `+column+` IN (`+placeholders(len(names))+`)
+		GROUP BY `+column, args, func(rows *sql.Rows) error {
+		var name string
+		var n int
+		if err := rows.Scan(&name, &n); err != nil {
+			return err
+		}
+		counts[name] = n
+		return nil
+	})
+	return counts
+}
+
+// overlaySeries adds the comparison window's time series to result,
+// shifting each comparison bucket onto the bucket it lines up with.
+func (q *statsQuery) overlaySeries(result *StatsResult, rng, comp TimeRange, mode string, f Filter) {
+	if q.err != nil {
+		return
+	}
+	layout := "2006-01-02"
+	if rng.Interval() == "hour" {
+		layout = "2006-01-02 15:00"
+	}
+	// Partial windows (ending at now) can shift by a fraction of a bucket
+	shift := rng.From.Sub(comp.From).Round(time.Hour)
+	shiftDays := int(math.Round(shift.Hours() / 24))
+
+	index := make(map[string]int, len(result.TimeSeries))
+	for i, tp := range result.TimeSeries {
+		index[tp.Date] = i
+	}
+
+	// Bucket the comparison window with the current range's interval
+	bucketRange := comp
+	bucketRange.To = bucketRange.From.Add(rng.To.Sub(rng.From))
+	bucket, args := bucketRange.bucketExpr()
+	fw, fargs := f.where("page_views", comp.From.Unix(), comp.To.Unix())
+	args = append(append(args, comp.From.Unix(), comp.To.Unix()), fargs...)
+	q.rows(`
+		SELECT `+bucket+` as d, COUNT(*), COUNT(DISTINCT visitor_hash)
+		FROM page_views WHERE ts >= ? AND ts < ?`+fw+`
+		GROUP BY d`, args, func(rows *sql.Rows) error {
+		var label string
+		var views, uniq int
+		if err := rows.Scan(&label, &views, &uniq); err != nil {
+			return err
+		}
+		t, err := time.ParseInLocation(layout, label, rng.Loc)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mode == "year":
+			t = t.AddDate(1, 0, 0)
+		case layout == "2006-01-02":
+			t = t.AddDate(0, 0, shiftDays)
+		default:
+			t = t.Add(shift)
+		}
+		aligned := t.Format(layout)
+
+		i, ok := index[aligned]
+		if !ok {
+			result.TimeSeries = append(result.TimeSeries, TimePoint{Date: aligned})
+			i = len(result.TimeSeries) - 1
+			index[aligned] = i
+		}
+		result.TimeSeries[i].PrevViews = &views
+		result.TimeSeries[i].PrevUniq = &uniq
+		return nil
+	})
+
+	sort.Slice(result.TimeSeries, func(i, j int) bool {
+		return result.TimeSeries[i].Date < result.TimeSeries[j].Date
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed config.example.toml
+var exampleConfig string
+
+// configSetting ties a key of the config file to the command-line flag
+// that sets the same value, and so to its type, default and help.
+type configSetting struct {
+	key  string // section.name, or name for the top level
+	flag string
+	live bool // applied by a reload on SIGHUP
+}
+
+// configSettings lists every setting the config file accepts. Those not
+// marked live are read once at startup and need a restart to change.
+var configSettings = []configSetting{
+	{"addr", "addr", false},
+	{"db", "db", false},
+	{"geoip", "geoip", true},
+	{"token", "token", false},
+
+	{"retention.pageviews", "retain-pageviews", true},
+	{"retention.events", "retain-events", true},
+	{"retention.ip", "retain-ip", true},
+	{"retention.salts", "retain-salts", true},
+	{"retention.aggregates", "retain-aggregates", true},
+	{"retention.audit", "retain-audit", true},
+	{"retention.purge_at", "purge-at", true},
+	{"retention.purge_chunk", "purge-chunk", true},
+	{"retention.archive_dir", "archive-dir", true},
+
+	{"backup.dir", "backup-dir", true},
+	{"backup.gzip", "backup-gzip", true},
+	{"backup.keep", "backup-keep", true},
+	{"backup.interval", "backup-interval", false},
+
+	{"database.partition_monthly", "partition-monthly", false},
+	{"database.read_conns", "read-conns", false},
+
+	{"timeouts.stats", "stats-timeout", true},
+	{"timeouts.realtime", "realtime-timeout", true},
+	{"timeouts.recent", "recent-timeout", true},
+
+	{"metrics.addr", "metrics-addr", false},
+	{"metrics.token", "metrics-token", false},
+
+	{"auth.session_ttl", "session-ttl", true},
+
+	{"oidc.issuer", "oidc-issuer", false},
+	{"oidc.client_id", "oidc-client-id", false},
+	{"oidc.client_secret", "oidc-client-secret", false},
+	{"oidc.redirect_url", "oidc-redirect-url", false},
+	{"oidc.scopes", "oidc-scopes", false},
+	{"oidc.name", "oidc-name", false},
+	{"oidc.role_claim", "oidc-role-claim", false},
+	{"oidc.roles", "oidc-roles", false},
+	{"oidc.default_role", "oidc-default-role", false},
+
+	{"privacy.min_visitors", "min-visitors", true},
+
+	{"public_stats.enabled", "public-stats", false},
+	{"public_stats.noise", "public-noise", true},
+	{"public_stats.epsilon", "public-epsilon", true},
+	{"public_stats.delta", "public-delta", true},
+
+	{"live.max_clients", "live-clients", true},
+
+	{"log.format", "log-format", false},
+	{"log.level", "log-level", true},
+}
+
+// envName is the environment variable overriding the setting: CONSOLE_
+// and the key in upper case, dots as underscores.
+func (s configSetting) envName() string {
+	return "CONSOLE_" + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+// settingsMu guards the settings a reload can change while the server
+// runs. They are written without it only before the server starts.
+var settingsMu sync.RWMutex
+
+// setting reads a setting that a reload may change.
+func setting[T any](v *T) T {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return *v
+}
+
+// validateSettings checks the settings that have no validation of their
+// own elsewhere. It runs at startup and before a reload is applied.
+func validateSettings() error {
+	if err := retention.Validate(); err != nil {
+		return fmt.Errorf("invalid retention policy: %w", err)
+	}
+	if err := publicCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid public stats config: %w", err)
+	}
+	if err := validateLogFormat(); err != nil {
+		return err
+	}
+	switch {
+	case minVisitors < 0 || minVisitors > 1000:
+		return errors.New("min visitors must be 0-1000")
+	case backupCfg.Keep < 0:
+		return errors.New("backups to keep must not be negative")
+	case liveMaxClients < 1:
+		return errors.New("live clients must be at least 1")
+	case sessionTTL < time.Minute:
+		return errors.New("session TTL must be at least 1m")
+	case queryTimeouts.Stats <= 0 || queryTimeouts.Realtime <= 0 || queryTimeouts.Recent <= 0:
+		return errors.New("query timeouts must be positive")
+	}
+	return nil
+}
+
+// configValue is one setting's value as text and where it came from.
+type configValue struct {
+	text   string
+	source string // file:line, or the environment variable
+}
+
+var (
+	configPath string
+	// commandLine holds the flags given on the command line; they win over
+	// the environment, which wins over the config file.
+	commandLine = map[string]bool{}
+	// configApplied is the text each setting was last given, to tell which
+	// ones a reload changes.
+	configApplied = map[string]string{}
+)
+
+// loadConfig applies the config file at path, if any, and the
+// environment to every setting not given on the command line.
+func loadConfig(path string) error {
+	configPath = path
+	flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+	values, err := configValues(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range configSettings {
+		v, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		if err := flag.Set(s.flag, v.text); err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %s", v.source, s.key, v.text, expected(s.flag))
+		}
+		configApplied[s.key] = v.text
+	}
+	return nil
+}
+
+// configValues returns the value of each setting not given on the command
+// line: from the environment, else the file, else the flag's default.
+func configValues(path string) (map[string]configValue, error) {
+	file := map[string]configValue{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if file, err = parseConfig(path, data); err != nil {
+			return nil, err
+		}
+	}
+	known := make(map[string]bool, len(configSettings))
+	for _, s := range configSettings {
+		known[s.key] = true
+	}
+	for key, v := range file {
+		if !known[key] {
+			return nil, fmt.Errorf("%s: unknown setting %q", v.source, key)
+		}
+	}
+
+	values := make(map[string]configValue, len(configSettings))
+	for _, s := range configSettings {
+		if commandLine[s.flag] {
+			continue
+		}
+		if text, ok := os.LookupEnv(s.envName()); ok {
+			values[s.key] = configValue{text, s.envName()}
+		} else if v, ok := file[s.key]; ok {
+			values[s.key] = v
+		} else {
+			values[s.key] = configValue{flag.Lookup(s.flag).DefValue, "default"}
+		}
+	}
+	return values, nil
+}
+
+// expected describes the values the named flag accepts, for errors; the
+// flag package's own just say "parse error".
+func expected(name string) string {
+	switch flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+	case bool:
+		return "want true or false"
+	case int:
+		return "want a whole number"
+	case float64:
+		return "want a number"
+	case time.Duration:
+		return `want a duration such as "30s" or "12h"`
+	case *slog.LevelVar:
+		return "want debug, info, warn or error"
+	}
+	return "invalid value"
+}
+
+// reloadConfig re-reads the config file and environment. Live settings
+// change in place; changes to others are logged as needing a restart.
+// If any value is invalid nothing changes.
+func reloadConfig() {
+	values, err := configValues(configPath)
+	if err != nil {
+		slog.Error("config reload failed; keeping the current settings", "err", err)
+		return
+	}
+
+	var changed, restart []string
+	previous := map[string]string{}
+	settingsMu.Lock()
+	rollback := func() {
+		for name, text := range previous {
+			flag.Set(name, text)
+		}
+	}
+	for _, s := range configSettings {
+		v, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		old, ok := configApplied[s.key]
+		if !ok {
+			old = flag.Lookup(s.flag).DefValue
+		}
+		if v.text == old {
+			continue
+		}
+		if !s.live {
+			restart = append(restart, s.key)
+			continue
+		}
+		previous[s.flag] = flag.Lookup(s.flag).Value.String()
+		if err := flag.Set(s.flag, v.text); err != nil {
+			rollback()
+			settingsMu.Unlock()
+			slog.Error("config reload failed; keeping the current settings",
+				"err", fmt.Sprintf("%s: invalid %s %q: %s", v.source, s.key, v.text, expected(s.flag)))
+			return
+		}
+		changed = append(changed, s.key)
+	}
+	if err := validateSettings(); err != nil {
+		rollback()
+		settingsMu.Unlock()
+		slog.Error("config reload failed; keeping the current settings", "err", err)
+		return
+	}
+	for _, s := range configSettings {
+		if v, ok := values[s.key]; ok && s.live {
+			configApplied[s.key] = v.text
+		}
+	}
+	settingsMu.Unlock()
+
+	// The GeoIP file is re-read even if its path is unchanged, so that a
+	// new download can be picked up with a SIGHUP
+	LoadGeoIP(setting(&geoIPPath))
+	reschedulePurge()
+
+	if len(restart) > 0 {
+		slog.Warn("config reload: restart to apply", "settings", strings.Join(restart, ", "))
+	}
+	detail := "no changes"
+	if len(changed) > 0 {
+		detail = "changed " + strings.Join(changed, ", ")
+	}
+	slog.Info("config reloaded", "detail", detail)
+	Audit("system", "config.reload", detail)
+}
+
+var (
+	configSection = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	configNumber  = regexp.MustCompile(`^[+-]?[0-9][0-9_]*(\.[0-9_]+)?([eE][+-]?[0-9]+)?$`)
+)
+
+// parseConfig reads the subset of TOML the example uses: [section] tables
+// of key = value pairs whose values are strings, numbers or booleans. It
+// returns each value as text, keyed section.key.
+func parseConfig(name string, data []byte) (map[string]configValue, error) {
+	values := map[string]configValue{}
+	section := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		source := name + ":" + strconv.Itoa(i+1)
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			header, rest, ok := strings.Cut(line[1:], "]")
+			if header = strings.TrimSpace(header); !ok || !configSection.MatchString(header) || !isComment(rest) {
+				return nil, fmt.Errorf("%s: invalid section header", source)
+			}
+			section = header + "."
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if key = strings.TrimSpace(key); !ok || !configSection.MatchString(key) {
+			return nil, fmt.Errorf("%s: expected key = value", source)
+		}
+		text, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", source, section+key, err)
+		}
+		if prev, dup := values[section+key]; dup {
+			return nil, fmt.Errorf("%s: %s already set at %s", source, section+key, prev.source)
+		}
+		values[section+key] = configValue{text, source}
+	}
+	return values, nil
+}
+
+// parseConfigValue returns the text of a quoted string, number or boolean,
+// followed by nothing but an optional comment.
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for end < len(raw) && raw[end] != '"' {
+			if raw[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(raw) {
+			return "", errors.New("unterminated string")
+		}
+		if !isComment(raw[end+1:]) {
+			return "", errors.New("unexpected text after string")
+		}
+		s, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", errors.New("invalid escape in string")
+		}
+		return s, nil
+	case strings.HasPrefix(raw, "'"):
+		s, rest, ok := strings.Cut(raw[1:], "'")
+		if !ok {
+			return "", errors.New("unterminated string")
+		}
+		if !isComment(rest) {
+			return "", errors.New("unexpected text after string")
+		}
+		return s, nil
+	}
+	value, _, _ := strings.Cut(raw, "#")
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "true" || value == "false":
+		return value, nil
+	case configNumber.MatchString(value):
+		return strings.ReplaceAll(value, "_", ""), nil
+	case strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{"):
+		return "", errors.New("arrays and inline tables are not supported")
+	}
+	return "", errors.New(`value must be a "quoted string", a number, true or false`)
+}
+
+func isComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
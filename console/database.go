@@ -1,23 +1,44 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-var db *sql.DB
+// db is the writer pool, limited to one connection so SQLite never sees
+// competing writers. readDB is a separate query_only pool for the dashboard
+// scans, which in WAL mode run alongside the writer without blocking it.
+var (
+	db     *sql.DB
+	readDB *sql.DB
+)
+
+// readConns is the size of the read-only pool.
+var readConns = 4
+
+// dbFile is the path of the open database.
+var dbFile string
+
+// schemaVersion is recorded in PRAGMA user_version after migrations run.
+// Bump it whenever migrateSchema gains a step.
+const schemaVersion = 2
 
 func initDB(path string) error {
+	dbFile = path
 	var err error
 	db, err = sql.Open("sqlite", path)
 	if err != nil {
 		return fmt.Errorf("open database: %w", err)
 	}
+	db.SetMaxOpenConns(1)
 
 	// SQLite pragmas for performance
 	pragmas := []string{
@@ -36,34 +57,40 @@ func initDB(path string) error {
 	if err := createSchema(); err != nil {
 		return err
 	}
-	return migrateSchema()
+	if err := migrateSchema(); err != nil {
+		return err
+	}
+	if err := setupPartitions(); err != nil {
+		return err
+	}
+	if err := createIndexes(); err != nil {
+		return err
+	}
+
+	// Pragmas in the DSN apply to every connection the pool opens
+	readDB, err = sql.Open("sqlite", "file:"+path+
+		"?_pragma=busy_timeout(5000)&_pragma=cache_size(-20000)&_pragma=query_only(1)")
+	if err != nil {
+		return fmt.Errorf("open read pool: %w", err)
+	}
+	readDB.SetMaxOpenConns(readConns)
+	readDB.SetMaxIdleConns(readConns)
+	return nil
+}
+
+// closeDB closes both connection pools.
+func closeDB() {
+	if readDB != nil {
+		readDB.Close()
+	}
+	db.Close()
 }
 
 func createSchema() error {
 	schema := `
-	CREATE TABLE IF NOT EXISTS page_views (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
-		path TEXT NOT NULL,
-		referrer TEXT NOT NULL DEFAULT '',
-		visitor_hash TEXT NOT NULL,
-		ip_address TEXT NOT NULL DEFAULT '',
-		country TEXT NOT NULL DEFAULT '',
-		region TEXT NOT NULL DEFAULT '',
-		city TEXT NOT NULL DEFAULT '',
-		device TEXT NOT NULL DEFAULT '',
-		browser TEXT NOT NULL DEFAULT '',
-		os TEXT NOT NULL DEFAULT '',
-		screen TEXT NOT NULL DEFAULT ''
-	);
+	CREATE TABLE IF NOT EXISTS page_views (` + pageViewsColumns + `);
 
-	CREATE TABLE IF NOT EXISTS events (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
-		event_type TEXT NOT NULL,
-		visitor_hash TEXT NOT NULL,
-		metadata TEXT NOT NULL DEFAULT ''
-	);
+	CREATE TABLE IF NOT EXISTS events (` + eventsColumns + `);
 
 	CREATE TABLE IF NOT EXISTS daily_aggregates (
 		date TEXT NOT NULL,
@@ -78,19 +105,185 @@ func createSchema() error {
 		salt TEXT NOT NULL
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_pv_timestamp ON page_views(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_pv_visitor ON page_views(visitor_hash);
-	CREATE INDEX IF NOT EXISTS idx_pv_path ON page_views(path);
-	CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_events_type ON events(event_type);
-	CREATE INDEX IF NOT EXISTS idx_agg_date ON daily_aggregates(date);
+	CREATE TABLE IF NOT EXISTS goals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		definition TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS funnels (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		definition TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+
+	-- Only a SHA-256 of each session cookie is stored
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	-- Links single sign-on accounts to users
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);
+
+	-- Likewise only a SHA-256 of each API key; scopes are space-separated
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		expires_at INTEGER,
+		last_used_at INTEGER,
+		created_at INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+
+	-- Server-side keys, created on first use
+	CREATE TABLE IF NOT EXISTS secrets (
+		name TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	);
+
+	-- Public dashboards; links are signed with the "share" secret and
+	-- sections are space-separated
+	CREATE TABLE IF NOT EXISTS share_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		sections TEXT NOT NULL,
+		path_prefix TEXT NOT NULL DEFAULT '',
+		min_visitors INTEGER NOT NULL,
+		expires_at INTEGER,
+		created_at INTEGER NOT NULL DEFAULT (unixepoch())
+	);
+
+	-- Differentially private releases, kept so that a window is never
+	-- answered twice with fresh noise, and the epsilon spent per day of data
+	CREATE TABLE IF NOT EXISTS public_releases (
+		period TEXT NOT NULL,
+		start TEXT NOT NULL,
+		result TEXT NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+		PRIMARY KEY (period, start)
+	);
+
+	CREATE TABLE IF NOT EXISTS privacy_budget (
+		day TEXT PRIMARY KEY,
+		spent REAL NOT NULL
+	);
+
+	-- Append-only: each hash covers the row and prev_hash, the hash of the
+	-- row before. Only retention deletes rows, oldest first.
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts INTEGER NOT NULL,
+		principal TEXT NOT NULL,
+		action TEXT NOT NULL,
+		method TEXT NOT NULL DEFAULT '',
+		path TEXT NOT NULL DEFAULT '',
+		params TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL DEFAULT 0,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT '',
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_ts ON audit_log(ts);
+	CREATE TRIGGER IF NOT EXISTS audit_log_append_only BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END;
+	-- Neither the middle nor the end of the chain can be cut
+	CREATE TRIGGER IF NOT EXISTS audit_log_prune_only BEFORE DELETE ON audit_log
+	WHEN OLD.id <> (SELECT MIN(id) FROM audit_log) OR OLD.id = (SELECT MAX(id) FROM audit_log)
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log entries can only be pruned oldest first');
+	END;
 	`
 	_, err := db.Exec(schema)
 	return err
 }
 
-// migrateSchema adds columns that may not exist in older databases.
+// Timestamps are stored as integer Unix seconds (UTC) in the ts column.
+const pageViewsColumns = `
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts INTEGER NOT NULL DEFAULT (unixepoch()),
+		path TEXT NOT NULL,
+		referrer TEXT NOT NULL DEFAULT '',
+		visitor_hash TEXT NOT NULL,
+		ip_address TEXT NOT NULL DEFAULT '',
+		country TEXT NOT NULL DEFAULT '',
+		region TEXT NOT NULL DEFAULT '',
+		city TEXT NOT NULL DEFAULT '',
+		device TEXT NOT NULL DEFAULT '',
+		browser TEXT NOT NULL DEFAULT '',
+		os TEXT NOT NULL DEFAULT '',
+		screen TEXT NOT NULL DEFAULT ''`
+
+const eventsColumns = `
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts INTEGER NOT NULL DEFAULT (unixepoch()),
+		event_type TEXT NOT NULL,
+		visitor_hash TEXT NOT NULL,
+		metadata TEXT NOT NULL DEFAULT ''`
+
+// rawIndexes returns the index definitions for a page_views or events table
+// (or one of their monthly partitions). The ts-leading index covers the
+// dashboard totals, unique visitors, time series and top pages, so those
+// are answered from a range of the index alone. There are deliberately no
+// standalone visitor_hash or path indexes: the planner prefers a full scan
+// of those to avoid a temp b-tree, which is far slower for short windows.
+func rawIndexes(table string) []string {
+	if strings.HasPrefix(table, "page_views") {
+		return []string{
+			`CREATE INDEX IF NOT EXISTS idx_` + table + `_ts_cover ON ` + table + `(ts, visitor_hash, path)`,
+			// Covers the device, browser and OS breakdowns, which would
+			// otherwise look up every row of the window
+			`CREATE INDEX IF NOT EXISTS idx_` + table + `_ts_agent ON ` + table + `(ts, device, browser, os)`,
+		}
+	}
+	return []string{
+		`CREATE INDEX IF NOT EXISTS idx_` + table + `_ts_type ON ` + table + `(ts, event_type)`,
+		`CREATE INDEX IF NOT EXISTS idx_` + table + `_type ON ` + table + `(event_type)`,
+	}
+}
+
+func createIndexes() error {
+	stmts := []string{`CREATE INDEX IF NOT EXISTS idx_agg_date ON daily_aggregates(date)`}
+	if !partitionMonthly {
+		stmts = append(stmts, rawIndexes("page_views")...)
+		stmts = append(stmts, rawIndexes("events")...)
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			return fmt.Errorf("create index: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateSchema adds columns that may not exist in older databases and
+// converts ISO TEXT timestamps to integer epoch seconds.
 func migrateSchema() error {
+	if isView("page_views") {
+		// Partitioned databases were already migrated before partitioning
+		return setSchemaVersion()
+	}
+
 	migrations := []string{
 		`ALTER TABLE page_views ADD COLUMN ip_address TEXT NOT NULL DEFAULT ''`,
 		`ALTER TABLE page_views ADD COLUMN region TEXT NOT NULL DEFAULT ''`,
@@ -100,16 +293,68 @@ func migrateSchema() error {
 		// Ignore "duplicate column" errors for idempotency
 		_, err := db.Exec(m)
 		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
-			log.Printf("migration skipped: %v", err)
+			slog.Warn("migration skipped", "err", err)
 		}
 	}
+
+	for _, t := range []struct{ table, columns, copyCols string }{
+		{"page_views", pageViewsColumns, "path, referrer, visitor_hash, ip_address, country, region, city, device, browser, os, screen"},
+		{"events", eventsColumns, "event_type, visitor_hash, metadata"},
+	} {
+		if err := migrateEpoch(t.table, t.columns, t.copyCols); err != nil {
+			return err
+		}
+	}
+
+	return setSchemaVersion()
+}
+
+func setSchemaVersion() error {
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version=%d", schemaVersion)); err != nil {
+		return fmt.Errorf("set schema version: %w", err)
+	}
 	return nil
 }
 
+// migrateEpoch rebuilds a table that still has the old TEXT timestamp
+// column into the integer ts layout.
+func migrateEpoch(table, columns, copyCols string) error {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'timestamp'`, table).Scan(&n)
+	if n == 0 {
+		return nil
+	}
+
+	slog.Info("migrating to integer timestamps", "table", table)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`CREATE TABLE ` + table + `_epoch (` + columns + `)`,
+		`INSERT INTO ` + table + `_epoch (id, ts, ` + copyCols + `)
+			SELECT id, CAST(strftime('%s', timestamp) AS INTEGER), ` + copyCols + ` FROM ` + table,
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + table + `_epoch RENAME TO ` + table,
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("migrate %s timestamps: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
 // InsertPageView records a page view.
 func InsertPageView(path, referrer, visitorHash, ipAddress, country, region, city, device, browser, os, screen string) error {
-	_, err := db.Exec(
-		`INSERT INTO page_views (path, referrer, visitor_hash, ip_address, country, region, city, device, browser, os, screen)
+	table, err := insertTable("page_views")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO `+table+` (path, referrer, visitor_hash, ip_address, country, region, city, device, browser, os, screen)
 		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		path, referrer, visitorHash, ipAddress, country, region, city, device, browser, os, screen,
 	)
@@ -118,189 +363,217 @@ func InsertPageView(path, referrer, visitorHash, ipAddress, country, region, cit
 
 // InsertEvent records a discrete event.
 func InsertEvent(eventType, visitorHash, metadata string) error {
-	_, err := db.Exec(
-		`INSERT INTO events (event_type, visitor_hash, metadata) VALUES (?, ?, ?)`,
+	table, err := insertTable("events")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO `+table+` (event_type, visitor_hash, metadata) VALUES (?, ?, ?)`,
 		eventType, visitorHash, metadata,
 	)
 	return err
 }
 
-// StatsResult holds dashboard data.
-type StatsResult struct {
-	TotalViews     int              `json:"total_views"`
-	UniqueVisitors int              `json:"unique_visitors"`
-	ActiveNow      int              `json:"active_now"`
-	TimeSeries     []TimePoint      `json:"time_series"`
-	TopPages       []PathCount      `json:"top_pages"`
-	TopReferrers   []PathCount      `json:"top_referrers"`
-	Browsers       []PathCount      `json:"browsers"`
-	Devices        []PathCount      `json:"devices"`
-	OSStats        []PathCount      `json:"os_stats"`
-	Countries      []PathCount      `json:"countries"`
-	Events         []EventSummary   `json:"events"`
-	Screens        []PathCount      `json:"screens"`
-}
-
-type TimePoint struct {
-	Date  string `json:"date"`
-	Views int    `json:"views"`
-	Uniq  int    `json:"uniq"`
-}
-
-type PathCount struct {
-	Name  string `json:"name"`
-	Count int    `json:"count"`
-}
-
-type EventSummary struct {
-	Type  string `json:"type"`
-	Count int    `json:"count"`
+// QueryStats returns dashboard stats for the given range.
+func QueryStats(rng TimeRange) (*StatsResult, error) {
+	return QueryStatsContext(context.Background(), rng, Filter{})
 }
 
-// QueryStats returns dashboard stats for the given number of days.
-func QueryStats(days int) (*StatsResult, error) {
-	since := time.Now().UTC().AddDate(0, 0, -days).Format("2006-01-02T15:04:05Z")
-	result := &StatsResult{}
+// QueryStatsContext is QueryStats bounded by ctx and restricted to the
+// segment f; a cancelled or expired context stops the scans in progress.
+func QueryStatsContext(ctx context.Context, rng TimeRange, f Filter) (*StatsResult, error) {
+	from, to := rng.From.Unix(), rng.To.Unix()
+	fw, fargs := f.where("page_views", from, to)
+	args := append([]any{from, to}, fargs...)
+	result := &StatsResult{
+		From:     rng.From.In(rng.Loc).Format(time.RFC3339),
+		To:       rng.To.In(rng.Loc).Format(time.RFC3339),
+		Timezone: rng.Loc.String(),
+		Interval: rng.Interval(),
+	}
+	q := &statsQuery{ctx: ctx}
 
 	// Total views
-	row := db.QueryRow(`SELECT COUNT(*) FROM page_views WHERE timestamp >= ?`, since)
-	row.Scan(&result.TotalViews)
+	q.scalar(&result.TotalViews, `SELECT COUNT(*) FROM page_views WHERE ts >= ? AND ts < ?`+fw, args...)
 
 	// Unique visitors
-	row = db.QueryRow(`SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE timestamp >= ?`, since)
-	row.Scan(&result.UniqueVisitors)
+	q.scalar(&result.UniqueVisitors, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ? AND ts < ?`+fw, args...)
 
 	// Active now (last 30 minutes)
-	thirtyAgo := time.Now().UTC().Add(-30 * time.Minute).Format("2006-01-02T15:04:05Z")
-	row = db.QueryRow(`SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE timestamp >= ?`, thirtyAgo)
-	row.Scan(&result.ActiveNow)
-
-	// Time series (per day)
-	rows, err := db.Query(`
-		SELECT date(timestamp) as d, COUNT(*) as views, COUNT(DISTINCT visitor_hash) as uniq
-		FROM page_views WHERE timestamp >= ?
-		GROUP BY d ORDER BY d`, since)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var tp TimePoint
-			rows.Scan(&tp.Date, &tp.Views, &tp.Uniq)
-			result.TimeSeries = append(result.TimeSeries, tp)
+	thirtyAgo := time.Now().UTC().Add(-30 * time.Minute).Unix()
+	nw, nargs := f.where("page_views", thirtyAgo, math.MaxInt64)
+	q.scalar(&result.ActiveNow, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ?`+nw, append([]any{thirtyAgo}, nargs...)...)
+
+	// Time series, bucketed by day or hour in the requested zone
+	bucket, bucketArgs := rng.bucketExpr()
+	q.rows(`
+		SELECT `+bucket+` as d, COUNT(*) as views, COUNT(DISTINCT visitor_hash) as uniq
+		FROM page_views WHERE ts >= ? AND ts < ?`+fw+`
+		GROUP BY d ORDER BY d`, append(bucketArgs, args...), func(rows *sql.Rows) error {
+		var tp TimePoint
+		if err := rows.Scan(&tp.Date, &tp.Views, &tp.Uniq); err != nil {
+			return err
 		}
-	}
+		result.TimeSeries = append(result.TimeSeries, tp)
+		return nil
+	})
 
 	// Top pages
-	result.TopPages = queryPathCounts(`
-		SELECT path, COUNT(*) as c FROM page_views WHERE timestamp >= ?
-		GROUP BY path ORDER BY c DESC LIMIT 20`, since)
+	result.TopPages = q.pathCounts(`
+		SELECT path, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ?`+fw+`
+		GROUP BY path ORDER BY c DESC LIMIT 20`, args...)
 
 	// Top referrers
-	result.TopReferrers = queryPathCounts(`
-		SELECT referrer, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND referrer != ''
-		GROUP BY referrer ORDER BY c DESC LIMIT 20`, since)
+	result.TopReferrers = q.pathCounts(`
+		SELECT referrer, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND referrer != ''`+fw+`
+		GROUP BY referrer ORDER BY c DESC LIMIT 20`, args...)
 
 	// Browsers
-	result.Browsers = queryPathCounts(`
-		SELECT browser, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND browser != ''
-		GROUP BY browser ORDER BY c DESC LIMIT 10`, since)
+	result.Browsers = q.pathCounts(`
+		SELECT browser, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND browser != ''`+fw+`
+		GROUP BY browser ORDER BY c DESC LIMIT 10`, args...)
 
 	// Devices
-	result.Devices = queryPathCounts(`
-		SELECT device, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND device != ''
-		GROUP BY device ORDER BY c DESC LIMIT 10`, since)
+	result.Devices = q.pathCounts(`
+		SELECT device, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND device != ''`+fw+`
+		GROUP BY device ORDER BY c DESC LIMIT 10`, args...)
 
 	// OS
-	result.OSStats = queryPathCounts(`
-		SELECT os, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND os != ''
-		GROUP BY os ORDER BY c DESC LIMIT 10`, since)
+	result.OSStats = q.pathCounts(`
+		SELECT os, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND os != ''`+fw+`
+		GROUP BY os ORDER BY c DESC LIMIT 10`, args...)
 
 	// Countries
-	result.Countries = queryPathCounts(`
-		SELECT country, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND country != ''
-		GROUP BY country ORDER BY c DESC LIMIT 20`, since)
+	result.Countries = q.pathCounts(`
+		SELECT country, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND country != ''`+fw+`
+		GROUP BY country ORDER BY c DESC LIMIT 20`, args...)
 
 	// Screens
-	result.Screens = queryPathCounts(`
-		SELECT screen, COUNT(*) as c FROM page_views WHERE timestamp >= ? AND screen != ''
-		GROUP BY screen ORDER BY c DESC LIMIT 10`, since)
+	result.Screens = q.pathCounts(`
+		SELECT screen, COUNT(*) as c FROM page_views WHERE ts >= ? AND ts < ? AND screen != ''`+fw+`
+		GROUP BY screen ORDER BY c DESC LIMIT 10`, args...)
 
 	// Events
-	eventRows, err := db.Query(`
-		SELECT event_type, COUNT(*) as c FROM events WHERE timestamp >= ?
-		GROUP BY event_type ORDER BY c DESC`, since)
-	if err == nil {
-		defer eventRows.Close()
-		for eventRows.Next() {
-			var es EventSummary
-			eventRows.Scan(&es.Type, &es.Count)
-			result.Events = append(result.Events, es)
+	ew, eargs := f.where("events", from, to)
+	q.rows(`
+		SELECT event_type, COUNT(*) as c FROM events WHERE ts >= ? AND ts < ?`+ew+`
+		GROUP BY event_type ORDER BY c DESC`, append([]any{from, to}, eargs...), func(rows *sql.Rows) error {
+		var es EventSummary
+		if err := rows.Scan(&es.Type, &es.Count); err != nil {
+			return err
 		}
-	}
+		result.Events = append(result.Events, es)
+		return nil
+	})
 
+	if q.err != nil {
+		return nil, q.err
+	}
 	return result, nil
 }
 
-func queryPathCounts(query, since string) []PathCount {
-	rows, err := db.Query(query, since)
+// statsQuery runs a sequence of read queries against readDB under one
+// context, remembering the first error and skipping the rest after it.
+type statsQuery struct {
+	ctx context.Context
+	err error
+}
+
+func (q *statsQuery) scalar(dest any, query string, args ...any) {
+	if q.err != nil {
+		return
+	}
+	q.err = readDB.QueryRowContext(q.ctx, query, args...).Scan(dest)
+}
+
+func (q *statsQuery) rows(query string, args []any, scan func(*sql.Rows) error) {
+	if q.err != nil {
+		return
+	}
+	rows, err := readDB.QueryContext(q.ctx, query, args...)
 	if err != nil {
-		return nil
+		q.err = err
+		return
 	}
 	defer rows.Close()
-	var results []PathCount
 	for rows.Next() {
-		var pc PathCount
-		rows.Scan(&pc.Name, &pc.Count)
-		results = append(results, pc)
+		if err := scan(rows); err != nil {
+			q.err = err
+			return
+		}
 	}
-	return results
+	q.err = rows.Err()
 }
 
-// RealtimeResult holds active visitors data.
-type RealtimeResult struct {
-	ActiveVisitors int         `json:"active_visitors"`
-	ActivePages    []PathCount `json:"active_pages"`
+func (q *statsQuery) pathCounts(query string, args ...any) []PathCount {
+	var results []PathCount
+	q.rows(query, args, func(rows *sql.Rows) error {
+		var pc PathCount
+		if err := rows.Scan(&pc.Name, &pc.Count); err != nil {
+			return err
+		}
+		results = append(results, pc)
+		return nil
+	})
+	return results
 }
 
 // QueryRealtime returns last-30-minute activity.
 func QueryRealtime() (*RealtimeResult, error) {
-	since := time.Now().UTC().Add(-30 * time.Minute).Format("2006-01-02T15:04:05Z")
+	return QueryRealtimeContext(context.Background(), Filter{})
+}
+
+// QueryRealtimeContext is QueryRealtime bounded by ctx and restricted to
+// the segment f.
+func QueryRealtimeContext(ctx context.Context, f Filter) (*RealtimeResult, error) {
+	window := realtimeWindow()
+	since := window.From.Unix()
 	result := &RealtimeResult{}
+	q := &statsQuery{ctx: ctx}
+	fw, fargs := f.where("page_views", since, math.MaxInt64)
+	args := append([]any{since}, fargs...)
 
-	row := db.QueryRow(`SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE timestamp >= ?`, since)
-	row.Scan(&result.ActiveVisitors)
+	q.scalar(&result.ActiveVisitors, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ?`+fw, args...)
 
-	result.ActivePages = queryPathCounts(`
-		SELECT path, COUNT(*) as c FROM page_views WHERE timestamp >= ?
-		GROUP BY path ORDER BY c DESC LIMIT 10`, since)
+	result.ActivePages = q.pathCounts(`
+		SELECT path, COUNT(*) as c FROM page_views WHERE ts >= ?`+fw+`
+		GROUP BY path ORDER BY c DESC LIMIT 10`, args...)
 
+	if q.err != nil {
+		return nil, q.err
+	}
+	if k := setting(&minVisitors); k > 1 {
+		visitors, err := visitorCounts(ctx, "page_views", "path", result.ActivePages, window, f)
+		if err != nil {
+			return nil, err
+		}
+		result.ActivePages = foldSmall(result.ActivePages, visitors, k)
+	}
 	return result, nil
 }
 
-// RecentVisit represents a single page view for the live log.
-type RecentVisit struct {
-	Timestamp   string `json:"timestamp"`
-	Path        string `json:"path"`
-	IPAddress   string `json:"ip_address"`
-	VisitorHash string `json:"visitor_hash"`
-	Country     string `json:"country"`
-	Region      string `json:"region"`
-	City        string `json:"city"`
-	Browser     string `json:"browser"`
-	OS          string `json:"os"`
-	Device      string `json:"device"`
-	Referrer    string `json:"referrer"`
-	Screen      string `json:"screen"`
+// realtimeWindow is the last 30 minutes, ending a little after now so
+// that views stored while a query runs still count.
+func realtimeWindow() TimeRange {
+	now := time.Now().UTC()
+	return TimeRange{From: now.Add(-30 * time.Minute), To: now.Add(time.Minute), Loc: time.UTC}
 }
 
-// QueryRecentVisitors returns the last N page views.
+// QueryRecentVisitors returns the last N page views. Places seen by fewer
+// than minVisitors visitors are generalised to the region or country.
 func QueryRecentVisitors(limit int) ([]RecentVisit, error) {
+	return QueryRecentVisitorsContext(context.Background(), limit)
+}
+
+// QueryRecentVisitorsContext is QueryRecentVisitors bounded by ctx.
+func QueryRecentVisitorsContext(ctx context.Context, limit int) ([]RecentVisit, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
 	}
-	rows, err := db.Query(`
-		SELECT timestamp, path, ip_address, visitor_hash, country, region, city, browser, os, device, referrer, screen
+	rows, err := readDB.QueryContext(ctx, `
+		SELECT strftime('%Y-%m-%dT%H:%M:%SZ', ts, 'unixepoch'), path, ip_address, visitor_hash, country, region, city, browser, os, device, referrer, screen
 		FROM page_views
-		ORDER BY id DESC
+		ORDER BY ts DESC, id DESC
 		LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
@@ -310,53 +583,89 @@ func QueryRecentVisitors(limit int) ([]RecentVisit, error) {
 	var results []RecentVisit
 	for rows.Next() {
 		var rv RecentVisit
-		rows.Scan(&rv.Timestamp, &rv.Path, &rv.IPAddress, &rv.VisitorHash, &rv.Country,
-			&rv.Region, &rv.City, &rv.Browser, &rv.OS, &rv.Device, &rv.Referrer, &rv.Screen)
+		if err := rows.Scan(&rv.Timestamp, &rv.Path, &rv.IPAddress, &rv.VisitorHash, &rv.Country,
+			&rv.Region, &rv.City, &rv.Browser, &rv.OS, &rv.Device, &rv.Referrer, &rv.Screen); err != nil {
+			return nil, err
+		}
+		rv.Country, rv.Region, rv.City = places.generalize(rv.Country, rv.Region, rv.City)
 		results = append(results, rv)
 	}
-	return results, nil
+	return results, rows.Err()
 }
 
-// RebuildAggregates rebuilds the daily_aggregates table.
+// RebuildAggregates rebuilds the daily_aggregates table for the days that
+// still have raw page views.
 func RebuildAggregates() {
+	start := time.Now()
+	var since int64
+	if days := setting(&retention).PageViews; days > 0 {
+		since = dayStart(days)
+	}
 	_, err := db.Exec(`
 		INSERT OR REPLACE INTO daily_aggregates (date, path, views, unique_visitors)
-		SELECT date(timestamp), path, COUNT(*), COUNT(DISTINCT visitor_hash)
+		SELECT date(ts, 'unixepoch') AS d, path, COUNT(*), COUNT(DISTINCT visitor_hash)
 		FROM page_views
-		WHERE date(timestamp) >= date('now', '-90 days')
-		GROUP BY date(timestamp), path
-	`)
+		WHERE ts >= ?
+		GROUP BY d, path
+	`, since)
+	metrics.aggregation.record(time.Since(start), err)
 	if err != nil {
-		log.Printf("rebuild aggregates: %v", err)
+		slog.Error("rebuild aggregates", "err", err)
 	}
 }
 
-// PurgeOldData removes raw data older than 90 days.
-func PurgeOldData() {
-	cutoff := time.Now().UTC().AddDate(0, 0, -90).Format("2006-01-02T15:04:05Z")
-	db.Exec(`DELETE FROM page_views WHERE timestamp < ?`, cutoff)
-	db.Exec(`DELETE FROM events WHERE timestamp < ?`, cutoff)
-	db.Exec(`DELETE FROM daily_salt WHERE date < date('now', '-90 days')`)
-	log.Println("purged data older than 90 days")
+// purgeRescheduled wakes the aggregation loop to recompute the next purge
+// time after a reload.
+var purgeRescheduled = make(chan struct{}, 1)
+
+func reschedulePurge() {
+	select {
+	case purgeRescheduled <- struct{}{}:
+	default:
+	}
 }
 
-// StartAggregationLoop runs aggregation every 5 minutes and purge daily.
+// aggregateInterval is how often the aggregation loop rebuilds aggregates.
+const aggregateInterval = 5 * time.Minute
+
+// aggregationBeat is when the aggregation loop last started or finished a
+// job, or a chunk of one, in Unix nanoseconds, for the readiness check.
+var aggregationBeat atomic.Int64
+
+// heartbeat records that the aggregation loop is making progress.
+func heartbeat() { aggregationBeat.Store(time.Now().UnixNano()) }
+
+// StartAggregationLoop runs aggregation every 5 minutes, and the retention
+// purge once at startup and then daily at retention.PurgeAt (UTC).
 func StartAggregationLoop() {
 	go func() {
-		aggTicker := time.NewTicker(5 * time.Minute)
-		purgeTicker := time.NewTicker(24 * time.Hour)
+		aggTicker := time.NewTicker(aggregateInterval)
 		defer aggTicker.Stop()
-		defer purgeTicker.Stop()
+		heartbeat()
 
 		// Run once on startup
 		RebuildAggregates()
+		heartbeat()
+		runScheduledPurge()
+		heartbeat()
+
+		purgeTimer := time.NewTimer(time.Until(nextPurgeTime(time.Now())))
+		defer purgeTimer.Stop()
 
 		for {
 			select {
 			case <-aggTicker.C:
 				RebuildAggregates()
-			case <-purgeTicker.C:
-				PurgeOldData()
+				heartbeat()
+			case <-purgeTimer.C:
+				runScheduledPurge()
+				heartbeat()
+				purgeTimer.Reset(time.Until(nextPurgeTime(time.Now())))
+			case <-purgeRescheduled:
+				if !purgeTimer.Stop() {
+					<-purgeTimer.C
+				}
+				purgeTimer.Reset(time.Until(nextPurgeTime(time.Now())))
 			}
 		}
 	}()
@@ -9,8 +9,10 @@
 # First-time VPS setup (run once):
 #   ssh paul@198.23.134.103
 #   mkdir -p ~/noblemind-console
-#   openssl rand -hex 32   # generate auth token
-#   echo 'CONSOLE_TOKEN=<paste-token-here>' > ~/noblemind-console/.env
+#   # After the first deploy, create the first admin (prompts for a password):
+#   #   cd ~/noblemind-console && ./noblemind-console user add -role admin <name>
+#   # Optional legacy bearer token for scripts:
+#   #   echo "CONSOLE_TOKEN=$(openssl rand -hex 32)" > ~/noblemind-console/.env
 #   # Download IP2Location LITE DB1 CSV (free):
 #   #   https://lite.ip2location.com/database/db1-ip-country
 #   # Place as ~/noblemind-console/IP2LOCATION-LITE-DB1.CSV
@@ -60,8 +62,13 @@ echo ""
 # Step 4: Restart service
 echo "[4/4] Restarting service..."
 ssh "$VPS_HOST" "sudo systemctl restart noblemind-console"
-sleep 2
-ssh "$VPS_HOST" "sudo systemctl status noblemind-console --no-pager -l" || true
+# Wait up to 30s for /readyz, and fail the deploy if the console never is
+if ! ssh "$VPS_HOST" 'for i in $(seq 30); do curl -fsS -o /dev/null http://127.0.0.1:3001/readyz && exit 0; sleep 1; done; exit 1'; then
+  echo "Service did not become ready:"
+  ssh "$VPS_HOST" "curl -sS http://127.0.0.1:3001/readyz; echo; sudo systemctl status noblemind-console --no-pager -l" || true
+  exit 1
+fi
+echo "Ready, running $(ssh "$VPS_HOST" "curl -fsS http://127.0.0.1:3001/version")"
 echo ""
 
 # Clean up local binary
@@ -70,5 +77,5 @@ rm -f noblemind-console
 echo "=========================================="
 echo "Deployment complete!"
 echo ""
-echo "Dashboard: https://noblemind.study/console?token=<your-token>"
+echo "Dashboard: https://noblemind.study/console"
 echo "=========================================="
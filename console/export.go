@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export is one bulk export: a dataset over a time range and segment,
+// encoded as CSV, NDJSON or Parquet. Rows are streamed from the database
+// to the encoder, so memory use does not grow with the export (Parquet
+// buffers one row group at a time).
+type Export struct {
+	Dataset string // pageviews, events, sessions or breakdown
+	Format  string // csv, ndjson or parquet
+	Gzip    bool   // gzip the stream; for Parquet, compress the pages instead
+	Query   AnalyticsQuery
+	Dims    []string // breakdown dimensions
+	RawIP   bool     // export IP addresses unmasked
+}
+
+var exportDatasets = []string{"pageviews", "events", "sessions", "breakdown"}
+
+var exportTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// parseExport reads an export from query parameters:
+//
+//	dataset     pageviews (default), events, sessions or breakdown
+//	format      csv (default), ndjson or parquet
+//	gzip        1 to compress
+//	include_ip  1 to export IP addresses unmasked
+//	dimension   breakdown dimension (required for breakdown)
+//	pivot       optional second breakdown dimension
+//	metric      breakdown metric, as for /api/analytics/breakdown
+//
+// plus the time range and filter parameters of /api/analytics/stats.
+func parseExport(q url.Values) (Export, error) {
+	a, err := parseAnalyticsQuery(q)
+	if err != nil {
+		return Export{}, err
+	}
+	e := Export{
+		Dataset: q.Get("dataset"),
+		Format:  q.Get("format"),
+		Gzip:    parseBool(q.Get("gzip")),
+		Query:   a,
+		RawIP:   parseBool(q.Get("include_ip")),
+	}
+	if e.Dataset == "" {
+		e.Dataset = "pageviews"
+	}
+	if e.Format == "" {
+		e.Format = "csv"
+	}
+	if _, ok := exportTypes[e.Format]; !ok {
+		return Export{}, fmt.Errorf("format must be csv, ndjson or parquet")
+	}
+
+	if !slices.Contains(exportDatasets, e.Dataset) {
+		return Export{}, fmt.Errorf("dataset must be %s", strings.Join(exportDatasets, ", "))
+	}
+	if e.Dataset == "breakdown" {
+		e.Dims = []string{q.Get("dimension")}
+		if p := q.Get("pivot"); p != "" {
+			e.Dims = append(e.Dims, p)
+		}
+		for _, d := range e.Dims {
+			if d == "" {
+				return Export{}, fmt.Errorf("dimension is required")
+			}
+			if err := a.checkDimension(d); err != nil {
+				return Export{}, err
+			}
+		}
+		if len(e.Dims) == 2 && e.Dims[0] == e.Dims[1] {
+			return Export{}, fmt.Errorf("pivot must differ from dimension")
+		}
+	}
+	return e, nil
+}
+
+// Filename names the export after its dataset and the days it covers,
+// e.g. pageviews_2026-10-01_2026-10-18.csv.gz.
+func (e Export) Filename() string {
+	rng := e.Query.Range
+	name := e.Dataset
+	for _, d := range e.Dims {
+		name += "-" + d
+	}
+	first := rng.From.In(rng.Loc).Format("2006-01-02")
+	last := rng.To.Add(-time.Nanosecond).In(rng.Loc).Format("2006-01-02")
+	name += "_" + first + "_" + last + "." + e.Format
+	if e.Gzip && e.Format != "parquet" {
+		name += ".gz"
+	}
+	return name
+}
+
+// ContentType is the media type of the export as written.
+func (e Export) ContentType() string {
+	if e.Gzip && e.Format != "parquet" {
+		return "application/gzip"
+	}
+	return exportTypes[e.Format]
+}
+
+// exportTimestamp formats ts as an RFC 3339 UTC timestamp.
+const exportTimestamp = `strftime('%Y-%m-%dT%H:%M:%SZ', ts, 'unixepoch')`
+
+// query returns the SQL and columns for the export's dataset, in
+// chronological (or, for breakdowns, descending value) order.
+func (e Export) query() (string, []any, []parquetColumn) {
+	a := e.Query
+	from, to := a.Range.From.Unix(), a.Range.To.Unix()
+
+	switch e.Dataset {
+	case "events":
+		fw, fargs := a.Filter.where("events", from, to)
+		return `SELECT id, ` + exportTimestamp + `, event_type, visitor_hash, metadata
+			FROM events WHERE ts >= ? AND ts < ?` + fw + ` ORDER BY ts, id`,
+			append([]any{from, to}, fargs...),
+			[]parquetColumn{{"id", true}, {"timestamp", false}, {"event_type", false}, {"visitor_hash", false}, {"metadata", false}}
+
+	case "sessions":
+		return e.sessionsQuery()
+
+	case "breakdown":
+		keys := make([]string, len(e.Dims))
+		cols := make([]parquetColumn, 0, len(e.Dims)+1)
+		order := []string{"value DESC"}
+		for i, d := range e.Dims {
+			keys[i] = dimensionColumns[d]
+			cols = append(cols, parquetColumn{d, false})
+			order = append(order, "k"+strconv.Itoa(i))
+		}
+		q, args := a.folded(keys)
+		return q + ` ORDER BY ` + strings.Join(order, ", "), args, append(cols, parquetColumn{a.Metric, true})
+	}
+
+	// IP addresses past the retention window are exported blank even if
+	// the daily purge has not cleared them yet
+	ipCutoff := int64(0)
+	if days := setting(&retention).IPAddress; days > 0 {
+		ipCutoff = dayStart(days)
+	}
+	fw, fargs := a.Filter.where("page_views", from, to)
+	return `SELECT id, ` + exportTimestamp + `, path, referrer, visitor_hash,
+			CASE WHEN ts >= ? THEN ip_address ELSE '' END,
+			country, region, city, device, browser, os, screen
+		FROM page_views WHERE ts >= ? AND ts < ?` + fw + ` ORDER BY ts, id`,
+		append([]any{ipCutoff, from, to}, fargs...),
+		[]parquetColumn{
+			{"id", true}, {"timestamp", false}, {"path", false}, {"referrer", false},
+			{"visitor_hash", false}, {"ip_address", false}, {"country", false}, {"region", false},
+			{"city", false}, {"device", false}, {"browser", false}, {"os", false}, {"screen", false},
+		}
+}
+
+// sessionsQuery reports one row per session, split on sessionGap as for
+// the sessions metric. Sessions are built from every view in the range and
+// kept when any of their views matches the filter.
+func (e Export) sessionsQuery() (string, []any, []parquetColumn) {
+	a := e.Query
+	from, to := a.Range.From.Unix(), a.Range.To.Unix()
+	fw, fargs := a.Filter.where("page_views", from, to)
+
+	matched := ``
+	args := []any{int64(sessionGap.Seconds()), from, to}
+	if fw != "" {
+		matched = ` WHERE (visitor_hash, session) IN (SELECT visitor_hash, session FROM numbered WHERE 1` + fw + `)`
+		args = append(args, fargs...)
+	}
+	query := `
+		WITH marked AS (
+			SELECT id, ts, path, referrer, visitor_hash, country, region, city, device, browser, os, screen,
+				CASE WHEN ts - LAG(ts) OVER (PARTITION BY visitor_hash ORDER BY ts, id) <= ? THEN 0 ELSE 1 END AS new_session
+			FROM page_views WHERE ts >= ? AND ts < ?
+		),
+		numbered AS (
+			SELECT *, SUM(new_session) OVER (PARTITION BY visitor_hash ORDER BY ts, id ROWS UNBOUNDED PRECEDING) AS session
+			FROM marked
+		),
+		edges AS (
+			SELECT visitor_hash, session, ts,
+				FIRST_VALUE(path) OVER s AS entry_path, LAST_VALUE(path) OVER s AS exit_path,
+				FIRST_VALUE(referrer) OVER s AS referrer, FIRST_VALUE(country) OVER s AS country,
+				FIRST_VALUE(device) OVER s AS device, FIRST_VALUE(browser) OVER s AS browser,
+				FIRST_VALUE(os) OVER s AS os
+			FROM numbered` + matched + `
+			WINDOW s AS (PARTITION BY visitor_hash, session ORDER BY ts, id
+				ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING)
+		)
+		SELECT visitor_hash, strftime('%Y-%m-%dT%H:%M:%SZ', MIN(ts), 'unixepoch'),
+			strftime('%Y-%m-%dT%H:%M:%SZ', MAX(ts), 'unixepoch'), MAX(ts) - MIN(ts), COUNT(*),
+			entry_path, exit_path, referrer, country, device, browser, os
+		FROM edges GROUP BY visitor_hash, session ORDER BY MIN(ts), visitor_hash`
+	return query, args, []parquetColumn{
+		{"visitor_hash", false}, {"start", false}, {"end", false}, {"duration_seconds", true},
+		{"pageviews", true}, {"entry_path", false}, {"exit_path", false}, {"referrer", false},
+		{"country", false}, {"device", false}, {"browser", false}, {"os", false},
+	}
+}
+
+// exportEncoder writes rows of int64 and string values.
+type exportEncoder interface {
+	WriteRow(values []any) error
+	Close() error
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVEncoder(w io.Writer, cols []parquetColumn) (*csvEncoder, error) {
+	enc := &csvEncoder{w: csv.NewWriter(w), record: make([]string, len(cols))}
+	for i, c := range cols {
+		enc.record[i] = c.name
+	}
+	return enc, enc.w.Write(enc.record)
+}
+
+func (enc *csvEncoder) WriteRow(values []any) error {
+	for i, v := range values {
+		switch v := v.(type) {
+		case int64:
+			enc.record[i] = strconv.FormatInt(v, 10)
+		case string:
+			enc.record[i] = v
+		}
+	}
+	return enc.w.Write(enc.record)
+}
+
+func (enc *csvEncoder) Close() error {
+	enc.w.Flush()
+	return enc.w.Error()
+}
+
+// ndjsonEncoder writes one JSON object per row, keys in column order.
+type ndjsonEncoder struct {
+	w    *bufio.Writer
+	keys [][]byte
+	line []byte
+}
+
+func newNDJSONEncoder(w io.Writer, cols []parquetColumn) *ndjsonEncoder {
+	enc := &ndjsonEncoder{w: bufio.NewWriter(w)}
+	for _, c := range cols {
+		key, _ := json.Marshal(c.name)
+		enc.keys = append(enc.keys, append(key, ':'))
+	}
+	return enc
+}
+
+func (enc *ndjsonEncoder) WriteRow(values []any) error {
+	line := append(enc.line[:0], '{')
+	for i, v := range values {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		line = append(line, enc.keys[i]...)
+		switch v := v.(type) {
+		case int64:
+			line = strconv.AppendInt(line, v, 10)
+		case string:
+			s, _ := json.Marshal(v)
+			line = append(line, s...)
+		}
+	}
+	enc.line = append(line, '}', '\n')
+	_, err := enc.w.Write(enc.line)
+	return err
+}
+
+func (enc *ndjsonEncoder) Close() error { return enc.w.Flush() }
+
+// maskIP truncates an IP address to its /24 (IPv4) or /48 (IPv6) network.
+func maskIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// openExport starts the export's query. It is separate from writeExport
+// so that a failing query can still be answered with an error status.
+func openExport(ctx context.Context, e Export) (*sql.Rows, []parquetColumn, error) {
+	query, args, cols := e.query()
+	rows, err := readDB.QueryContext(ctx, query, args...)
+	return rows, cols, err
+}
+
+// writeExport encodes rows to w in the export's format and closes rows.
+// It returns the number of rows written.
+func writeExport(w io.Writer, e Export, rows *sql.Rows, cols []parquetColumn) (n int64, err error) {
+	defer rows.Close()
+
+	var zw *gzip.Writer
+	if e.Gzip && e.Format != "parquet" {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+
+	var enc exportEncoder
+	switch e.Format {
+	case "csv":
+		enc, err = newCSVEncoder(w, cols)
+	case "ndjson":
+		enc = newNDJSONEncoder(w, cols)
+	case "parquet":
+		enc, err = newParquetWriter(w, cols, e.Gzip)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ipCol := -1
+	if e.Dataset == "pageviews" && !e.RawIP {
+		for i, c := range cols {
+			if c.name == "ip_address" {
+				ipCol = i
+			}
+		}
+	}
+
+	// Every column is required, so a NULL (which the schema does not
+	// allow, but a hand-edited database may hold) is written as 0 or ""
+	ints := make([]sql.NullInt64, len(cols))
+	strs := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	values := make([]any, len(cols))
+	for i, c := range cols {
+		if c.isInt {
+			dest[i] = &ints[i]
+		} else {
+			dest[i] = &strs[i]
+		}
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, c := range cols {
+			if c.isInt {
+				values[i] = ints[i].Int64
+			} else {
+				values[i] = strs[i].String
+			}
+		}
+		if ipCol >= 0 {
+			values[ipCol] = maskIP(strs[ipCol].String)
+		}
+		if err := enc.WriteRow(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if err := enc.Close(); err != nil {
+		return n, err
+	}
+	if zw != nil {
+		return n, zw.Close()
+	}
+	return n, nil
+}
+
+// deadlineWriter extends the connection's write deadline before each
+// write, so a long export is not cut off by the server's WriteTimeout
+// while a stalled client still is.
+type deadlineWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	d.rc.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+	return d.w.Write(p)
+}
+
+// exportDetail describes an export for the audit log.
+func exportDetail(e Export, rows int64, err error) string {
+	d := fmt.Sprintf("%s, %d rows", e.Filename(), rows)
+	if e.RawIP {
+		d += ", unmasked IP addresses"
+	}
+	if err != nil {
+		d += ", aborted"
+	}
+	return d
+}
+
+// handleExport serves /api/analytics/export as a file download; see
+// parseExport for the parameters. IP addresses are masked to their network
+// unless include_ip=1, and blank past the IP retention window either way.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	e, err := parseExport(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.RawIP && !permitted(r, roleAdmin, scopeAdmin) {
+		http.Error(w, "include_ip requires the admin role or scope", http.StatusForbidden)
+		return
+	}
+	// Breakdowns are aggregates, held to the same k-anonymity as the API's
+	if e.Dataset == "breakdown" && !segmentAllowed(w, r.Context(), "export", e.Query.table(), e.Query.Range, e.Query.Filter) {
+		return
+	}
+
+	rows, cols, err := openExport(r.Context(), e)
+	if err != nil {
+		queryFailed(w, r.Context(), "export", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", e.ContentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+e.Filename()+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	dw := deadlineWriter{w, http.NewResponseController(w)}
+	n, err := writeExport(dw, e, rows, cols)
+	noteAudit(r, "export", exportDetail(e, n, err))
+	if err != nil {
+		if r.Context().Err() == nil {
+			slog.ErrorContext(r.Context(), "export", "file", e.Filename(), "err", err)
+		}
+		// Abort the response so the client sees a truncated download
+		// rather than a complete-looking file
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"modernc.org/sqlite"
+)
+
+// Filter narrows stats to a segment of traffic. Conditions on different
+// fields must all hold; the values of one condition are alternatives.
+type Filter struct {
+	conds []filterCond
+}
+
+type filterCond struct {
+	column  string // page_views column, or event_type
+	op      string // "eq", "prefix" or "regex"
+	values  []string
+	exclude bool
+}
+
+// filterParams maps query parameters to the column and match they filter
+// on. Only these fixed identifiers are ever written into SQL; values are
+// always bound as arguments.
+var filterParams = []struct {
+	param, column, op string
+}{
+	{"path", "path", "eq"},
+	{"path_prefix", "path", "prefix"},
+	{"path_regex", "path", "regex"},
+	{"referrer", "referrer", "eq"},
+	{"country", "country", "eq"},
+	{"region", "region", "eq"},
+	{"city", "city", "eq"},
+	{"device", "device", "eq"},
+	{"browser", "browser", "eq"},
+	{"os", "os", "eq"},
+	{"screen", "screen", "eq"},
+	{"event", "event_type", "eq"},
+}
+
+const maxFilterValues = 50
+
+// ParseFilter reads segment filters from query parameters. Each parameter
+// in filterParams takes a comma-separated list of values (regexes are not
+// split) and may be repeated; a value starting with "!" excludes instead:
+//
+//	country=KE,UG           from Kenya or Uganda
+//	referrer=!facebook.com  not from Facebook
+//	path_prefix=/lessons/   under /lessons/
+//	event=signup            visitors who signed up
+func ParseFilter(q url.Values) (Filter, error) {
+	var f Filter
+	for _, p := range filterParams {
+		var include, exclude []string
+		for _, raw := range q[p.param] {
+			parts := []string{raw}
+			if p.op != "regex" {
+				parts = strings.Split(raw, ",")
+			}
+			for _, v := range parts {
+				v = strings.TrimSpace(v)
+				neg := strings.HasPrefix(v, "!")
+				if neg {
+					v = v[1:]
+				}
+				if v == "" && p.op != "eq" {
+					continue
+				}
+				if p.op == "regex" {
+					if len(v) > 200 {
+						return Filter{}, fmt.Errorf("%s: pattern too long", p.param)
+					}
+					if _, err := regexp.Compile(v); err != nil {
+						return Filter{}, fmt.Errorf("%s: %v", p.param, err)
+					}
+				}
+				if neg {
+					exclude = append(exclude, v)
+				} else {
+					include = append(include, v)
+				}
+			}
+		}
+		if len(include)+len(exclude) > maxFilterValues {
+			return Filter{}, fmt.Errorf("%s: too many values", p.param)
+		}
+		if len(include) > 0 {
+			f.conds = append(f.conds, filterCond{p.column, p.op, include, false})
+		}
+		if len(exclude) > 0 {
+			f.conds = append(f.conds, filterCond{p.column, p.op, exclude, true})
+		}
+	}
+	return f, nil
+}
+
+// IsZero reports whether f matches everything.
+func (f Filter) IsZero() bool { return len(f.conds) == 0 }
+
+// where returns an SQL fragment (" AND ...", or "" for no filter) and its
+// arguments restricting rows of table, page_views or events, with ts in
+// [from, to). Conditions on the other table match through visitor_hash:
+// page views of visitors with a matching event, or events of visitors with
+// a matching page view. An excluding condition there keeps the visitors
+// with no matching row, including those with no rows at all.
+func (f Filter) where(table string, from, to int64) (string, []any) {
+	own, other := f.split(table)
+
+	var b strings.Builder
+	var args []any
+	for _, c := range own {
+		b.WriteString(" AND ")
+		args = c.appendSQL(&b, args)
+	}
+	if len(other) == 0 {
+		return b.String(), args
+	}
+	otherTable := "events"
+	if table == "events" {
+		otherTable = "page_views"
+	}
+	var include []filterCond
+	for _, c := range other {
+		if !c.exclude {
+			include = append(include, c)
+			continue
+		}
+		c.exclude = false
+		b.WriteString(" AND visitor_hash NOT IN (SELECT visitor_hash FROM " + otherTable + " WHERE ts >= ? AND ts < ? AND ")
+		args = c.appendSQL(&b, append(args, from, to))
+		b.WriteString(")")
+	}
+	if len(include) > 0 {
+		b.WriteString(" AND visitor_hash IN (SELECT visitor_hash FROM " + otherTable + " WHERE ts >= ? AND ts < ?")
+		args = append(args, from, to)
+		for _, c := range include {
+			b.WriteString(" AND ")
+			args = c.appendSQL(&b, args)
+		}
+		b.WriteString(")")
+	}
+	return b.String(), args
+}
+
+// split returns f's conditions on the columns of table and those on the
+// other table.
+func (f Filter) split(table string) (own, other []filterCond) {
+	for _, c := range f.conds {
+		if (c.column == "event_type") == (table == "events") {
+			own = append(own, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	return own, other
+}
+
+func (c filterCond) appendSQL(b *strings.Builder, args []any) []any {
+	if c.op == "eq" {
+		b.WriteString(c.column)
+		if c.exclude {
+			b.WriteString(" NOT")
+		}
+		b.WriteString(" IN (" + placeholders(len(c.values)) + ")")
+		for _, v := range c.values {
+			args = append(args, v)
+		}
+		return args
+	}
+
+	if c.exclude {
+		b.WriteString("NOT ")
+	}
+	b.WriteString("(")
+	for i, v := range c.values {
+		if i > 0 {
+			b.WriteString(" OR ")
+		}
+		switch c.op {
+		case "prefix":
+			b.WriteString("substr(" + c.column + ", 1, ?) = ?")
+			args = append(args, utf8.RuneCountInString(v), v)
+		case "regex":
+			b.WriteString(c.column + " REGEXP ?")
+			args = append(args, v)
+		}
+	}
+	b.WriteString(")")
+	return args
+}
+
+// match reports whether a row whose column holds v satisfies c, as the SQL
+// of appendSQL would.
+func (c filterCond) match(v string) bool {
+	hit := false
+	for _, want := range c.values {
+		switch c.op {
+		case "eq":
+			hit = v == want
+		case "prefix":
+			hit = strings.HasPrefix(v, want)
+		case "regex":
+			re, err := cachedRegexp(want)
+			hit = err == nil && re.MatchString(v)
+		}
+		if hit {
+			break
+		}
+	}
+	return hit != c.exclude
+}
+
+// placeholders returns n comma-separated "?" parameters.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// regexCache holds compiled REGEXP patterns; filters reuse a handful of
+// patterns across millions of rows.
+var regexCache sync.Map
+
+// SQLite parses "x REGEXP y" but leaves the function to the application.
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, _ := args[0].(string)
+		var s string
+		switch v := args[1].(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case nil:
+			return false, nil
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		re, err := cachedRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	})
+}
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	re, _ := regexCache.LoadOrStore(pattern, compiled)
+	return re.(*regexp.Regexp), nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stepSource returns SQL selecting the visitor_hash, ts and id of rows
+// matching s in [from, to), restricted to the segment f.
+func stepSource(s Step, f Filter, from, to int64) (string, []any) {
+	var b strings.Builder
+	args := []any{from, to}
+	if s.Type == "pageview" {
+		b.WriteString("SELECT visitor_hash, ts, id FROM page_views WHERE ts >= ? AND ts < ? AND ")
+		op := s.Match
+		if op == "exact" {
+			op = "eq"
+		}
+		args = filterCond{column: "path", op: op, values: []string{s.Path}}.appendSQL(&b, args)
+		fw, fargs := f.where("page_views", from, to)
+		b.WriteString(fw)
+		return b.String(), append(args, fargs...)
+	}
+
+	b.WriteString("SELECT visitor_hash, ts, id FROM events WHERE ts >= ? AND ts < ? AND event_type = ?")
+	args = append(args, s.Event)
+	if s.Metadata != "" {
+		b.WriteString(" AND metadata = ?")
+		args = append(args, s.Metadata)
+	}
+	for k, v := range s.Props {
+		b.WriteString(" AND CAST(json_extract(CASE WHEN json_valid(metadata) THEN metadata END, ?) AS TEXT) = ?")
+		args = append(args, "$."+k, v)
+	}
+	fw, fargs := f.where("events", from, to)
+	b.WriteString(fw)
+	return b.String(), append(args, fargs...)
+}
+
+// ListGoals returns all configured goals.
+func ListGoals() ([]Goal, error) {
+	rows, err := db.Query(`SELECT id, name, definition FROM goals ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []Goal{}
+	for rows.Next() {
+		var g Goal
+		var def string
+		if err := rows.Scan(&g.ID, &g.Name, &def); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(def), &g.Step); err != nil {
+			return nil, fmt.Errorf("goal %d: %w", g.ID, err)
+		}
+		goals = append(goals, g)
+	}
+	return goals, rows.Err()
+}
+
+// CreateGoal validates and stores g, setting its ID.
+func CreateGoal(g *Goal) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	def, _ := json.Marshal(g.Step)
+	res, err := db.Exec(`INSERT INTO goals (name, definition) VALUES (?, ?)`, g.Name, string(def))
+	if err != nil {
+		return err
+	}
+	g.ID, err = res.LastInsertId()
+	return err
+}
+
+// DeleteGoal removes a goal, reporting whether it existed.
+func DeleteGoal(id int64) (bool, error) {
+	res, err := db.Exec(`DELETE FROM goals WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ListFunnels returns all configured funnels.
+func ListFunnels() ([]Funnel, error) {
+	rows, err := db.Query(`SELECT id, name, definition FROM funnels ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	funnels := []Funnel{}
+	for rows.Next() {
+		var fn Funnel
+		var def string
+		if err := rows.Scan(&fn.ID, &fn.Name, &def); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(def), &fn); err != nil {
+			return nil, fmt.Errorf("funnel %d: %w", fn.ID, err)
+		}
+		funnels = append(funnels, fn)
+	}
+	return funnels, rows.Err()
+}
+
+// GetFunnel returns one funnel, or sql.ErrNoRows.
+func GetFunnel(id int64) (*Funnel, error) {
+	fn := &Funnel{ID: id}
+	var def string
+	if err := db.QueryRow(`SELECT name, definition FROM funnels WHERE id = ?`, id).Scan(&fn.Name, &def); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(def), fn); err != nil {
+		return nil, fmt.Errorf("funnel %d: %w", id, err)
+	}
+	return fn, nil
+}
+
+// CreateFunnel validates and stores fn, setting its ID.
+func CreateFunnel(fn *Funnel) error {
+	if err := fn.Validate(); err != nil {
+		return err
+	}
+	def, _ := json.Marshal(struct {
+		Steps  []Step `json:"steps"`
+		Window string `json:"window"`
+	}{fn.Steps, fn.Window})
+	res, err := db.Exec(`INSERT INTO funnels (name, definition) VALUES (?, ?)`, fn.Name, string(def))
+	if err != nil {
+		return err
+	}
+	fn.ID, err = res.LastInsertId()
+	return err
+}
+
+// DeleteFunnel removes a funnel, reporting whether it existed.
+func DeleteFunnel(id int64) (bool, error) {
+	res, err := db.Exec(`DELETE FROM funnels WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// percent returns n as a percentage of d to one decimal place.
+func percent(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(d)*1000) / 10
+}
+
+// QueryGoalsContext counts conversions of each goal over rng within the
+// segment f.
+func QueryGoalsContext(ctx context.Context, rng TimeRange, f Filter, goals []Goal) (*GoalsResult, error) {
+	from, to := rng.From.Unix(), rng.To.Unix()
+	result := &GoalsResult{
+		From:  rng.From.In(rng.Loc).Format(time.RFC3339),
+		To:    rng.To.In(rng.Loc).Format(time.RFC3339),
+		Goals: make([]GoalReport, len(goals)),
+	}
+	q := &statsQuery{ctx: ctx}
+
+	fw, fargs := f.where("page_views", from, to)
+	q.scalar(&result.Visitors, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ? AND ts < ?`+fw,
+		append([]any{from, to}, fargs...)...)
+
+	for i, g := range goals {
+		r := &result.Goals[i]
+		r.Goal = g
+		src, args := stepSource(g.Step, f, from, to)
+		var visitors, conversions int
+		q.rows(`SELECT COUNT(*), COUNT(DISTINCT visitor_hash) FROM (`+src+`)`, args, func(rows *sql.Rows) error {
+			return rows.Scan(&conversions, &visitors)
+		})
+		r.Conversions, r.Visitors = conversions, visitors
+		r.Rate = percent(visitors, result.Visitors)
+	}
+
+	if q.err != nil {
+		return nil, q.err
+	}
+	return result, nil
+}
+
+// QueryFunnelContext follows each visitor from their first match of step 1
+// in rng through the earliest later match of each following step, within
+// the funnel window.
+func QueryFunnelContext(ctx context.Context, rng TimeRange, f Filter, fn *Funnel) (*FunnelResult, error) {
+	window, err := fn.WindowDuration()
+	if err != nil {
+		return nil, err
+	}
+	from, to := rng.From.Unix(), rng.To.Unix()
+
+	// Each CTE holds, per visitor still in the funnel, the row that reached
+	// the step (t, id) and the time they entered the funnel (start). Rows
+	// are ordered by (ts, id) so that a step never matches the row that
+	// reached the one before it.
+	var ctes, counts []string
+	var args []any
+	for i, step := range fn.Steps {
+		src, srcArgs := stepSource(step, f, from, to)
+		name := "s" + strconv.Itoa(i+1)
+		if i == 0 {
+			ctes = append(ctes, name+` AS (SELECT v, t, id, t AS start FROM (
+				SELECT visitor_hash AS v, ts AS t, id, ROW_NUMBER() OVER (PARTITION BY visitor_hash ORDER BY ts, id) AS n
+				FROM (`+src+`)) WHERE n = 1)`)
+			args = append(args, srcArgs...)
+		} else {
+			bound := `p.start + ?`
+			limit := int64(window.Seconds())
+			if window == 0 {
+				bound = `p.t + ?`
+				limit = int64(sessionGap.Seconds())
+			}
+			// ids only order rows of the same table
+			after := `x.ts >= p.t`
+			if (step.Type == "pageview") == (fn.Steps[i-1].Type == "pageview") {
+				after = `(x.ts > p.t OR x.ts = p.t AND x.id > p.id)`
+			}
+			ctes = append(ctes, name+` AS (SELECT v, t, id, start FROM (
+				SELECT p.v, x.ts AS t, x.id, p.start, ROW_NUMBER() OVER (PARTITION BY p.v ORDER BY x.ts, x.id) AS n
+				FROM s`+strconv.Itoa(i)+` p
+				JOIN (`+src+`) x ON x.visitor_hash = p.v AND `+after+` AND x.ts <= `+bound+`) WHERE n = 1)`)
+			args = append(append(args, srcArgs...), limit)
+		}
+		counts = append(counts, `(SELECT COUNT(*) FROM `+name+`)`)
+	}
+
+	reached := make([]int, len(fn.Steps))
+	dest := make([]any, len(reached))
+	for i := range reached {
+		dest[i] = &reached[i]
+	}
+	q := &statsQuery{ctx: ctx}
+	q.rows(`WITH `+strings.Join(ctes, ",\n")+` SELECT `+strings.Join(counts, ", "), args, func(rows *sql.Rows) error {
+		return rows.Scan(dest...)
+	})
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	result := &FunnelResult{
+		Funnel:    *fn,
+		From:      rng.From.In(rng.Loc).Format(time.RFC3339),
+		To:        rng.To.In(rng.Loc).Format(time.RFC3339),
+		Entered:   reached[0],
+		Converted: reached[len(reached)-1],
+		Rate:      percent(reached[len(reached)-1], reached[0]),
+		Report:    make([]FunnelStepReport, len(fn.Steps)),
+	}
+	for i, step := range fn.Steps {
+		r := FunnelStepReport{Step: step, Visitors: reached[i], Rate: percent(reached[i], reached[0])}
+		if i > 0 {
+			r.DropOff = reached[i-1] - reached[i]
+			r.DropOffRate = percent(r.DropOff, reached[i-1])
+		}
+		result.Report[i] = r
+	}
+	return result, nil
+}
+
+// pathID parses the {id} path parameter.
+func pathID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// handleListGoals returns the configured goals.
+func handleListGoals(w http.ResponseWriter, r *http.Request) {
+	goals, err := ListGoals()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list goals", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goals)
+}
+
+// handleCreateGoal stores a goal from a JSON body.
+func handleCreateGoal(w http.ResponseWriter, r *http.Request) {
+	var g Goal
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&g); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	g.ID = 0
+	if err := g.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CreateGoal(&g); err != nil {
+		definitionFailed(w, r, "goal", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// handleDeleteGoal removes a goal.
+func handleDeleteGoal(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := DeleteGoal(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "delete goal", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListFunnels returns the configured funnels.
+func handleListFunnels(w http.ResponseWriter, r *http.Request) {
+	funnels, err := ListFunnels()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list funnels", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(funnels)
+}
+
+// handleCreateFunnel stores a funnel from a JSON body.
+func handleCreateFunnel(w http.ResponseWriter, r *http.Request) {
+	var fn Funnel
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&fn); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	fn.ID = 0
+	if err := fn.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CreateFunnel(&fn); err != nil {
+		definitionFailed(w, r, "funnel", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fn)
+}
+
+// handleDeleteFunnel removes a funnel.
+func handleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := DeleteFunnel(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "delete funnel", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// definitionFailed reports a goal or funnel that could not be stored.
+func definitionFailed(w http.ResponseWriter, r *http.Request, kind string, err error) {
+	if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		http.Error(w, kind+" name already exists", http.StatusConflict)
+		return
+	}
+	slog.ErrorContext(r.Context(), "create "+kind, "err", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// handleGoalsReport reports every goal over the requested range and
+// segment.
+func handleGoalsReport(w http.ResponseWriter, r *http.Request) {
+	rng, err := ParseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	goals, err := ListGoals()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list goals", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "goals", "page_views", rng, filter) {
+		return
+	}
+	result, err := QueryGoalsContext(ctx, rng, filter, goals)
+	if err != nil {
+		queryFailed(w, ctx, "goals", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleFunnelReport reports one funnel over the requested range and
+// segment.
+func handleFunnelReport(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rng, err := ParseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fn, err := GetFunnel(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "get funnel", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "funnel", "page_views", rng, filter) {
+		return
+	}
+	result, err := QueryFunnelContext(ctx, rng, filter, fn)
+	if err != nil {
+		queryFailed(w, ctx, "funnel", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -1,30 +1,84 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-//go:embed dashboard.html
+//go:embed dashboard.html login.html
 var dashboardFS embed.FS
 
-// authToken is set from the environment or config.
+// authToken is the legacy shared token, accepted as an admin bearer token;
+// scripts should use API keys instead. It is set from the environment or
+// config.
 var authToken string
 
+// routeMux is what SetupRoutes registers on: an *http.ServeMux, or in
+// tests a recorder of the patterns.
+type routeMux interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
 // SetupRoutes configures all HTTP routes.
-func SetupRoutes(mux *http.ServeMux) {
+func SetupRoutes(mux routeMux) {
 	mux.HandleFunc("POST /api/analytics/event", handleBeacon)
 	mux.HandleFunc("/api/analytics/event", handleBeaconCORS) // OPTIONS preflight
-	mux.HandleFunc("GET /api/analytics/stats", requireAuth(handleStats))
-	mux.HandleFunc("GET /api/analytics/realtime", requireAuth(handleRealtime))
-	mux.HandleFunc("GET /api/analytics/recent", requireAuth(handleRecent))
-	mux.HandleFunc("GET /console", requireAuth(handleDashboard))
-	mux.HandleFunc("GET /console/", requireAuth(handleDashboard))
+	mux.HandleFunc("GET /api/analytics/stats", requireAuth(roleViewer, scopeReadStats, handleStats))
+	mux.HandleFunc("GET /api/analytics/realtime", requireAuth(roleViewer, scopeReadStats, handleRealtime))
+	mux.HandleFunc("GET /api/analytics/recent", requireAuth(roleViewer, scopeReadRaw, handleRecent))
+	mux.HandleFunc("GET /api/analytics/live", requireAuth(roleViewer, scopeReadRaw, handleLive))
+	mux.HandleFunc("GET /api/analytics/breakdown", requireAuth(roleViewer, scopeReadStats, handleBreakdown))
+	mux.HandleFunc("GET /api/analytics/timeseries", requireAuth(roleViewer, scopeReadStats, handleTimeseries))
+	mux.HandleFunc("GET /api/analytics/paths", requireAuth(roleViewer, scopeReadStats, handlePaths))
+	mux.HandleFunc("GET /api/analytics/export", requireAuth(roleAnalyst, scopeReadRaw, handleExport))
+	mux.HandleFunc("GET /api/analytics/goals", requireAuth(roleViewer, scopeReadStats, handleGoalsReport))
+	mux.HandleFunc("GET /api/analytics/funnels/{id}", requireAuth(roleViewer, scopeReadStats, handleFunnelReport))
+	mux.HandleFunc("GET /api/admin/goals", requireAuth(roleViewer, scopeReadStats, handleListGoals))
+	mux.HandleFunc("POST /api/admin/goals", requireAuth(roleAnalyst, scopeAdmin, handleCreateGoal))
+	mux.HandleFunc("DELETE /api/admin/goals/{id}", requireAuth(roleAnalyst, scopeAdmin, handleDeleteGoal))
+	mux.HandleFunc("GET /api/admin/funnels", requireAuth(roleViewer, scopeReadStats, handleListFunnels))
+	mux.HandleFunc("POST /api/admin/funnels", requireAuth(roleAnalyst, scopeAdmin, handleCreateFunnel))
+	mux.HandleFunc("DELETE /api/admin/funnels/{id}", requireAuth(roleAnalyst, scopeAdmin, handleDeleteFunnel))
+	mux.HandleFunc("POST /api/admin/backup", requireAuth(roleAdmin, scopeAdmin, handleBackup))
+	mux.HandleFunc("POST /api/admin/purge", requireAuth(roleAdmin, scopeAdmin, handlePurge))
+	mux.HandleFunc("GET /api/admin/keys", requireAuth(roleAdmin, scopeAdmin, handleListAPIKeys))
+	mux.HandleFunc("POST /api/admin/keys", requireAuth(roleAdmin, scopeAdmin, handleCreateAPIKey))
+	mux.HandleFunc("DELETE /api/admin/keys/{id}", requireAuth(roleAdmin, scopeAdmin, handleRevokeAPIKey))
+	mux.HandleFunc("GET /api/admin/shares", requireAuth(roleAdmin, scopeAdmin, handleListShareLinks))
+	mux.HandleFunc("POST /api/admin/shares", requireAuth(roleAdmin, scopeAdmin, handleCreateShareLink))
+	mux.HandleFunc("DELETE /api/admin/shares/{id}", requireAuth(roleAdmin, scopeAdmin, handleRevokeShareLink))
+	mux.HandleFunc("GET /api/admin/audit", requireAuth(roleAdmin, scopeAdmin, handleAuditLog))
+	mux.HandleFunc("GET /api/admin/audit/verify", requireAuth(roleAdmin, scopeAdmin, handleVerifyAudit))
+	mux.HandleFunc("GET /api/me", requireAuth(roleViewer, "", handleMe))
+	mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /login", handleLoginPage)
+	mux.HandleFunc("POST /login", handleLogin)
+	mux.HandleFunc("POST /logout", handleLogout)
+	if oidcCfg.enabled() {
+		mux.HandleFunc("GET /auth/oidc/login", handleOIDCLogin)
+		mux.HandleFunc("GET /auth/oidc/callback", handleOIDCCallback)
+	}
+	mux.HandleFunc("GET /share/{token}", handleSharePage)
+	mux.HandleFunc("GET /api/share/{token}/stats", handleShareStats)
+	if publicCfg.Enabled {
+		mux.HandleFunc("GET /api/public/stats", handlePublicStats)
+	}
+	mux.HandleFunc("GET /console", requireAuth(roleViewer, scopeReadStats, handleDashboard))
+	mux.HandleFunc("GET /console/", requireAuth(roleViewer, scopeReadStats, handleDashboard))
+	if metricsAddr == "" && metricsToken != "" {
+		mux.HandleFunc("GET /metrics", requireMetricsToken(handleMetrics))
+	}
 }
 
 // handleBeaconCORS handles OPTIONS preflight for the beacon endpoint.
@@ -42,6 +96,7 @@ func handleBeacon(w http.ResponseWriter, r *http.Request) {
 	// Limit body size to 4KB
 	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
 	if err != nil {
+		metrics.beaconsRejected.Inc(labels("reason", "read_error", "type", "unknown"))
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
@@ -49,6 +104,7 @@ func handleBeacon(w http.ResponseWriter, r *http.Request) {
 
 	beacon, err := ParseBeacon(body)
 	if err != nil {
+		metrics.beaconsRejected.Inc(labels("reason", "invalid_json", "type", "unknown"))
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
@@ -63,6 +119,9 @@ func handleBeacon(w http.ResponseWriter, r *http.Request) {
 	// Parse User-Agent — raw UA is never stored
 	browser, osName, device := ParseUserAgent(r.Header.Get("User-Agent"))
 
+	kind := beaconKind(beacon.Type)
+	metrics.queueDepth.Add(1)
+	insertStart := time.Now()
 	if beacon.Type == "pageview" {
 		err = InsertPageView(
 			beacon.Path,
@@ -80,13 +139,31 @@ func handleBeacon(w http.ResponseWriter, r *http.Request) {
 	} else {
 		err = InsertEvent(beacon.Type, visitorHash, beacon.Metadata)
 	}
+	metrics.insertSeconds.Observe(time.Since(insertStart).Seconds())
+	metrics.queueDepth.Add(-1)
 
 	if err != nil {
-		log.Printf("beacon insert error: %v", err)
+		metrics.beaconsRejected.Inc(labels("reason", "insert_error", "type", kind))
+		slog.ErrorContext(r.Context(), "beacon insert", "type", kind, "err", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
+	now := time.Now().UTC()
+	ev := LiveEvent{Type: beacon.Type, Timestamp: now.Format("2006-01-02T15:04:05Z"), VisitorHash: visitorHash}
+	if beacon.Type == "pageview" {
+		ev.Path, ev.Referrer, ev.Screen = beacon.Path, beacon.Referrer, beacon.Screen
+		// Only the streams see the place, and the window keeps none
+		if live.clientCount() > 0 {
+			ev.Country, ev.Region, ev.City = places.generalize(loc.Country, loc.Region, loc.City)
+		}
+		ev.Device, ev.Browser, ev.OS = device, browser, osName
+	} else {
+		ev.Metadata = beacon.Metadata
+	}
+	live.Publish(ev, now)
+	metrics.beaconsAccepted.Inc(labels("type", kind))
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"ok":true}`))
@@ -94,13 +171,44 @@ func handleBeacon(w http.ResponseWriter, r *http.Request) {
 
 // handleStats returns dashboard statistics.
 func handleStats(w http.ResponseWriter, r *http.Request) {
-	periodStr := r.URL.Query().Get("period")
-	days := parsePeriod(periodStr)
+	rng, err := ParseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var comp TimeRange
+	compare := r.URL.Query().Get("compare")
+	if compare != "" {
+		if comp, err = ComparisonRange(rng, compare); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
 
-	stats, err := QueryStats(days)
+	if !segmentAllowed(w, ctx, "stats", "page_views", rng, filter) {
+		return
+	}
+	if compare != "" && !segmentAllowed(w, ctx, "stats", "page_views", comp, filter) {
+		return
+	}
+	stats, err := QueryStatsContext(ctx, rng, filter)
+	if err == nil && compare != "" {
+		err = CompareStatsContext(ctx, stats, rng, comp, compare, filter)
+	}
+	// After comparing, so the folded rows carry no change of their own
+	if err == nil {
+		err = suppressStats(ctx, stats, rng, filter, setting(&minVisitors))
+	}
 	if err != nil {
-		log.Printf("stats query error: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		queryFailed(w, ctx, "stats", err)
 		return
 	}
 
@@ -110,10 +218,21 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 
 // handleRealtime returns last 30-minute activity.
 func handleRealtime(w http.ResponseWriter, r *http.Request) {
-	data, err := QueryRealtime()
+	filter, err := ParseFilter(r.URL.Query())
 	if err != nil {
-		log.Printf("realtime query error: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Realtime)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "realtime", "page_views", realtimeWindow(), filter) {
+		return
+	}
+	data, err := QueryRealtimeContext(ctx, filter)
+	if err != nil {
+		queryFailed(w, ctx, "realtime", err)
 		return
 	}
 
@@ -121,7 +240,8 @@ func handleRealtime(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// handleRecent returns the most recent individual page views.
+// handleRecent returns the most recent individual page views. IP addresses
+// are masked to their network for all but admins, as in exports.
 func handleRecent(w http.ResponseWriter, r *http.Request) {
 	limitStr := r.URL.Query().Get("limit")
 	limit := 50
@@ -129,17 +249,53 @@ func handleRecent(w http.ResponseWriter, r *http.Request) {
 		limit = n
 	}
 
-	visits, err := QueryRecentVisitors(limit)
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Recent)
+	defer cancel()
+
+	visits, err := QueryRecentVisitorsContext(ctx, limit)
 	if err != nil {
-		log.Printf("recent query error: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		queryFailed(w, ctx, "recent", err)
 		return
 	}
+	if !permitted(r, roleAdmin, scopeAdmin) {
+		for i := range visits {
+			visits[i].IPAddress = maskIP(visits[i].IPAddress)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(visits)
 }
 
+// queryTimeouts bound how long each dashboard endpoint may spend in the
+// database. They sit below the server's 10s WriteTimeout so a slow query
+// is answered with 503 rather than a dropped connection.
+var queryTimeouts = struct {
+	Stats    time.Duration
+	Realtime time.Duration
+	Recent   time.Duration
+}{
+	Stats:    8 * time.Second,
+	Realtime: 3 * time.Second,
+	Recent:   3 * time.Second,
+}
+
+// queryFailed reports a failed dashboard query: 503 when the endpoint's
+// timeout expired, nothing when the client went away, 500 otherwise.
+func queryFailed(w http.ResponseWriter, ctx context.Context, name string, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		slog.WarnContext(ctx, "query timed out", "query", name)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "query timed out", http.StatusServiceUnavailable)
+	case errors.Is(ctx.Err(), context.Canceled):
+		// Client disconnected; nobody is listening for a response
+	default:
+		slog.ErrorContext(ctx, "query failed", "query", name, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
 // handleDashboard serves the embedded dashboard HTML.
 func handleDashboard(w http.ResponseWriter, r *http.Request) {
 	data, err := dashboardFS.ReadFile("dashboard.html")
@@ -152,29 +308,6 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-// requireAuth wraps a handler with token authentication.
-func requireAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if authToken == "" {
-			// No token configured — allow access (dev mode)
-			next(w, r)
-			return
-		}
-
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			token = extractBearerToken(r.Header.Get("Authorization"))
-		}
-
-		if token != authToken {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		next(w, r)
-	}
-}
-
 func extractBearerToken(auth string) string {
 	if strings.HasPrefix(auth, "Bearer ") {
 		return strings.TrimPrefix(auth, "Bearer ")
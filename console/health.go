@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// handleHealthz serves /healthz, which answers whenever the process does.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz serves /readyz: 200 when the console can take beacons and
+// answer queries, 503 with the failing checks otherwise.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	res := Readiness(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// Readiness checks that the database takes writes and has the current
+// schema, that GeoIP data is loaded if a file is configured, and that the
+// aggregation loop is running.
+func Readiness(ctx context.Context) *api.Readiness {
+	res := &api.Readiness{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		res.Checks[name] = "ok"
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+		}
+	}
+
+	version, err := checkDatabase(ctx)
+	check("database", err)
+	switch {
+	case err != nil:
+		err = errors.New("not checked")
+	case version != schemaVersion:
+		err = fmt.Errorf("schema version %d, want %d", version, schemaVersion)
+	}
+	check("migrations", err)
+
+	if setting(&geoIPPath) == "" {
+		res.Checks["geoip"] = "disabled"
+	} else {
+		geoIP.mu.RLock()
+		loaded := geoIP.loaded && len(geoIP.records) > 0
+		geoIP.mu.RUnlock()
+		if loaded {
+			check("geoip", nil)
+		} else {
+			check("geoip", errors.New("not loaded"))
+		}
+	}
+
+	// The loop beats at least every aggregateInterval, unless a job runs
+	// long; three missed beats mean it is stuck
+	beat := aggregationBeat.Load()
+	age := time.Since(time.Unix(0, beat))
+	switch {
+	case beat == 0:
+		check("aggregation", errors.New("not started"))
+	case age > 3*aggregateInterval:
+		check("aggregation", fmt.Errorf("no heartbeat for %s", age.Round(time.Second)))
+	default:
+		check("aggregation", nil)
+	}
+	return res
+}
+
+// checkDatabase returns the schema version, rewriting it unchanged in a
+// transaction that is rolled back, which fails if the database cannot be
+// written.
+func checkDatabase(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version=%d", version)); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Build returns the module version and VCS stamp of the running binary.
+func Build() api.BuildInfo {
+	b := api.BuildInfo{Version: "(unknown)"}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.Version, b.GoVersion = info.Main.Version, info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.Time = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// handleVersion serves /version.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Build())
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otherBucket names the row that small counts fold into.
+const otherBucket = "Other"
+
+// minVisitors is the k of the k-anonymity applied to dashboard queries:
+// rows seen by fewer visitors fold into "Other", and filters matching
+// fewer visitors are refused. 0 or 1 turns it off.
+var minVisitors = 5
+
+// smallSegmentError refuses a filter that would isolate fewer than k
+// visitors.
+type smallSegmentError struct{ k int }
+
+func (e smallSegmentError) Error() string {
+	return fmt.Sprintf("filter matches fewer than %d visitors", e.k)
+}
+
+// checkSegment refuses a non-empty filter matching fewer than minVisitors
+// visitors in table over rng. A filter matching nobody is refused too, so
+// that the refusal does not tell "none" from "a few".
+func checkSegment(ctx context.Context, table string, rng TimeRange, f Filter) error {
+	k := setting(&minVisitors)
+	if k <= 1 || f.IsZero() {
+		return nil
+	}
+	from, to := rng.From.Unix(), rng.To.Unix()
+	fw, fargs := f.where(table, from, to)
+	var n int
+	q := &statsQuery{ctx: ctx}
+	q.scalar(&n, `SELECT COUNT(DISTINCT visitor_hash) FROM `+table+` WHERE ts >= ? AND ts < ?`+fw,
+		append([]any{from, to}, fargs...)...)
+	if q.err != nil {
+		return q.err
+	}
+	if n < k {
+		return smallSegmentError{k}
+	}
+	return nil
+}
+
+// segmentAllowed runs checkSegment for a dashboard endpoint, answering 400
+// for a refused filter and reporting query failures as queryFailed does.
+func segmentAllowed(w http.ResponseWriter, ctx context.Context, name, table string, rng TimeRange, f Filter) bool {
+	err := checkSegment(ctx, table, rng, f)
+	var small smallSegmentError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &small):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		queryFailed(w, ctx, name, err)
+	}
+	return false
+}
+
+// suppressStats applies k-anonymity to stats computed over rng and f. List
+// rows seen by fewer than k visitors fold into an "Other" row, time series
+// buckets with fewer than k visitors read zero, and a result covering
+// fewer than k visitors in all is emptied. The same goes for the
+// comparison, if any: its buckets and totals read zero below k.
+func suppressStats(ctx context.Context, s *StatsResult, rng TimeRange, f Filter, k int) error {
+	if k <= 1 {
+		return nil
+	}
+	if s.UniqueVisitors < k {
+		*s = StatsResult{From: s.From, To: s.To, Timezone: s.Timezone, Interval: s.Interval}
+		return nil
+	}
+	for i, tp := range s.TimeSeries {
+		if tp.Uniq < k {
+			s.TimeSeries[i].Views, s.TimeSeries[i].Uniq = 0, 0
+		}
+		if tp.PrevUniq != nil && *tp.PrevUniq < k {
+			var views, uniq int
+			s.TimeSeries[i].PrevViews, s.TimeSeries[i].PrevUniq = &views, &uniq
+		}
+	}
+	if c := s.Comparison; c != nil && c.UniqueVisitors.Previous < k {
+		c.TotalViews, c.UniqueVisitors = newChange(s.TotalViews, 0), newChange(s.UniqueVisitors, 0)
+	}
+	return foldStats(ctx, s, rng, f, k)
+}
+
+// foldStats folds the list rows of s seen by fewer than k visitors, and
+// the event types triggered by fewer than k, into "Other" rows.
+func foldStats(ctx context.Context, s *StatsResult, rng TimeRange, f Filter, k int) error {
+	if k <= 1 {
+		return nil
+	}
+	lists := []struct {
+		rows   *[]PathCount
+		column string
+	}{
+		{&s.TopPages, "path"},
+		{&s.TopReferrers, "referrer"},
+		{&s.Browsers, "browser"},
+		{&s.Devices, "device"},
+		{&s.OSStats, "os"},
+		{&s.Countries, "country"},
+		{&s.Screens, "screen"},
+	}
+	for _, l := range lists {
+		visitors, err := visitorCounts(ctx, "page_views", l.column, *l.rows, rng, f)
+		if err != nil {
+			return err
+		}
+		*l.rows = foldSmall(*l.rows, visitors, k)
+	}
+
+	events := make([]PathCount, len(s.Events))
+	for i, e := range s.Events {
+		events[i] = PathCount{Name: e.Type, Count: e.Count}
+	}
+	visitors, err := visitorCounts(ctx, "events", "event_type", events, rng, f)
+	if err != nil {
+		return err
+	}
+	s.Events = nil
+	for _, e := range foldSmall(events, visitors, k) {
+		s.Events = append(s.Events, EventSummary{Type: e.Name, Count: e.Count})
+	}
+	return nil
+}
+
+// visitorCounts returns the distinct visitors behind each row, counted in
+// table grouped by column.
+func visitorCounts(ctx context.Context, table, column string, rows []PathCount, rng TimeRange, f Filter) (map[string]int, error) {
+	counts := make(map[string]int, len(rows))
+	if len(rows) == 0 {
+		return counts, nil
+	}
+	from, to := rng.From.Unix(), rng.To.Unix()
+	fw, fargs := f.where(table, from, to)
+	args := append([]any{from, to}, fargs...)
+	for _, r := range rows {
+		args = append(args, r.Name)
+	}
+	q := &statsQuery{ctx: ctx}
+	q.rows(`SELECT `+column+`, COUNT(DISTINCT visitor_hash) FROM `+table+`
+		WHERE ts >= ? AND ts < ?`+fw+` AND `+column+` IN (`+placeholders(len(rows))+`)
+		GROUP BY `+column, args, func(r *sql.Rows) error {
+		var name string
+		var n int
+		if err := r.Scan(&name, &n); err != nil {
+			return err
+		}
+		counts[name] = n
+		return nil
+	})
+	return counts, q.err
+}
+
+// foldSmall replaces rows with fewer than k visitors by one "Other" row,
+// keeping the order of the rest. A row already named "Other" (such as an
+// unrecognised browser) absorbs them instead of being repeated.
+func foldSmall(rows []PathCount, visitors map[string]int, k int) []PathCount {
+	var kept []PathCount
+	var other int
+	for _, r := range rows {
+		if r.Name != otherBucket && visitors[r.Name] < k {
+			other += r.Count
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if other == 0 {
+		return kept
+	}
+	for i := range kept {
+		if kept[i].Name == otherBucket {
+			kept[i].Count += other
+			return kept
+		}
+	}
+	return append(kept, PathCount{Name: otherBucket, Count: other})
+}
+
+// foldGroups wraps a grouped query selecting keys k0, k1, ..., value and
+// visitors so that groups seen by fewer than k visitors fold into one row
+// with every key "Other", whose value is the sum of theirs.
+func foldGroups(inner string, args []any, nkeys, k int) (string, []any) {
+	selects := make([]string, 0, nkeys+1)
+	groups := make([]string, nkeys)
+	var foldArgs []any
+	for i := range nkeys {
+		key := "k" + strconv.Itoa(i)
+		selects = append(selects, `CASE WHEN visitors >= ? THEN `+key+` ELSE ? END AS `+key)
+		groups[i] = strconv.Itoa(i + 1)
+		foldArgs = append(foldArgs, k, otherBucket)
+	}
+	selects = append(selects, "SUM(value) AS value")
+	query := `SELECT ` + strings.Join(selects, ", ") + ` FROM (` + inner + `) GROUP BY ` + strings.Join(groups, ", ")
+	return query, append(foldArgs, args...)
+}
+
+const (
+	placeCensusWindow = 30 * 24 * time.Hour
+	placeCensusTTL    = 10 * time.Minute
+)
+
+// placeCensus records the countries, regions and cities seen by at least
+// minVisitors visitors lately, so that single visits can be shown without
+// naming a rare place.
+type placeCensus struct {
+	mu      sync.Mutex
+	known   map[string]bool
+	updated time.Time
+	loading bool
+}
+
+var places placeCensus
+
+func placeKey(parts ...string) string { return strings.Join(parts, "\x00") }
+
+// generalize blanks the parts of a location seen by fewer than
+// minVisitors visitors: the city, then the region, then the country. It
+// never waits for the database.
+func (c *placeCensus) generalize(country, region, city string) (string, string, string) {
+	if setting(&minVisitors) <= 1 {
+		return country, region, city
+	}
+	known := c.current()
+	if !known[placeKey(country, region, city)] {
+		city = ""
+	}
+	if !known[placeKey(country, region)] {
+		region, city = "", ""
+	}
+	if !known[placeKey(country)] {
+		country, region, city = "", "", ""
+	}
+	return country, region, city
+}
+
+// current returns the census, starting a refresh once it is older than
+// placeCensusTTL. Until a load succeeds every place counts as rare.
+func (c *placeCensus) current() map[string]bool {
+	c.mu.Lock()
+	known, stale := c.known, time.Since(c.updated) > placeCensusTTL
+	c.mu.Unlock()
+	if stale {
+		c.refresh()
+	}
+	return known
+}
+
+// refresh loads the census in the background unless a load is running.
+func (c *placeCensus) refresh() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loading {
+		return
+	}
+	c.loading = true
+	go func() {
+		known, err := loadPlaces(context.Background())
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.loading = false
+		if err != nil {
+			slog.Error("place census", "err", err)
+			return
+		}
+		c.known, c.updated = known, time.Now()
+	}()
+}
+
+// loadPlaces returns the places, keyed by placeKey, seen by at least
+// minVisitors visitors within placeCensusWindow.
+func loadPlaces(ctx context.Context) (map[string]bool, error) {
+	since := time.Now().Add(-placeCensusWindow).Unix()
+	known := make(map[string]bool)
+	q := &statsQuery{ctx: ctx}
+	for _, cols := range []string{"country", "country, region", "country, region, city"} {
+		n := strings.Count(cols, ",") + 1
+		q.rows(`SELECT `+cols+` FROM page_views WHERE ts >= ?
+			GROUP BY `+cols+` HAVING COUNT(DISTINCT visitor_hash) >= ?`, []any{since, setting(&minVisitors)}, func(rows *sql.Rows) error {
+			parts := make([]string, n)
+			dest := make([]any, n)
+			for i := range parts {
+				dest[i] = &parts[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			known[placeKey(parts...)] = true
+			return nil
+		})
+	}
+	return known, q.err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withMinVisitors sets minVisitors for one test.
+func withMinVisitors(t *testing.T, k int) {
+	t.Helper()
+	saved := minVisitors
+	t.Cleanup(func() { minVisitors = saved })
+	minVisitors = k
+}
+
+// todayRange covers the whole UTC day, so that rows written now are in it.
+func todayRange() TimeRange {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return TimeRange{From: from, To: from.AddDate(0, 0, 1), Loc: time.UTC}
+}
+
+func TestFoldSmall(t *testing.T) {
+	visitors := map[string]int{"/a": 9, "/b": 2, "/c": 1, otherBucket: 1, "/d": 5}
+	tests := []struct {
+		name string
+		rows []PathCount
+		want []PathCount
+	}{
+		{
+			"into a new Other",
+			[]PathCount{{Name: "/a", Count: 20}, {Name: "/b", Count: 4}, {Name: "/d", Count: 3}, {Name: "/c", Count: 1}},
+			[]PathCount{{Name: "/a", Count: 20}, {Name: "/d", Count: 3}, {Name: otherBucket, Count: 5}},
+		},
+		{
+			"into an existing Other",
+			[]PathCount{{Name: "/a", Count: 20}, {Name: otherBucket, Count: 6}, {Name: "/b", Count: 4}, {Name: "/c", Count: 1}},
+			[]PathCount{{Name: "/a", Count: 20}, {Name: otherBucket, Count: 11}},
+		},
+		{
+			"nothing small",
+			[]PathCount{{Name: "/a", Count: 20}, {Name: "/d", Count: 3}},
+			[]PathCount{{Name: "/a", Count: 20}, {Name: "/d", Count: 3}},
+		},
+		{
+			"all small",
+			[]PathCount{{Name: "/b", Count: 4}, {Name: "/unknown", Count: 2}},
+			[]PathCount{{Name: otherBucket, Count: 6}},
+		},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := foldSmall(tt.rows, visitors, 5); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFoldGroups(t *testing.T) {
+	openTestDB(t)
+	inner := `SELECT column1 AS k0, column2 AS k1, column3 AS value, column4 AS visitors
+		FROM (VALUES ('Chrome', 'Linux', 40, 12), ('Chrome', 'BSD', 3, 2), ('Lynx', 'Linux', 5, 1), ('Firefox', 'Linux', 9, ?))`
+	query, args := foldGroups(inner, []any{5}, 2, 5)
+	rows, err := db.Query(query+` ORDER BY value DESC`, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var k0, k1 string
+		var value int
+		if err := rows.Scan(&k0, &k1, &value); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s/%s=%d", k0, k1, value))
+	}
+	want := []string{"Chrome/Linux=40", "Firefox/Linux=9", "Other/Other=8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("folded groups %v, want %v", got, want)
+	}
+}
+
+// TestCheckSegment checks that filters isolating fewer than k visitors,
+// or none at all, are refused.
+func TestCheckSegment(t *testing.T) {
+	openTestDB(t)
+	withMinVisitors(t, 5)
+	for i := range 5 {
+		InsertPageView("/popular", "", fmt.Sprintf("p%d", i), "", "", "", "", "Desktop", "Firefox", "Linux", "")
+	}
+	InsertPageView("/rare", "", "r0", "", "", "", "", "Desktop", "Firefox", "Linux", "")
+	InsertPageView("/rare", "", "r1", "", "", "", "", "Mobile", "Safari", "iOS", "")
+
+	tests := []struct {
+		query   string
+		refused bool
+	}{
+		{"", false},
+		{"path=/popular", false},
+		{"path=/rare", true},
+		{"path=/nowhere", true},
+		{"path=!/popular", true},
+		{"path=!/rare", false},
+		{"path=/popular,/rare", false},
+		{"browser=Firefox", false},
+		{"browser=Safari", true},
+		{"path_prefix=/", false},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		f, err := ParseFilter(q)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		err = checkSegment(context.Background(), "page_views", todayRange(), f)
+		var small smallSegmentError
+		if refused := errors.As(err, &small); refused != tt.refused || err != nil && !refused {
+			t.Errorf("%q: %v, want refused %v", tt.query, err, tt.refused)
+		}
+	}
+
+	withMinVisitors(t, 1)
+	q, _ := url.ParseQuery("path=/rare")
+	f, _ := ParseFilter(q)
+	if err := checkSegment(context.Background(), "page_views", todayRange(), f); err != nil {
+		t.Errorf("with k-anonymity off: %v", err)
+	}
+}
+
+func TestSuppressStats(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	n := func(v int) *int { return &v }
+
+	s := &StatsResult{
+		TotalViews: 40, UniqueVisitors: 12,
+		TimeSeries: []TimePoint{
+			{Date: "2026-01-01", Views: 30, Uniq: 9, PrevViews: n(8), PrevUniq: n(4)},
+			{Date: "2026-01-02", Views: 6, Uniq: 4, PrevViews: n(20), PrevUniq: n(6)},
+			{Date: "2026-01-03", Views: 4, Uniq: 5},
+		},
+		Comparison: &Comparison{UniqueVisitors: newChange(12, 3), TotalViews: newChange(40, 7)},
+	}
+	if err := suppressStats(ctx, s, todayRange(), Filter{}, 5); err != nil {
+		t.Fatal(err)
+	}
+	want := []TimePoint{
+		{Date: "2026-01-01", Views: 30, Uniq: 9, PrevViews: n(0), PrevUniq: n(0)},
+		{Date: "2026-01-02", Views: 0, Uniq: 0, PrevViews: n(20), PrevUniq: n(6)},
+		{Date: "2026-01-03", Views: 4, Uniq: 5},
+	}
+	if !reflect.DeepEqual(s.TimeSeries, want) {
+		t.Errorf("time series %+v, want %+v", s.TimeSeries, want)
+	}
+	if c := s.Comparison; c.UniqueVisitors.Previous != 0 || c.TotalViews.Previous != 0 {
+		t.Errorf("comparison below k kept: %+v", c)
+	}
+	if s.TotalViews != 40 || s.UniqueVisitors != 12 {
+		t.Errorf("totals changed: %d, %d", s.TotalViews, s.UniqueVisitors)
+	}
+
+	small := &StatsResult{From: "a", To: "b", Timezone: "UTC", Interval: "day", TotalViews: 9, UniqueVisitors: 4,
+		TopPages: []PathCount{{Name: "/", Count: 9}}, TimeSeries: []TimePoint{{Date: "2026-01-01", Views: 9, Uniq: 4}}}
+	if err := suppressStats(ctx, small, todayRange(), Filter{}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*small, StatsResult{From: "a", To: "b", Timezone: "UTC", Interval: "day"}) {
+		t.Errorf("stats of fewer than k visitors kept: %+v", small)
+	}
+}
+
+// TestSuppressStatsFolds folds the list rows of real stats, counting each
+// row's visitors rather than its views.
+func TestSuppressStatsFolds(t *testing.T) {
+	openTestDB(t)
+	for i := range 5 {
+		InsertPageView("/", "", fmt.Sprintf("v%d", i), "", "", "", "", "Desktop", "Firefox", "Linux", "")
+	}
+	// Many views by one visitor do not make a row safe to show
+	for range 10 {
+		InsertPageView("/mine", "", "v0", "", "", "", "", "Desktop", "Lynx", "Linux", "")
+	}
+	rng := todayRange()
+	s, err := QueryStatsContext(context.Background(), rng, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := suppressStats(context.Background(), s, rng, Filter{}, 5); err != nil {
+		t.Fatal(err)
+	}
+	pages := []PathCount{{Name: "/", Count: 5}, {Name: otherBucket, Count: 10}}
+	browsers := []PathCount{{Name: "Firefox", Count: 5}, {Name: otherBucket, Count: 10}}
+	systems := []PathCount{{Name: "Linux", Count: 15}}
+	if !reflect.DeepEqual(s.TopPages, pages) || !reflect.DeepEqual(s.Browsers, browsers) || !reflect.DeepEqual(s.OSStats, systems) {
+		t.Errorf("pages %v, browsers %v, os %v; want %v, %v, %v", s.TopPages, s.Browsers, s.OSStats, pages, browsers, systems)
+	}
+}
+
+// setCensus replaces the place census for one test.
+func setCensus(t *testing.T, known map[string]bool, loading bool) {
+	t.Helper()
+	places.mu.Lock()
+	saved, updated, wasLoading := places.known, places.updated, places.loading
+	places.known, places.updated, places.loading = known, time.Now(), loading
+	places.mu.Unlock()
+	t.Cleanup(func() {
+		places.mu.Lock()
+		places.known, places.updated, places.loading = saved, updated, wasLoading
+		places.mu.Unlock()
+	})
+}
+
+func TestGeneralize(t *testing.T) {
+	withMinVisitors(t, 5)
+	setCensus(t, map[string]bool{
+		placeKey("GB"):                     true,
+		placeKey("GB", "England"):          true,
+		placeKey("GB", "England", "Leeds"): true,
+		placeKey("GB", "Wales"):            true,
+		placeKey("FR"):                     true,
+	}, false)
+
+	tests := []struct{ in, want [3]string }{
+		{[3]string{"GB", "England", "Leeds"}, [3]string{"GB", "England", "Leeds"}},
+		{[3]string{"GB", "England", "Ripon"}, [3]string{"GB", "England", ""}},
+		{[3]string{"GB", "Wales", "Hay"}, [3]string{"GB", "Wales", ""}},
+		{[3]string{"GB", "Scotland", "Leeds"}, [3]string{"GB", "", ""}},
+		{[3]string{"FR", "Corse", "Bastia"}, [3]string{"FR", "", ""}},
+		{[3]string{"TV", "Funafuti", "Vaiaku"}, [3]string{"", "", ""}},
+		{[3]string{"", "", ""}, [3]string{"", "", ""}},
+	}
+	for _, tt := range tests {
+		country, region, city := places.generalize(tt.in[0], tt.in[1], tt.in[2])
+		if got := [3]string{country, region, city}; got != tt.want {
+			t.Errorf("generalize(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	withMinVisitors(t, 1)
+	if country, region, city := places.generalize("TV", "Funafuti", "Vaiaku"); city != "Vaiaku" || region != "Funafuti" || country != "TV" {
+		t.Errorf("with k-anonymity off: %s, %s, %s", country, region, city)
+	}
+}
+
+// TestGeneralizeBeforeCensus checks that every place is rare until the
+// census has loaded, rather than waiting for it.
+func TestGeneralizeBeforeCensus(t *testing.T) {
+	withMinVisitors(t, 5)
+	// Loading, so that no load starts without a database
+	setCensus(t, nil, true)
+	if country, region, city := places.generalize("GB", "England", "Leeds"); country != "" || region != "" || city != "" {
+		t.Errorf("before the census: %s, %s, %s; want nothing", country, region, city)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	activeWindow         = 30 * time.Minute
+	liveSnapshotInterval = 5 * time.Second
+	liveClientBuffer     = 64
+	liveWriteTimeout     = 10 * time.Second
+	maxLiveViews         = 200_000 // page views kept for snapshots
+)
+
+// liveMaxClients caps concurrent /api/analytics/live connections.
+var liveMaxClients = 50
+
+type liveMessage struct {
+	event string
+	data  []byte
+}
+
+// liveClient is one connected stream. Messages that do not fit in ch are
+// dropped and counted rather than blocking the beacon handler.
+type liveClient struct {
+	ch      chan liveMessage
+	dropped atomic.Int64
+}
+
+type liveView struct {
+	at      time.Time
+	visitor string
+	path    string
+}
+
+// liveHub fans accepted beacons out to connected streams and keeps the
+// last activeWindow of page views in memory for active-visitor snapshots.
+type liveHub struct {
+	mu      sync.Mutex
+	clients map[*liveClient]struct{}
+	views   []liveView // oldest first
+}
+
+var live = &liveHub{clients: make(map[*liveClient]struct{})}
+
+func (h *liveHub) subscribe() (*liveClient, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) >= setting(&liveMaxClients) {
+		return nil, false
+	}
+	c := &liveClient{ch: make(chan liveMessage, liveClientBuffer)}
+	h.clients[c] = struct{}{}
+	return c, true
+}
+
+func (h *liveHub) unsubscribe(c *liveClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+func (h *liveHub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Publish records ev in the sliding window and sends it to every client.
+func (h *liveHub) Publish(ev LiveEvent, at time.Time) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	event := "event"
+	if ev.Type == "pageview" {
+		event = "pageview"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ev.Type == "pageview" {
+		h.views = append(h.views, liveView{at, ev.VisitorHash, ev.Path})
+		h.prune(at)
+	}
+	h.broadcast(liveMessage{event, data})
+}
+
+// broadcast sends msg to every client without blocking. h.mu must be held.
+func (h *liveHub) broadcast(msg liveMessage) {
+	for c := range h.clients {
+		select {
+		case c.ch <- msg:
+		default:
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// prune drops views older than activeWindow, and the oldest views beyond
+// maxLiveViews. h.mu must be held.
+func (h *liveHub) prune(now time.Time) {
+	cutoff := now.Add(-activeWindow)
+	i := sort.Search(len(h.views), func(i int) bool { return !h.views[i].at.Before(cutoff) })
+	i = max(i, len(h.views)-maxLiveViews)
+	if i == 0 {
+		return
+	}
+	h.views = h.views[i:]
+	// Reclaim the dropped prefix once it dominates the backing array
+	if cap(h.views) > 2*len(h.views)+1024 {
+		h.views = append([]liveView(nil), h.views...)
+	}
+}
+
+// Snapshot returns the visitors and pages active in the last activeWindow,
+// in the same shape as /api/analytics/realtime, with pages seen by fewer
+// than minVisitors visitors folded into "Other" as there.
+func (h *liveHub) Snapshot(now time.Time) *RealtimeResult {
+	h.mu.Lock()
+	h.prune(now)
+	visitors := make(map[string]struct{})
+	pages := make(map[string]int)
+	pageVisitors := make(map[string]map[string]struct{})
+	for _, v := range h.views {
+		visitors[v.visitor] = struct{}{}
+		pages[v.path]++
+		if pageVisitors[v.path] == nil {
+			pageVisitors[v.path] = make(map[string]struct{})
+		}
+		pageVisitors[v.path][v.visitor] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	result := &RealtimeResult{ActiveVisitors: len(visitors)}
+	for p, n := range pages {
+		result.ActivePages = append(result.ActivePages, PathCount{Name: p, Count: n})
+	}
+	sort.Slice(result.ActivePages, func(i, j int) bool {
+		a, b := result.ActivePages[i], result.ActivePages[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Name < b.Name
+	})
+	if len(result.ActivePages) > 10 {
+		result.ActivePages = result.ActivePages[:10]
+	}
+	if k := setting(&minVisitors); k > 1 {
+		counts := make(map[string]int, len(result.ActivePages))
+		for _, p := range result.ActivePages {
+			counts[p.Name] = len(pageVisitors[p.Name])
+		}
+		result.ActivePages = foldSmall(result.ActivePages, counts, k)
+	}
+	return result
+}
+
+// StartLiveFeed seeds the sliding window from the database and starts
+// broadcasting snapshots every liveSnapshotInterval.
+func StartLiveFeed() {
+	// Places are generalised against the census, so start loading it now
+	if setting(&minVisitors) > 1 {
+		places.refresh()
+	}
+
+	since := time.Now().Add(-activeWindow)
+	rows, err := readDB.Query(`SELECT ts, visitor_hash, path FROM page_views WHERE ts >= ? ORDER BY ts, id`, since.Unix())
+	if err != nil {
+		slog.Error("live: seed window", "err", err)
+	} else {
+		live.mu.Lock()
+		for rows.Next() {
+			var ts int64
+			var v liveView
+			if rows.Scan(&ts, &v.visitor, &v.path) == nil {
+				v.at = time.Unix(ts, 0)
+				live.views = append(live.views, v)
+			}
+		}
+		live.mu.Unlock()
+		rows.Close()
+	}
+
+	go func() {
+		ticker := time.NewTicker(liveSnapshotInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			data, _ := json.Marshal(live.Snapshot(now))
+			live.mu.Lock()
+			live.broadcast(liveMessage{"snapshot", data})
+			live.mu.Unlock()
+		}
+	}()
+}
+
+// handleLive streams accepted beacons ("pageview" and "event" messages)
+// and active-visitor snapshots ("snapshot") as Server-Sent Events. When a
+// client falls behind, messages are skipped and a "dropped" message with
+// the count precedes the next one delivered.
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	c, ok := live.subscribe()
+	if !ok {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many live connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer live.unsubscribe(c)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(event string, data []byte) error {
+		// Bound each write instead of the server-wide WriteTimeout, so a
+		// stalled client is cut off but a healthy stream stays open
+		rc.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	fmt.Fprint(w, "retry: 5000\n\n")
+	data, _ := json.Marshal(live.Snapshot(time.Now()))
+	if send("snapshot", data) != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-c.ch:
+			if n := c.dropped.Swap(0); n > 0 {
+				if send("dropped", []byte(fmt.Sprintf(`{"count":%d}`, n))) != nil {
+					return
+				}
+			}
+			if send(msg.event, msg.data) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Log settings, set by -log-format and -log-level. The level can change
+// on a reload; the handler reads it on every record.
+var (
+	logFormat = "text"
+	logLevel  slog.LevelVar
+)
+
+// setupLogging sends the default logger, and with it the log package, to
+// stderr in logFormat, tagging records with their request's ID and
+// redacting secrets and addresses.
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: &logLevel, ReplaceAttr: redactAttr}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if logFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+func validateLogFormat() error {
+	if logFormat != "text" && logFormat != "json" {
+		return errors.New("log format must be text or json")
+	}
+	return nil
+}
+
+// fatal logs an error and exits, as slog has no Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID to records logged with a request's
+// context, so that a handler's errors can be matched to its access log.
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// validRequestID matches the X-Request-ID values taken from a proxy
+// rather than replaced.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID gives r an ID, the proxy's X-Request-ID if it sent a
+// sensible one, and echoes it in the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// quietRoutes are logged at debug level unless they fail, as they are
+// requested far more often than the rest.
+var quietRoutes = map[string]bool{
+	"POST /api/analytics/event": true,
+	"/api/analytics/event":      true,
+	"GET /metrics":              true,
+	"GET /healthz":              true,
+	"GET /readyz":               true,
+}
+
+// logRequest writes the access log entry of a served request.
+func logRequest(r *http.Request, route string, status int, bytes int64, latency time.Duration) {
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case quietRoutes[route] && status < 400:
+		level = slog.LevelDebug
+	}
+	slog.LogAttrs(r.Context(), level, "request",
+		slog.String("method", r.Method),
+		slog.String("route", route),
+		slog.String("path", r.URL.RequestURI()),
+		slog.Int("status", status),
+		slog.Int64("bytes", bytes),
+		slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+		slog.String("ip", clientIP(r)),
+	)
+}
+
+// secretKeys are attribute names whose values are never logged.
+var secretKeys = map[string]bool{
+	"token": true, "password": true, "secret": true, "client_secret": true,
+	"authorization": true, "cookie": true, "key": true,
+}
+
+var (
+	// secretParam matches the value of a query parameter that may carry a
+	// credential, such as the code and state of a sign-in callback.
+	secretParam = regexp.MustCompile(`(?i)([?&](?:token|access_token|id_token|api_key|key|code|state|password|secret|client_secret)=)[^&#\s"]*`)
+	// secretPath matches the token of a share link.
+	secretPath = regexp.MustCompile(`(/share/)[^/?#\s"{]+`)
+	bearer     = regexp.MustCompile(`(?i)(bearer\s+)[^\s"]+`)
+	// ipAddress matches candidate IPv4 and IPv6 addresses; only those that
+	// parse are masked.
+	ipAddress = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|[0-9A-Fa-f]*:[0-9A-Fa-f]*:[0-9A-Fa-f:.]*`)
+)
+
+// redactAttr is the handlers' ReplaceAttr. The values of attributes named
+// like secrets are hidden, and credentials and client addresses are removed
+// from the message and every string or error.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[redacted]")
+	}
+	switch v := a.Value.Any().(type) {
+	case string:
+		a.Value = slog.StringValue(redact(v))
+	case error:
+		a.Value = slog.StringValue(redact(v.Error()))
+	}
+	return a
+}
+
+// redact removes credentials from s and masks IP addresses to their /24
+// or /48 network, as exports do. Loopback and unspecified addresses, such
+// as listen addresses, are kept.
+func redact(s string) string {
+	s = secretParam.ReplaceAllString(s, "${1}[redacted]")
+	s = secretPath.ReplaceAllString(s, "${1}[redacted]")
+	s = bearer.ReplaceAllString(s, "${1}[redacted]")
+	return ipAddress.ReplaceAllStringFunc(s, func(m string) string {
+		ip := net.ParseIP(m)
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			return m
+		}
+		return maskIP(m)
+	})
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,40 +12,62 @@ import (
 )
 
 func main() {
-	var (
-		addr    = flag.String("addr", ":3001", "listen address")
-		dbPath  = flag.String("db", "analytics.db", "SQLite database path")
-		geoPath = flag.String("geoip", "", "path to IP2Location LITE DB1 CSV file")
-		token   = flag.String("token", "", "auth token for dashboard (or set CONSOLE_TOKEN env)")
-	)
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	f := defineFlags()
 	flag.Parse()
 
-	// Auth token from flag or environment
-	authToken = *token
-	if authToken == "" {
-		authToken = os.Getenv("CONSOLE_TOKEN")
+	// Config file and environment variables, for settings not given as flags
+	if err := loadConfig(*f.config); err != nil {
+		fatal("invalid config", "err", err)
+	}
+	if err := validateSettings(); err != nil {
+		fatal("invalid config", "err", err)
+	}
+	setupLogging()
+	authToken = *f.token
+
+	if err := oidcCfg.Validate(); err != nil {
+		fatal("invalid OpenID Connect config", "err", err)
+	}
+
+	if metricsAddr == "" && metricsToken == "" {
+		slog.Info("metrics disabled: set -metrics-token or -metrics-addr to serve /metrics")
 	}
 
 	// Initialize database
-	if err := initDB(*dbPath); err != nil {
-		log.Fatalf("database init failed: %v", err)
+	if err := initDB(*f.dbPath); err != nil {
+		fatal("database init failed", "err", err)
+	}
+	defer closeDB()
+	slog.Info("database initialized", "path", *f.dbPath)
+
+	if err := loadUsers(); err != nil {
+		fatal("loading users failed", "err", err)
 	}
-	defer db.Close()
-	log.Println("database initialized")
 
 	// Load GeoIP database (optional)
-	LoadGeoIP(*geoPath)
+	LoadGeoIP(geoIPPath)
+
+	// Seed and start the realtime feed
+	StartLiveFeed()
 
 	// Start background aggregation
 	StartAggregationLoop()
 
+	// Start scheduled backups (optional)
+	StartBackupLoop()
+
 	// Setup routes
 	mux := http.NewServeMux()
 	SetupRoutes(mux)
+	StartMetricsServer()
 
 	server := &http.Server{
-		Addr:         *addr,
-		Handler:      mux,
+		Addr:         *f.addr,
+		Handler:      instrument(mux),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -55,26 +77,98 @@ func main() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
 
+	// SIGHUP reloads the live settings without touching connections
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
 	go func() {
-		log.Printf("noblemind-console listening on %s", *addr)
-		if authToken != "" {
-			log.Println("auth token configured — dashboard requires ?token=... parameter")
-		} else {
-			log.Println("WARNING: no auth token set — dashboard is publicly accessible")
+		slog.Info("noblemind-console listening", "addr", *f.addr)
+		switch {
+		case oidcCfg.enabled():
+			slog.Info("dashboard requires login; single sign-on", "issuer", oidcCfg.Issuer)
+		case haveUsers.Load() && authToken != "":
+			slog.Info("dashboard requires login; legacy bearer token also accepted")
+		case haveUsers.Load():
+			slog.Info("dashboard requires login")
+		case authToken != "":
+			slog.Info("no users yet — run `noblemind-console user add -role admin <name>` to enable dashboard login")
+		default:
+			slog.Warn("no users or auth token — dashboard is publicly accessible")
 		}
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+			fatal("server error", "err", err)
 		}
 	}()
 
 	<-done
-	log.Println("shutting down...")
+	slog.Info("shutting down")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("shutdown error: %v", err)
+		fatal("shutdown error", "err", err)
+	}
+	slog.Info("stopped")
+}
+
+// serverFlags are the server's flags not bound to a package variable.
+type serverFlags struct {
+	config, addr, dbPath, token *string
+}
+
+// defineFlags registers the server's flags. Each but -config has a
+// setting of the same value in the config file.
+func defineFlags() serverFlags {
+	f := serverFlags{
+		config: flag.String("config", os.Getenv("CONSOLE_CONFIG"), "TOML config file; `noblemind-console config example` prints a documented one"),
+		addr:   flag.String("addr", ":3001", "listen address"),
+		dbPath: flag.String("db", "analytics.db", "SQLite database path"),
+		token:  flag.String("token", "", "legacy admin bearer token for scripts (or set CONSOLE_TOKEN env)"),
 	}
-	log.Println("stopped")
+	flag.StringVar(&geoIPPath, "geoip", "", "path to IP2Location LITE DB1 CSV file")
+	flag.StringVar(&backupCfg.Dir, "backup-dir", backupCfg.Dir, "directory for database snapshots")
+	flag.BoolVar(&backupCfg.Gzip, "backup-gzip", false, "gzip-compress database snapshots")
+	flag.IntVar(&backupCfg.Keep, "backup-keep", backupCfg.Keep, "number of scheduled snapshots to keep")
+	flag.DurationVar(&backupCfg.Interval, "backup-interval", 0, "interval between scheduled snapshots (0 disables)")
+	flag.StringVar(&archiveDir, "archive-dir", "", "archive raw rows here as gzip NDJSON before purging (empty disables)")
+	flag.IntVar(&retention.PageViews, "retain-pageviews", retention.PageViews, "days to keep raw page views (0 = forever)")
+	flag.IntVar(&retention.Events, "retain-events", retention.Events, "days to keep raw events (0 = forever)")
+	flag.IntVar(&retention.IPAddress, "retain-ip", retention.IPAddress, "days to keep raw IP addresses (0 = forever)")
+	flag.IntVar(&retention.Salts, "retain-salts", retention.Salts, "days to keep daily salts (0 = forever)")
+	flag.IntVar(&retention.Aggregates, "retain-aggregates", retention.Aggregates, "days to keep daily aggregates (0 = forever)")
+	flag.IntVar(&retention.Audit, "retain-audit", retention.Audit, "days to keep the audit log (0 = forever)")
+	flag.StringVar(&retention.PurgeAt, "purge-at", retention.PurgeAt, "daily purge time, HH:MM UTC")
+	flag.IntVar(&retention.ChunkSize, "purge-chunk", retention.ChunkSize, "rows deleted per purge statement")
+	flag.BoolVar(&partitionMonthly, "partition-monthly", false, "store raw rows in monthly partition tables (a partitioned database stays so)")
+	flag.IntVar(&readConns, "read-conns", readConns, "connections in the read-only query pool")
+	flag.DurationVar(&queryTimeouts.Stats, "stats-timeout", queryTimeouts.Stats, "query timeout for /api/analytics/stats")
+	flag.DurationVar(&queryTimeouts.Realtime, "realtime-timeout", queryTimeouts.Realtime, "query timeout for /api/analytics/realtime")
+	flag.DurationVar(&queryTimeouts.Recent, "recent-timeout", queryTimeouts.Recent, "query timeout for /api/analytics/recent")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve /metrics on this separate address, e.g. 127.0.0.1:9101")
+	flag.StringVar(&metricsToken, "metrics-token", "", "bearer token for /metrics (or set CONSOLE_METRICS_TOKEN env)")
+	flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "how long a dashboard login lasts")
+	flag.StringVar(&oidcCfg.Issuer, "oidc-issuer", "", "OpenID Connect issuer URL; enables single sign-on")
+	flag.StringVar(&oidcCfg.ClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&oidcCfg.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret, empty for a public client (or set CONSOLE_OIDC_CLIENT_SECRET env)")
+	flag.StringVar(&oidcCfg.RedirectURL, "oidc-redirect-url", "", "callback URL registered with the provider (default https://<host>/auth/oidc/callback)")
+	flag.StringVar(&oidcCfg.Scopes, "oidc-scopes", oidcCfg.Scopes, "space-separated scopes to request")
+	flag.StringVar(&oidcCfg.Name, "oidc-name", oidcCfg.Name, "provider name on the login page")
+	flag.StringVar(&oidcCfg.RoleClaim, "oidc-role-claim", oidcCfg.RoleClaim, "ID token claim holding groups or roles, e.g. realm_access.roles")
+	flag.StringVar(&oidcCfg.RoleMap, "oidc-roles", "", "claim value to role mapping, e.g. console-admins=admin,staff=analyst")
+	flag.StringVar(&oidcCfg.DefaultRole, "oidc-default-role", "", "role for users matching no mapping (empty refuses them)")
+	flag.IntVar(&minVisitors, "min-visitors", minVisitors, "fold rows seen by fewer visitors into \"Other\" and refuse filters matching fewer (0 = off)")
+	flag.BoolVar(&publicCfg.Enabled, "public-stats", false, "serve differentially private totals at /api/public/stats without credentials")
+	flag.StringVar(&publicCfg.Mechanism, "public-noise", publicCfg.Mechanism, "noise for public stats: laplace or gaussian")
+	flag.Float64Var(&publicCfg.Budget, "public-epsilon", publicCfg.Budget, "privacy budget (epsilon) of each day of data across all public releases")
+	flag.Float64Var(&publicCfg.Delta, "public-delta", publicCfg.Delta, "delta of each gaussian count and of listing a page in public stats")
+	flag.IntVar(&liveMaxClients, "live-clients", liveMaxClients, "maximum concurrent /api/analytics/live streams")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log output: text or json")
+	flag.TextVar(&logLevel, "log-level", new(slog.LevelVar), "minimum log level: debug, info, warn or error")
+	return f
 }
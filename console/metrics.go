@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server and ingestion metrics, exposed at /metrics in the Prometheus text
+// format. They are written by hand rather than through a client library to
+// keep the binary dependency-free.
+
+// metricsToken guards /metrics on the main listener. metricsAddr, when
+// set, serves /metrics on a separate listener instead (e.g. 127.0.0.1:9101),
+// where the token is only checked if also set.
+var (
+	metricsToken string
+	metricsAddr  string
+)
+
+// insertBuckets are the upper bounds, in seconds, of the insert latency
+// histogram.
+var insertBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// counterVec is a counter per label set; keys are rendered label sets as
+// produced by labels.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (c *counterVec) Inc(labelSet string) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[labelSet]++
+	c.mu.Unlock()
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// jobStats tracks runs of a background job.
+type jobStats struct {
+	runs, failures atomic.Int64
+	lastNanos      atomic.Int64
+}
+
+func (j *jobStats) record(d time.Duration, err error) {
+	j.runs.Add(1)
+	if err != nil {
+		j.failures.Add(1)
+	}
+	j.lastNanos.Store(int64(d))
+}
+
+var metrics = struct {
+	beaconsAccepted counterVec // type
+	beaconsRejected counterVec // reason, type
+	insertSeconds   *histogram
+	queueDepth      atomic.Int64 // beacons waiting for or holding the writer
+	aggregation     jobStats
+	purge           jobStats
+	geoLookups      atomic.Int64
+	geoHits         atomic.Int64
+	httpRequests    counterVec // route, code
+	started         time.Time
+}{
+	insertSeconds: newHistogram(insertBuckets),
+	started:       time.Now(),
+}
+
+// beaconKind is the type label for a beacon: event types are chosen by
+// the client, so they are collapsed to keep the label set bounded.
+func beaconKind(beaconType string) string {
+	switch beaconType {
+	case "pageview":
+		return "pageview"
+	case "":
+		return "unknown"
+	}
+	return "event"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders name/value pairs as a Prometheus label set.
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(kv[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// instrument counts and logs requests by the mux pattern that served them,
+// so the route label stays bounded whatever paths clients ask for, and
+// gives each request an ID.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		r = withRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.httpRequests.Inc(labels("route", route, "code", strconv.Itoa(status)))
+			logRequest(r, route, status, rec.bytes, time.Since(start))
+		}()
+		mux.ServeHTTP(rec, r)
+	})
+}
+
+// promWriter writes the Prometheus text exposition format.
+type promWriter struct {
+	*bufio.Writer
+}
+
+func (p promWriter) header(name, typ, help string) {
+	fmt.Fprintf(p, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p promWriter) sample(name, labelSet string, v float64) {
+	p.WriteString(name)
+	p.WriteString(labelSet)
+	p.WriteByte(' ')
+	p.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	p.WriteByte('\n')
+}
+
+func (p promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", v)
+}
+
+func (p promWriter) counter(name, help string, v float64) {
+	p.header(name, "counter", help)
+	p.sample(name, "", v)
+}
+
+func (p promWriter) counterVec(name, help string, c *counterVec) {
+	p.header(name, "counter", help)
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.sample(name, k, float64(c.values[k]))
+	}
+	c.mu.Unlock()
+}
+
+func (p promWriter) histogram(name, help string, h *histogram) {
+	p.header(name, "histogram", help)
+	h.mu.Lock()
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i]
+		p.sample(name+"_bucket", labels("le", strconv.FormatFloat(b, 'g', -1, 64)), float64(cum))
+	}
+	p.sample(name+"_bucket", labels("le", "+Inf"), float64(h.count))
+	p.sample(name+"_sum", "", h.sum)
+	p.sample(name+"_count", "", float64(h.count))
+	h.mu.Unlock()
+}
+
+func (p promWriter) job(name, what string, j *jobStats) {
+	p.counter(name+"_runs_total", what+" runs.", float64(j.runs.Load()))
+	p.counter(name+"_failures_total", what+" runs that failed.", float64(j.failures.Load()))
+	p.gauge(name+"_last_duration_seconds", "Duration of the last "+strings.ToLower(what)+" run.",
+		time.Duration(j.lastNanos.Load()).Seconds())
+}
+
+// fileSize returns the size of path, or 0 if it does not exist.
+func fileSize(path string) float64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return float64(fi.Size())
+}
+
+// WriteMetrics writes every metric in the Prometheus text format.
+func WriteMetrics(w io.Writer) error {
+	p := promWriter{bufio.NewWriter(w)}
+
+	p.counterVec("noblemind_beacons_accepted_total", "Beacons stored, by type.", &metrics.beaconsAccepted)
+	p.counterVec("noblemind_beacons_rejected_total", "Beacons rejected, by reason and type.", &metrics.beaconsRejected)
+	p.histogram("noblemind_insert_duration_seconds", "Time to insert one beacon, including waiting for the writer.", metrics.insertSeconds)
+	p.gauge("noblemind_beacon_queue_depth", "Beacons waiting for or holding the database writer.", float64(metrics.queueDepth.Load()))
+	p.job("noblemind_aggregation", "Aggregate rebuild", &metrics.aggregation)
+	p.job("noblemind_purge", "Retention purge", &metrics.purge)
+
+	p.header("noblemind_db_size_bytes", "gauge", "Size of the SQLite database files.")
+	p.sample("noblemind_db_size_bytes", labels("file", "db"), fileSize(dbFile))
+	p.sample("noblemind_db_size_bytes", labels("file", "wal"), fileSize(dbFile+"-wal"))
+
+	geoIP.mu.RLock()
+	records := len(geoIP.records)
+	geoIP.mu.RUnlock()
+	p.gauge("noblemind_geoip_records", "GeoIP ranges loaded.", float64(records))
+	p.counter("noblemind_geoip_lookups_total", "GeoIP lookups made with a database loaded.", float64(metrics.geoLookups.Load()))
+	p.counter("noblemind_geoip_hits_total", "GeoIP lookups that found a location.", float64(metrics.geoHits.Load()))
+
+	p.counterVec("noblemind_http_requests_total", "HTTP requests, by route and status code.", &metrics.httpRequests)
+	p.gauge("noblemind_live_clients", "Connected live streams.", float64(live.clientCount()))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.header("go_info", "gauge", "Go version the binary was built with.")
+	p.sample("go_info", labels("version", runtime.Version()), 1)
+	p.gauge("go_goroutines", "Goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	p.gauge("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", float64(ms.Alloc))
+	p.gauge("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", float64(ms.HeapInuse))
+	p.gauge("go_memstats_heap_objects", "Allocated heap objects.", float64(ms.HeapObjects))
+	p.gauge("go_memstats_sys_bytes", "Bytes obtained from the OS.", float64(ms.Sys))
+	p.counter("go_gc_cycles_total", "Completed GC cycles.", float64(ms.NumGC))
+	p.counter("go_gc_pause_seconds_total", "Total GC stop-the-world pause time.", float64(ms.PauseTotalNs)/1e9)
+	p.gauge("process_start_time_seconds", "Start time of the process since the Unix epoch.", float64(metrics.started.Unix()))
+
+	return p.Flush()
+}
+
+// handleMetrics serves /metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WriteMetrics(w); err != nil {
+		slog.ErrorContext(r.Context(), "metrics", "err", err)
+	}
+}
+
+// requireMetricsToken checks the metrics bearer token, if one is set.
+func requireMetricsToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if metricsToken != "" {
+			token := extractBearerToken(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// StartMetricsServer serves /metrics on metricsAddr, if set.
+func StartMetricsServer() {
+	if metricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", requireMetricsToken(handleMetrics))
+	server := &http.Server{
+		Addr:         metricsAddr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("metrics listening", "addr", metricsAddr)
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("metrics server", "err", err)
+		}
+	}()
+}
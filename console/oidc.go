@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for RS384, ES512, ...
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcConfig configures dashboard single sign-on through an OpenID Connect
+// provider, using the authorization code flow with PKCE.
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for a public client
+	RedirectURL  string // default /auth/oidc/callback on the request's host
+	Scopes       string
+	Name         string // provider name on the login page
+	RoleClaim    string // claim holding group or role names; dots reach nested claims
+	RoleMap      string // comma-separated claim value=role pairs
+	DefaultRole  string // role of users matching no pair; empty turns them away
+
+	roles map[string]string
+}
+
+var oidcCfg = oidcConfig{Scopes: "openid email profile", Name: "single sign-on", RoleClaim: "groups"}
+
+func (c *oidcConfig) enabled() bool { return c.Issuer != "" }
+
+// Validate checks the configuration and parses the role map.
+func (c *oidcConfig) Validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if u, err := url.Parse(c.Issuer); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if c.ClientID == "" {
+		return errors.New("a client ID is required")
+	}
+	if !slices.Contains(strings.Fields(c.Scopes), "openid") {
+		return errors.New(`scopes must include "openid"`)
+	}
+	c.roles = map[string]string{}
+	for _, pair := range strings.Split(c.RoleMap, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(pair, "=")
+		if !ok || roleRanks[role] == 0 {
+			return fmt.Errorf("invalid role mapping %q: want value=viewer|analyst|admin", pair)
+		}
+		c.roles[value] = role
+	}
+	if c.DefaultRole != "" && roleRanks[c.DefaultRole] == 0 {
+		return fmt.Errorf("invalid default role %q", c.DefaultRole)
+	}
+	return nil
+}
+
+// oidcMetadata is the part of the provider's discovery document we use.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jwk is one key of the provider's JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcPending is a login waiting for the provider to redirect back.
+type oidcPending struct {
+	verifier, nonce, next string
+	expires               time.Time
+}
+
+// oidcProvider caches the discovery document and signing keys, and holds
+// logins in progress.
+type oidcProvider struct {
+	mu      sync.Mutex
+	meta    *oidcMetadata
+	metaAt  time.Time
+	keys    map[string]crypto.PublicKey
+	keysAt  time.Time
+	pending map[string]oidcPending // by state
+}
+
+var (
+	oidc       = &oidcProvider{pending: map[string]oidcPending{}}
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+const (
+	oidcStateCookie = "nm_oidc_state"
+	oidcLoginTTL    = 10 * time.Minute
+	oidcMaxPending  = 10000
+	oidcCacheTTL    = time.Hour
+	oidcClockSkew   = time.Minute
+)
+
+// fetchJSON GETs a provider document.
+func fetchJSON(ctx context.Context, u string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// metadata returns the discovery document, refetching it hourly. A stale
+// copy is used while the provider is unreachable.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.metaAt) < oidcCacheTTL {
+		return p.meta, nil
+	}
+	var m oidcMetadata
+	err := fetchJSON(ctx, strings.TrimSuffix(oidcCfg.Issuer, "/")+"/.well-known/openid-configuration", &m)
+	switch {
+	case err == nil && m.Issuer != oidcCfg.Issuer:
+		err = fmt.Errorf("discovery document is for issuer %q", m.Issuer)
+	case err == nil && (m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == ""):
+		err = errors.New("discovery document lacks an endpoint")
+	}
+	if err != nil {
+		if p.meta != nil {
+			slog.Warn("oidc discovery failed; using cached copy", "err", err)
+			return p.meta, nil
+		}
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	p.meta, p.metaAt = &m, time.Now()
+	return p.meta, nil
+}
+
+// key returns the signing key with ID kid, refetching the key set when the
+// cache is old or, at most once a minute, when kid is unknown (the
+// provider rotated its keys).
+func (p *oidcProvider) key(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+	age := time.Since(p.keysAt)
+	if k := lookup(); k != nil && age < oidcCacheTTL {
+		return k, nil
+	}
+	if age >= time.Minute {
+		var set struct{ Keys []jwk }
+		if err := fetchJSON(ctx, jwksURI, &set); err != nil {
+			slog.Warn("oidc jwks", "err", err)
+		} else {
+			p.keys, p.keysAt = map[string]crypto.PublicKey{}, time.Now()
+			for _, j := range set.Keys {
+				if j.Use != "" && j.Use != "sig" {
+					continue
+				}
+				if k, err := j.publicKey(); err == nil {
+					p.keys[j.Kid] = k
+				}
+			}
+		}
+	}
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no signing key %q", kid)
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// publicKey decodes an RSA, EC or Ed25519 key.
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err1 := b64(j.N)
+		e, err2 := b64(j.E)
+		if err := errors.Join(err1, err2); err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve := curves[j.Crv]
+		x, err1 := b64(j.X)
+		y, err2 := b64(j.Y)
+		if curve == nil || errors.Join(err1, err2) != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		// ecdsa.Verify rejects points that are not on the curve
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := b64(j.X)
+		if j.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+// verifyJWS checks an asymmetric JWS signature. Symmetric and "none"
+// algorithms are refused.
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	if alg == "EdDSA" {
+		if k, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(k, input, sig) {
+			return nil
+		}
+		return errors.New("invalid signature")
+	}
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hashes[alg[2:]]
+	digest := h.New()
+	digest.Write(input)
+	sum := digest.Sum(nil)
+
+	var ok bool
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			ok = rsa.VerifyPKCS1v15(k, h, sum, sig) == nil
+		case "PS":
+			ok = rsa.VerifyPSS(k, h, sum, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(k, sum, r, s)
+		}
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry
+// and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, meta *oidcMetadata, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct{ Alg, Kid string }
+	hb, err1 := b64(parts[0])
+	pb, err2 := b64(parts[1])
+	sig, err3 := b64(parts[2])
+	if errors.Join(err1, err2, err3) != nil || json.Unmarshal(hb, &header) != nil {
+		return nil, errors.New("malformed id token")
+	}
+	key, err := p.key(ctx, meta.JWKSURI, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(pb, &claims); err != nil {
+		return nil, errors.New("malformed id token claims")
+	}
+	now := time.Now()
+	var aud []string
+	switch v := claims["aud"].(type) {
+	case string:
+		aud = []string{v}
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	iat, hasIat := claims["iat"].(float64)
+	azp, hasAzp := claims["azp"].(string)
+	tokenNonce, _ := claims["nonce"].(string)
+	switch {
+	case claims["iss"] != meta.Issuer:
+		return nil, fmt.Errorf("id token issuer %v", claims["iss"])
+	case !slices.Contains(aud, oidcCfg.ClientID):
+		return nil, errors.New("id token is for another client")
+	case (len(aud) > 1 || hasAzp) && azp != oidcCfg.ClientID:
+		return nil, errors.New("id token authorized party is another client")
+	case now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)):
+		return nil, errors.New("id token expired")
+	case hasIat && time.Unix(int64(iat), 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("id token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1:
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+// oidcRole maps the role claim to the highest matching role, or the
+// default role.
+func oidcRole(claims map[string]any) string {
+	var v any = claims
+	for _, name := range strings.Split(oidcCfg.RoleClaim, ".") {
+		m, _ := v.(map[string]any)
+		v = m[name]
+	}
+	var values []string
+	switch v := v.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []any:
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := oidcCfg.DefaultRole
+	for _, value := range values {
+		if r := oidcCfg.roles[value]; roleRanks[r] > roleRanks[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+// oidcUsername picks the first of preferred_username, email and sub that
+// is a valid username.
+func oidcUsername(claims map[string]any) string {
+	for _, c := range []string{"preferred_username", "email", "sub"} {
+		if s, _ := claims[c].(string); usernameRe.MatchString(s) {
+			return s
+		}
+	}
+	return ""
+}
+
+var errUsernameTaken = errors.New("username belongs to a local account")
+
+// linkOIDCUser returns the user linked to a provider account, creating it
+// on first sign-in. The role follows the provider's claims on every
+// sign-in.
+func linkOIDCUser(issuer, subject, username, role string) (*User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	u := User{Username: username, Role: role}
+	err = tx.QueryRow(`SELECT u.id, u.username FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, issuer, subject).Scan(&u.ID, &u.Username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if username == "" {
+			return nil, errors.New("no usable username claim")
+		}
+		// No password: the account can only sign in through the provider
+		res, err := tx.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, '', ?)`, username, role)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				return nil, errUsernameTaken
+			}
+			return nil, err
+		}
+		u.ID, _ = res.LastInsertId()
+		if _, err := tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)`,
+			issuer, subject, u.ID); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if _, err := tx.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, u.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	haveUsers.Store(true)
+	return &u, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func oidcRedirectURL(r *http.Request) string {
+	if oidcCfg.RedirectURL != "" {
+		return oidcCfg.RedirectURL
+	}
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/oidc/callback"
+}
+
+// handleOIDCLogin sends the browser to the provider.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.URL.Query().Get("next"))
+	meta, err := oidc.metadata(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc discovery", "err", err)
+		renderLogin(w, http.StatusBadGateway, next, "", "The sign-in provider is unavailable. Try again later.")
+		return
+	}
+
+	state, nonce, verifier := randomString(16), randomString(16), randomString(32)
+	oidc.mu.Lock()
+	now := time.Now()
+	for s, p := range oidc.pending {
+		if now.After(p.expires) {
+			delete(oidc.pending, s)
+		}
+	}
+	full := len(oidc.pending) >= oidcMaxPending
+	if !full {
+		oidc.pending[state] = oidcPending{verifier: verifier, nonce: nonce, next: next, expires: now.Add(oidcLoginTTL)}
+	}
+	oidc.mu.Unlock()
+	if full {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many sign-ins in progress", http.StatusServiceUnavailable)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcCfg.ClientID},
+		"redirect_uri":          {oidcRedirectURL(r)},
+		"scope":                 {oidcCfg.Scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// exchangeCode redeems an authorization code for an ID token.
+func exchangeCode(ctx context.Context, meta *oidcMetadata, code, verifier, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	if oidcCfg.ClientSecret == "" {
+		form.Set("client_id", oidcCfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidcCfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidcCfg.ClientID), url.QueryEscape(oidcCfg.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// handleOIDCCallback completes a sign-in: it checks the state, redeems the
+// code, verifies the ID token and starts a session.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		renderLogin(w, http.StatusBadRequest, "/console", "", "Sign-in expired or was started in another browser. Please try again.")
+		return
+	}
+	oidc.mu.Lock()
+	pending, ok := oidc.pending[state]
+	delete(oidc.pending, state)
+	oidc.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+	if !ok || time.Now().After(pending.expires) {
+		renderLogin(w, http.StatusBadRequest, "/console", "", "Sign-in expired. Please try again.")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		slog.WarnContext(r.Context(), "oidc sign-in refused", "error", e, "description", q.Get("error_description"))
+		renderLogin(w, http.StatusUnauthorized, pending.next, "", "Sign-in was cancelled or refused.")
+		return
+	}
+
+	fail := func(err error) {
+		slog.ErrorContext(r.Context(), "oidc sign-in", "err", err)
+		renderLogin(w, http.StatusBadGateway, pending.next, "", "Sign-in failed. Please try again.")
+	}
+	meta, err := oidc.metadata(r.Context())
+	if err != nil {
+		fail(err)
+		return
+	}
+	idToken, err := exchangeCode(r.Context(), meta, q.Get("code"), pending.verifier, oidcRedirectURL(r))
+	if err != nil {
+		fail(err)
+		return
+	}
+	claims, err := oidc.verifyIDToken(r.Context(), meta, idToken, pending.nonce)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	sub := claims["sub"].(string)
+	role := oidcRole(claims)
+	if role == "" {
+		slog.WarnContext(r.Context(), "oidc sign-in refused: no role", "sub", sub, "claim", oidcCfg.RoleClaim)
+		renderLogin(w, http.StatusForbidden, pending.next, "", "Your account is not allowed to use the console.")
+		return
+	}
+	u, err := linkOIDCUser(meta.Issuer, sub, oidcUsername(claims), role)
+	if errors.Is(err, errUsernameTaken) {
+		slog.WarnContext(r.Context(), "oidc sign-in refused: username belongs to a local account", "sub", sub, "username", oidcUsername(claims))
+		renderLogin(w, http.StatusConflict, pending.next, "", "Your username is already used by a console account. Ask an admin to rename it.")
+		return
+	}
+	if err == nil {
+		err = startSession(w, r, u.ID)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc login", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	Audit(u.Username, "login", fmt.Sprintf("%s via %s from %s", u.Role, oidcCfg.Name, clientIP(r)))
+	http.Redirect(w, r, pending.next, http.StatusSeeOther)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "console"
+
+// mockProvider is an OpenID Connect provider serving discovery, a key set
+// with an RSA, an EC and an Ed25519 key, and a token endpoint that checks
+// PKCE before handing out an RS256 ID token.
+type mockProvider struct {
+	*httptest.Server
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	mu    sync.Mutex
+	codes map[string]mockGrant // by code
+}
+
+type mockGrant struct {
+	challenge, redirectURI, nonce string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	p := &mockProvider{codes: map[string]mockGrant{}}
+	var err error
+	if p.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if p.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, p.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		pad := func(n *big.Int) string { return enc(n.FillBytes(make([]byte, 32))) }
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: enc(p.rsa.N.Bytes()), E: enc(big.NewInt(int64(p.rsa.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: pad(p.ec.X), Y: pad(p.ec.Y)},
+			{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: enc(p.ed.Public().(ed25519.PublicKey))},
+			{Kty: "RSA", Kid: "enc", Use: "enc", N: enc(p.rsa.N.Bytes()), E: "AQAB"},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		grant, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case !ok,
+			r.PostForm.Get("grant_type") != "authorization_code",
+			r.PostForm.Get("client_id") != testClientID,
+			r.PostForm.Get("redirect_uri") != grant.redirectURI,
+			base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign("RS256", "rsa", p.claims(grant.nonce))})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize stands in for the user signing in at the provider: it takes
+// the authorization request the console redirected to and returns a code.
+func (p *mockProvider) authorize(t *testing.T, location string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, p.URL+"/authorize?") {
+		t.Fatalf("redirected to %q, want the authorization endpoint", location)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without an S256 PKCE challenge: %s", u.RawQuery)
+	}
+	if q.Get("client_id") != testClientID || q.Get("response_type") != "code" || q.Get("nonce") == "" {
+		t.Fatalf("unexpected authorization request: %s", u.RawQuery)
+	}
+	code = randomString(8)
+	p.mu.Lock()
+	p.codes[code] = mockGrant{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), nonce: q.Get("nonce")}
+	p.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func (p *mockProvider) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss": p.URL, "sub": "u-123", "aud": testClientID, "nonce": nonce,
+		"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		"preferred_username": "ada", "groups": []string{"staff"},
+	}
+}
+
+// sign encodes claims as a JWS with the given algorithm, signed by the
+// provider's key of that kind; HS256 is keyed with the RSA modulus, as in
+// the attack on verifiers that take the public key as an HMAC secret.
+func (p *mockProvider) sign(alg, kid string, claims map[string]any) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := enc(header) + "." + enc(payload)
+	sum := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, p.rsa, crypto.SHA256, sum[:])
+	case "PS256":
+		sig, _ = rsa.SignPSS(rand.Reader, p.rsa, crypto.SHA256, sum[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, p.ec, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		sig = ed25519.Sign(p.ed, []byte(input))
+	case "HS256":
+		mac := hmac.New(sha256.New, p.rsa.N.Bytes())
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	}
+	return input + "." + enc(sig)
+}
+
+// useMockProvider points the console's OIDC settings and provider cache at
+// p for the length of the test.
+func useMockProvider(t *testing.T, p *mockProvider) {
+	t.Helper()
+	savedCfg, savedProvider := oidcCfg, oidc
+	t.Cleanup(func() { oidcCfg, oidc = savedCfg, savedProvider })
+	oidcCfg = oidcConfig{Issuer: p.URL, ClientID: testClientID, Scopes: "openid", RoleClaim: "groups", RoleMap: "staff=analyst"}
+	if err := oidcCfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	oidc = &oidcProvider{pending: map[string]oidcPending{}}
+}
+
+// TestOIDCSignIn runs the whole authorization code flow against the mock
+// provider: discovery, the PKCE challenge, code redemption, ID token
+// verification against the key set, and the session it ends in.
+func TestOIDCSignIn(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "analytics.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	p := newMockProvider(t)
+	useMockProvider(t, p)
+
+	w := httptest.NewRecorder()
+	handleOIDCLogin(w, httptest.NewRequest("GET", "/auth/oidc/login?next=/console/goals", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d, want 302", w.Code)
+	}
+	var stateCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			stateCookie = c
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("login set no state cookie")
+	}
+	code, state := p.authorize(t, w.Header().Get("Location"))
+	if state != stateCookie.Value {
+		t.Fatalf("state %q does not match the cookie's %q", state, stateCookie.Value)
+	}
+
+	r := httptest.NewRequest("GET", "/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	r.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	handleOIDCCallback(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/console/goals" {
+		t.Fatalf("callback: status %d to %q, want 303 to /console/goals", w.Code, w.Header().Get("Location"))
+	}
+	var session string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c.Value
+		}
+	}
+	u, err := sessionUser(context.Background(), session)
+	if err != nil || u == nil {
+		t.Fatalf("callback started no session: %v", err)
+	}
+	if u.Username != "ada" || u.Role != roleAnalyst {
+		t.Errorf("signed in as %s (%s), want ada (analyst)", u.Username, u.Role)
+	}
+
+	// The state is single use
+	w = httptest.NewRecorder()
+	handleOIDCCallback(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: status %d, want 400", w.Code)
+	}
+}
+
+// TestOIDCCodeNeedsVerifier checks that the code is only redeemed with the
+// verifier whose challenge the authorization request carried.
+func TestOIDCCodeNeedsVerifier(t *testing.T) {
+	p := newMockProvider(t)
+	useMockProvider(t, p)
+	meta, err := oidc.metadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := randomString(32)
+	challenge := sha256.Sum256([]byte(verifier))
+	redirect := "https://console.example/auth/oidc/callback"
+	grant := func() string {
+		code := randomString(8)
+		p.mu.Lock()
+		p.codes[code] = mockGrant{challenge: base64.RawURLEncoding.EncodeToString(challenge[:]), redirectURI: redirect}
+		p.mu.Unlock()
+		return code
+	}
+	if _, err := exchangeCode(context.Background(), meta, grant(), randomString(32), redirect); err == nil {
+		t.Error("code redeemed with the wrong verifier")
+	}
+	if _, err := exchangeCode(context.Background(), meta, grant(), verifier, redirect); err != nil {
+		t.Errorf("code not redeemed with its verifier: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	p := newMockProvider(t)
+	useMockProvider(t, p)
+	oidcCfg.Issuer = p.URL + "/"
+	if _, err := oidc.metadata(context.Background()); err == nil {
+		t.Error("accepted a discovery document for another issuer")
+	}
+}
+
+// TestVerifyIDToken checks each rule an ID token must pass.
+func TestVerifyIDToken(t *testing.T) {
+	p := newMockProvider(t)
+	useMockProvider(t, p)
+	meta, err := oidc.metadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nonce = "n-0S6_WzA2Mj"
+	with := func(change func(map[string]any)) map[string]any {
+		c := p.claims(nonce)
+		change(c)
+		return c
+	}
+	// reheader swaps a signed token's header for header
+	reheader := func(token, header string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(header)) + token[strings.Index(token, "."):]
+	}
+	valid := p.sign("RS256", "rsa", p.claims(nonce))
+	tampered := func() string {
+		parts := strings.Split(valid, ".")
+		payload, _ := json.Marshal(with(func(c map[string]any) { c["sub"] = "admin" }))
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", valid, true},
+		{"PS256", p.sign("PS256", "rsa", p.claims(nonce)), true},
+		{"ES256", p.sign("ES256", "ec", p.claims(nonce)), true},
+		{"EdDSA", p.sign("EdDSA", "ed", p.claims(nonce)), true},
+		{"audience list with azp", p.sign("RS256", "rsa", with(func(c map[string]any) {
+			c["aud"], c["azp"] = []string{testClientID, "other"}, testClientID
+		})), true},
+		{"clock skew", p.sign("RS256", "rsa", with(func(c map[string]any) {
+			c["exp"] = time.Now().Add(-30 * time.Second).Unix()
+		})), true},
+
+		{"bad nonce", p.sign("RS256", "rsa", with(func(c map[string]any) { c["nonce"] = "other" })), false},
+		{"no nonce", p.sign("RS256", "rsa", with(func(c map[string]any) { delete(c, "nonce") })), false},
+		{"other audience", p.sign("RS256", "rsa", with(func(c map[string]any) { c["aud"] = "other" })), false},
+		{"audience list without azp", p.sign("RS256", "rsa", with(func(c map[string]any) {
+			c["aud"] = []string{testClientID, "other"}
+		})), false},
+		{"azp of another client", p.sign("RS256", "rsa", with(func(c map[string]any) { c["azp"] = "other" })), false},
+		{"expired", p.sign("RS256", "rsa", with(func(c map[string]any) {
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+		})), false},
+		{"no expiry", p.sign("RS256", "rsa", with(func(c map[string]any) { delete(c, "exp") })), false},
+		{"issued in the future", p.sign("RS256", "rsa", with(func(c map[string]any) {
+			c["iat"] = time.Now().Add(10 * time.Minute).Unix()
+		})), false},
+		{"other issuer", p.sign("RS256", "rsa", with(func(c map[string]any) { c["iss"] = "https://evil.example" })), false},
+		{"no subject", p.sign("RS256", "rsa", with(func(c map[string]any) { delete(c, "sub") })), false},
+		{"alg none", reheader(valid[:strings.LastIndex(valid, ".")+1], `{"alg":"none","kid":"rsa"}`), false},
+		{"alg none with the signature", reheader(valid, `{"alg":"none","kid":"rsa"}`), false},
+		{"HS256 keyed with the public key", p.sign("HS256", "rsa", p.claims(nonce)), false},
+		{"HS512 header", reheader(valid, `{"alg":"HS512","kid":"rsa"}`), false},
+		{"ES256 header on the RSA key", reheader(valid, `{"alg":"ES256","kid":"rsa"}`), false},
+		{"ES256 signature under the RSA key", reheader(p.sign("ES256", "ec", p.claims(nonce)), `{"alg":"ES256","kid":"rsa"}`), false},
+		{"RS256 header on the EC key", reheader(p.sign("ES256", "ec", p.claims(nonce)), `{"alg":"RS256","kid":"ec"}`), false},
+		{"EdDSA header on the RSA key", reheader(valid, `{"alg":"EdDSA","kid":"rsa"}`), false},
+		{"encryption key", p.sign("RS256", "enc", p.claims(nonce)), false},
+		{"unknown key", p.sign("RS256", "gone", p.claims(nonce)), false},
+		{"tampered claims", tampered(), false},
+		{"malformed", "a.b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := oidc.verifyIDToken(context.Background(), meta, tt.token, nonce)
+			switch {
+			case tt.ok && err != nil:
+				t.Errorf("refused: %v", err)
+			case !tt.ok && err == nil:
+				t.Errorf("accepted with claims %v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"noblemind-console/api"
+)
+
+// The OpenAPI document is generated rather than written by hand: schemas
+// are reflected from the api package types the handlers encode, and
+// parameter enums come from the same tables the handlers validate against,
+// so the document cannot fall out of step with either.
+
+// apiParam documents one query or path parameter.
+type apiParam struct {
+	name, in, desc string
+	typ            string // string (default), integer or boolean
+	enum           []string
+	required       bool
+}
+
+// apiOperation documents one route.
+type apiOperation struct {
+	method, path, summary string
+	params                []apiParam
+	body                  any      // request document, nil for none
+	response              any      // success document, nil for none
+	status                string   // success status, default "200"
+	media                 []string // success media types when not JSON
+	public                bool     // no authentication required
+	role                  string   // least role allowed, default viewer
+	scope                 string   // API key scope needed, default read:stats; "*" for any key
+}
+
+func rangeParams() []apiParam {
+	return []apiParam{
+		{name: "tz", desc: "IANA time zone for bucketing and date parsing (default UTC)"},
+		{name: "preset", desc: "named window; takes precedence over from/to", enum: presetNames},
+		{name: "from", desc: "start date (YYYY-MM-DD) or RFC 3339 timestamp"},
+		{name: "to", desc: "inclusive end date (YYYY-MM-DD) or RFC 3339 timestamp"},
+		{name: "period", desc: "Nd counted back from now, used when neither preset nor from is given (default 7d)"},
+	}
+}
+
+func filterParamDocs() []apiParam {
+	var params []apiParam
+	for _, p := range filterParams {
+		desc := "comma-separated values to match; prefix a value with ! to exclude it"
+		switch p.op {
+		case "prefix":
+			desc = "comma-separated prefixes to match; prefix with ! to exclude"
+		case "regex":
+			desc = "regular expression to match; prefix with ! to exclude"
+		}
+		params = append(params, apiParam{name: p.param, desc: desc})
+	}
+	return params
+}
+
+// sortedKeys returns the keys of a string-keyed map in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func params(groups ...[]apiParam) []apiParam {
+	var all []apiParam
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+func apiOperations() []apiOperation {
+	segment := params(rangeParams(), filterParamDocs())
+	metric := apiParam{name: "metric", desc: "value to count (default views)", enum: sortedKeys(metricExprs)}
+	dimensions := sortedKeys(dimensionColumns)
+	id := apiParam{name: "id", in: "path", typ: "integer", required: true}
+
+	return []apiOperation{
+		{method: "POST", path: "/api/analytics/event", summary: "Record a page view or event beacon",
+			body: api.Beacon{}, response: api.BeaconResponse{}, public: true},
+		{method: "GET", path: "/api/analytics/stats", summary: "Dashboard totals, time series and top lists; rows seen by fewer than -min-visitors visitors fold into Other and such time buckets read zero",
+			params:   params(segment, []apiParam{{name: "compare", desc: "compare with another window", enum: []string{"previous", "year"}}}),
+			response: api.StatsResult{}},
+		{method: "GET", path: "/api/analytics/realtime", summary: "Visitors active in the last 30 minutes",
+			params: filterParamDocs(), response: api.RealtimeResult{}},
+		{method: "GET", path: "/api/analytics/recent", summary: "The most recent page views, with rarely seen places generalised and IP addresses masked for non-admins",
+			params:   []apiParam{{name: "limit", typ: "integer", desc: "1-200, default 50"}},
+			response: []api.RecentVisit{}, scope: scopeReadRaw},
+		{method: "GET", path: "/api/analytics/live",
+			summary: "Server-Sent Events stream of beacons (pageview, event: LiveEvent) and active-visitor snapshots (snapshot: RealtimeResult)",
+			media:   []string{"text/event-stream"}, scope: scopeReadRaw},
+		{method: "GET", path: "/api/analytics/breakdown", summary: "A metric grouped by one or two dimensions; groups seen by fewer than -min-visitors visitors fold into Other",
+			params: params(segment, []apiParam{
+				{name: "dimension", enum: dimensions, required: true},
+				{name: "pivot", desc: "second dimension", enum: dimensions},
+				metric,
+				{name: "sort", enum: sortedKeys(breakdownSorts)},
+				{name: "limit", typ: "integer", desc: "1-1000, default 20"},
+				{name: "offset", typ: "integer"},
+			}),
+			response: api.BreakdownResult{}},
+		{method: "GET", path: "/api/analytics/timeseries", summary: "A metric per time bucket; buckets seen by fewer than -min-visitors visitors read zero",
+			params: params(segment, []apiParam{metric,
+				{name: "granularity", desc: "bucket size (default hour for up to two days, else day)", enum: granularities}}),
+			response: api.TimeseriesResult{}},
+		{method: "GET", path: "/api/analytics/paths", summary: "Entry and exit pages, transitions and common sequences, leaving out those of fewer than -min-visitors visitors",
+			params: params(segment, []apiParam{
+				{name: "after", desc: "only report transitions leaving pages with this prefix"},
+				{name: "limit", typ: "integer", desc: "entries per list, 1-100, default 20"},
+			}),
+			response: api.PathsResult{}},
+		{method: "GET", path: "/api/analytics/export", summary: "Download raw rows, sessions or a breakdown as a file",
+			params: params(segment, []apiParam{
+				{name: "dataset", desc: "default pageviews", enum: exportDatasets},
+				{name: "format", enum: sortedKeys(exportTypes)},
+				{name: "gzip", typ: "boolean"},
+				{name: "include_ip", typ: "boolean", desc: "export IP addresses unmasked (admin only)"},
+				{name: "dimension", desc: "breakdown dimension", enum: dimensions},
+				{name: "pivot", enum: dimensions},
+				metric,
+			}),
+			media: append(sortedValues(exportTypes), "application/gzip"), role: roleAnalyst, scope: scopeReadRaw},
+		{method: "GET", path: "/api/analytics/goals", summary: "Conversions of every goal",
+			params: segment, response: api.GoalsResult{}},
+		{method: "GET", path: "/api/analytics/funnels/{id}", summary: "Visitors reaching each step of a funnel",
+			params: params([]apiParam{id}, segment), response: api.FunnelResult{}},
+		{method: "GET", path: "/api/admin/goals", summary: "List goals", response: []api.Goal{}},
+		{method: "POST", path: "/api/admin/goals", summary: "Create a goal",
+			body: api.Goal{}, response: api.Goal{}, status: "201", role: roleAnalyst, scope: scopeAdmin},
+		{method: "DELETE", path: "/api/admin/goals/{id}", summary: "Delete a goal",
+			params: []apiParam{id}, status: "204", role: roleAnalyst, scope: scopeAdmin},
+		{method: "GET", path: "/api/admin/funnels", summary: "List funnels", response: []api.Funnel{}},
+		{method: "POST", path: "/api/admin/funnels", summary: "Create a funnel",
+			body: api.Funnel{}, response: api.Funnel{}, status: "201", role: roleAnalyst, scope: scopeAdmin},
+		{method: "DELETE", path: "/api/admin/funnels/{id}", summary: "Delete a funnel",
+			params: []apiParam{id}, status: "204", role: roleAnalyst, scope: scopeAdmin},
+		{method: "POST", path: "/api/admin/backup", summary: "Snapshot the database",
+			response: api.BackupResult{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "POST", path: "/api/admin/purge", summary: "Apply the retention policy now",
+			params:   []apiParam{{name: "dry_run", typ: "boolean", desc: "only count what would be removed"}},
+			response: api.PurgeReport{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "GET", path: "/api/admin/keys", summary: "List API keys, without their secrets",
+			response: []api.APIKey{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "POST", path: "/api/admin/keys", summary: "Create an API key; the response holds its only copy",
+			body: api.APIKey{}, response: api.APIKey{}, status: "201", role: roleAdmin, scope: scopeAdmin},
+		{method: "DELETE", path: "/api/admin/keys/{id}", summary: "Revoke an API key",
+			params: []apiParam{id}, status: "204", role: roleAdmin, scope: scopeAdmin},
+		{method: "GET", path: "/api/admin/shares", summary: "List public share links with their URLs",
+			response: []api.ShareLink{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "POST", path: "/api/admin/shares", summary: "Create a public share link",
+			body: api.ShareLink{}, response: api.ShareLink{}, status: "201", role: roleAdmin, scope: scopeAdmin},
+		{method: "DELETE", path: "/api/admin/shares/{id}", summary: "Revoke a share link",
+			params: []apiParam{id}, status: "204", role: roleAdmin, scope: scopeAdmin},
+		{method: "GET", path: "/api/share/{token}/stats",
+			summary:  "The stats a share link exposes; rows seen by fewer than min_visitors visitors fold into Other and such time buckets read zero",
+			params:   params([]apiParam{{name: "token", in: "path", required: true}}, rangeParams()),
+			response: api.SharedStats{}, public: true},
+		{method: "GET", path: "/api/public/stats",
+			summary:  "Differentially private totals and top pages of the last complete UTC day, week or month; served with -public-stats",
+			params:   []apiParam{{name: "period", desc: "default week", enum: publicPeriods}},
+			response: api.PublicStats{}, public: true},
+		{method: "GET", path: "/api/admin/audit", summary: "Audit log of authenticated requests and admin actions, newest first; the whole log unless preset, from or period is given",
+			params: params(rangeParams(), []apiParam{
+				{name: "principal", desc: "only entries by this username, key:<name>, cli:<user> or system"},
+				{name: "action", desc: "only this action, e.g. request, purge, export, key.create or login.failed"},
+				{name: "before", typ: "integer", desc: "only entries older than this ID, for paging"},
+				{name: "limit", typ: "integer", desc: "1-1000, default 100"},
+			}),
+			response: api.AuditPage{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "GET", path: "/api/admin/audit/verify", summary: "Check the audit log's hash chain",
+			response: api.AuditVerification{}, role: roleAdmin, scope: scopeAdmin},
+		{method: "GET", path: "/api/me", summary: "The signed-in user, or key:<name> for an API key",
+			response: api.User{}, scope: "*"},
+		{method: "GET", path: "/api/openapi.json", summary: "This document",
+			media: []string{"application/json"}, public: true},
+		{method: "GET", path: "/healthz", summary: "Liveness: answers ok whenever the process is running",
+			media: []string{"text/plain"}, public: true},
+		{method: "GET", path: "/readyz", summary: "Readiness: database writable, migrations current, GeoIP loaded if configured and aggregation running; 503 with the failing checks otherwise",
+			response: api.Readiness{}, public: true},
+		{method: "GET", path: "/version", summary: "Module version and VCS revision of the running binary",
+			response: api.BuildInfo{}, public: true},
+	}
+}
+
+func sortedValues(m map[string]string) []string {
+	var values []string
+	for _, k := range sortedKeys(m) {
+		values = append(values, m[k])
+	}
+	return values
+}
+
+// schemaGen reflects JSON schemas for Go types, collecting named structs
+// as components.
+type schemaGen struct {
+	components map[string]any
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := g.components[t.Name()]; ok {
+			return ref
+		}
+		g.components[t.Name()] = nil // placeholder while recursing
+		obj := map[string]any{"type": "object"}
+		props := map[string]any{}
+		var required []string
+		g.fields(t, props, &required, true)
+		obj["properties"] = props
+		if len(required) > 0 {
+			sort.Strings(required)
+			obj["required"] = required
+		}
+		g.components[t.Name()] = obj
+		return ref
+	}
+	return map[string]any{}
+}
+
+// fields adds t's JSON fields to props, flattening embedded structs as
+// encoding/json does. Fields reached through an embedded pointer, or
+// tagged omitempty, are optional.
+func (g *schemaGen) fields(t reflect.Type, props map[string]any, required *[]string, mandatory bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				g.fields(ft.Elem(), props, required, false)
+			} else {
+				g.fields(ft, props, required, mandatory)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if mandatory && !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+var errorResponse = map[string]any{
+	"description": "error message",
+	"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+}
+
+// OpenAPIDocument builds the OpenAPI 3 description of the API.
+func OpenAPIDocument() map[string]any {
+	g := &schemaGen{components: map[string]any{}}
+	paths := map[string]any{}
+	for _, op := range apiOperations() {
+		o := map[string]any{
+			"summary":     op.summary,
+			"operationId": operationID(op),
+		}
+		var ps []any
+		for _, p := range op.params {
+			in := p.in
+			if in == "" {
+				in = "query"
+			}
+			typ := p.typ
+			if typ == "" {
+				typ = "string"
+			}
+			s := map[string]any{"type": typ}
+			if len(p.enum) > 0 {
+				s["enum"] = p.enum
+			}
+			param := map[string]any{"name": p.name, "in": in, "schema": s, "required": p.required}
+			if p.desc != "" {
+				param["description"] = p.desc
+			}
+			ps = append(ps, param)
+		}
+		if len(ps) > 0 {
+			o["parameters"] = ps
+		}
+		if op.body != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.body))}},
+			}
+		}
+
+		status := op.status
+		if status == "" {
+			status = "200"
+		}
+		success := map[string]any{"description": "success"}
+		switch {
+		case op.response != nil:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.response))}}
+		case len(op.media) > 0:
+			content := map[string]any{}
+			for _, m := range op.media {
+				content[m] = map[string]any{}
+			}
+			success["content"] = content
+		}
+		responses := map[string]any{status: success, "default": errorResponse}
+		if op.public {
+			o["security"] = []any{}
+		} else {
+			role := op.role
+			if role == "" {
+				role = roleViewer
+			}
+			who := "the " + role + " role"
+			if role != roleAdmin {
+				who += " or higher"
+			}
+			switch op.scope {
+			case "*":
+				who += ", or any API key"
+			case "":
+				who += ", or an API key with the " + scopeReadStats + " scope"
+			default:
+				who += ", or an API key with the " + op.scope + " scope"
+			}
+			o["description"] = "Requires " + who + "."
+			responses["401"] = errorResponse
+			responses["403"] = errorResponse
+		}
+		o["responses"] = responses
+
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "noblemind-console API",
+			"version": api.Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer",
+					"description": "An API key (" + apiKeyPrefix + "...) or the server's legacy -token"},
+			},
+		},
+		"security": []any{map[string]any{"session": []any{}}, map[string]any{"bearer": []any{}}},
+	}
+}
+
+// operationID derives a stable id such as getAnalyticsStats or
+// deleteAdminGoalsById from the route.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.method)
+	for _, part := range strings.Split(strings.TrimSuffix(op.path, ".json"), "/") {
+		if part == "" || part == "api" {
+			continue
+		}
+		if strings.HasPrefix(part, "{") {
+			part = "by_" + strings.Trim(part, "{}")
+		}
+		for _, w := range strings.Split(part, "_") {
+			if w != "" {
+				id += strings.ToUpper(w[:1]) + w[1:]
+			}
+		}
+	}
+	return id
+}
+
+var openAPI struct {
+	once sync.Once
+	doc  []byte
+}
+
+// handleOpenAPI serves the OpenAPI document at /api/openapi.json.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPI.once.Do(func() {
+		openAPI.doc, _ = json.MarshalIndent(OpenAPIDocument(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI.doc)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// routeRecorder records the patterns SetupRoutes registers.
+type routeRecorder map[string]bool
+
+func (r routeRecorder) HandleFunc(pattern string, _ func(http.ResponseWriter, *http.Request)) {
+	r[pattern] = true
+}
+
+// undocumentedRoutes are registered but deliberately left out of the
+// OpenAPI document: pages, sign-in redirects, the beacon's CORS preflight
+// and the Prometheus endpoint.
+var undocumentedRoutes = []string{
+	"/api/analytics/event",
+	"GET /login",
+	"POST /login",
+	"POST /logout",
+	"GET /auth/oidc/login",
+	"GET /auth/oidc/callback",
+	"GET /share/{token}",
+	"GET /console",
+	"GET /console/",
+	"GET /metrics",
+}
+
+// TestOpenAPICoversRoutes checks that every route SetupRoutes registers is
+// documented by apiOperations, and that every documented operation is
+// registered.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	// Register the optional routes too
+	defer func(issuer string, public bool, addr, token string) {
+		oidcCfg.Issuer, publicCfg.Enabled, metricsAddr, metricsToken = issuer, public, addr, token
+	}(oidcCfg.Issuer, publicCfg.Enabled, metricsAddr, metricsToken)
+	oidcCfg.Issuer, publicCfg.Enabled, metricsAddr, metricsToken = "https://idp.example", true, "", "secret"
+
+	routes := routeRecorder{}
+	SetupRoutes(routes)
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations() {
+		pattern := op.method + " " + op.path
+		if documented[pattern] {
+			t.Errorf("%s is documented twice", pattern)
+		}
+		documented[pattern] = true
+		if !routes[pattern] {
+			t.Errorf("%s is documented but not registered", pattern)
+		}
+	}
+
+	skip := map[string]bool{}
+	for _, pattern := range undocumentedRoutes {
+		skip[pattern] = true
+		if !routes[pattern] {
+			t.Errorf("%s is listed as undocumented but not registered", pattern)
+		}
+	}
+	for pattern := range routes {
+		if !documented[pattern] && !skip[pattern] {
+			t.Errorf("%s is registered but missing from apiOperations", pattern)
+		}
+	}
+}
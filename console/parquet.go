@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A minimal Parquet writer for exports: flat schemas of required INT64 and
+// UTF-8 BYTE_ARRAY columns, PLAIN encoding, one data page per column per
+// row group, optionally GZIP-compressed. Rows are buffered one row group at
+// a time, so memory stays bounded however large the export.
+
+const (
+	parquetRowGroupRows = 32768
+
+	parquetInt64     = 2 // Type.INT64
+	parquetByteArray = 6 // Type.BYTE_ARRAY
+	parquetUTF8      = 0 // ConvertedType.UTF8
+	parquetRequired  = 0 // FieldRepetitionType.REQUIRED
+	parquetPlain     = 0 // Encoding.PLAIN
+	parquetRLE       = 3 // Encoding.RLE
+	parquetDataPage  = 0 // PageType.DATA_PAGE
+
+	parquetUncompressed = 0 // CompressionCodec.UNCOMPRESSED
+	parquetGzip         = 2 // CompressionCodec.GZIP
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn describes one column: its name and whether it holds
+// int64 values (otherwise strings).
+type parquetColumn struct {
+	name  string
+	isInt bool
+}
+
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetWriter writes rows as a Parquet file to w. Close must be called
+// to write the footer.
+type parquetWriter struct {
+	w      io.Writer
+	cols   []parquetColumn
+	codec  int32
+	offset int64
+
+	rows    int
+	buffers []bytes.Buffer // PLAIN-encoded values of the pending row group
+	groups  []parquetRowGroup
+	total   int64
+}
+
+func newParquetWriter(w io.Writer, cols []parquetColumn, compress bool) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w, cols: cols, buffers: make([]bytes.Buffer, len(cols))}
+	if compress {
+		pw.codec = parquetGzip
+	}
+	return pw, pw.write(parquetMagic)
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// WriteRow appends one row; values must be int64 or string to match cols.
+func (pw *parquetWriter) WriteRow(values []any) error {
+	if len(values) != len(pw.cols) {
+		return errors.New("parquet: wrong number of values")
+	}
+	for i, v := range values {
+		buf := &pw.buffers[i]
+		if pw.cols[i].isInt {
+			n, _ := v.(int64)
+			binary.Write(buf, binary.LittleEndian, n)
+		} else {
+			s, _ := v.(string)
+			binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+			buf.WriteString(s)
+		}
+	}
+	pw.rows++
+	if pw.rows >= parquetRowGroupRows {
+		return pw.flush()
+	}
+	return nil
+}
+
+// flush writes the pending rows as a row group.
+func (pw *parquetWriter) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(pw.rows)}
+	for i := range pw.cols {
+		data := pw.buffers[i].Bytes()
+		page := data
+		if pw.codec == parquetGzip {
+			var zb bytes.Buffer
+			zw := gzip.NewWriter(&zb)
+			zw.Write(data)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			page = zb.Bytes()
+		}
+
+		var h thriftWriter
+		h.begin()
+		h.fieldI32(1, parquetDataPage)
+		h.fieldI32(2, int32(len(data)))
+		h.fieldI32(3, int32(len(page)))
+		h.fieldStruct(5)
+		h.fieldI32(1, int32(pw.rows))
+		h.fieldI32(2, parquetPlain)
+		h.fieldI32(3, parquetRLE)
+		h.fieldI32(4, parquetRLE)
+		h.stop()
+		h.stop()
+
+		chunk := parquetChunk{
+			offset:           pw.offset,
+			uncompressedSize: int64(h.buf.Len() + len(data)),
+			compressedSize:   int64(h.buf.Len() + len(page)),
+		}
+		if err := pw.write(h.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		pw.buffers[i].Reset()
+	}
+	pw.groups = append(pw.groups, group)
+	pw.total += int64(pw.rows)
+	pw.rows = 0
+	return nil
+}
+
+// Close flushes pending rows and writes the file footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var m thriftWriter
+	m.begin()
+	m.fieldI32(1, 1) // version
+	m.fieldList(2, thriftStruct, len(pw.cols)+1)
+	m.begin()
+	m.fieldString(4, "schema")
+	m.fieldI32(5, int32(len(pw.cols)))
+	m.stop()
+	for _, c := range pw.cols {
+		m.begin()
+		if c.isInt {
+			m.fieldI32(1, parquetInt64)
+		} else {
+			m.fieldI32(1, parquetByteArray)
+		}
+		m.fieldI32(3, parquetRequired)
+		m.fieldString(4, c.name)
+		if !c.isInt {
+			m.fieldI32(6, parquetUTF8)
+		}
+		m.stop()
+	}
+	m.fieldI64(3, pw.total)
+	m.fieldList(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		m.begin()
+		m.fieldList(1, thriftStruct, len(g.chunks))
+		var size int64
+		for i, ch := range g.chunks {
+			c := pw.cols[i]
+			m.begin()
+			m.fieldI64(2, ch.offset)
+			m.fieldStruct(3)
+			if c.isInt {
+				m.fieldI32(1, parquetInt64)
+			} else {
+				m.fieldI32(1, parquetByteArray)
+			}
+			m.fieldList(2, thriftI32, 2)
+			m.i32(parquetPlain)
+			m.i32(parquetRLE)
+			m.fieldList(3, thriftBinary, 1)
+			m.string(c.name)
+			m.fieldI32(4, pw.codec)
+			m.fieldI64(5, g.rows)
+			m.fieldI64(6, ch.uncompressedSize)
+			m.fieldI64(7, ch.compressedSize)
+			m.fieldI64(9, ch.offset)
+			m.stop()
+			m.stop()
+			size += ch.uncompressedSize
+		}
+		m.fieldI64(2, size)
+		m.fieldI64(3, g.rows)
+		m.stop()
+	}
+	m.fieldString(6, "noblemind-console")
+	m.stop()
+
+	footer := m.buf.Bytes()
+	if err := pw.write(footer); err != nil {
+		return err
+	}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(footer)))
+	if err := pw.write(n[:]); err != nil {
+		return err
+	}
+	return pw.write(parquetMagic)
+}
+
+// thriftWriter encodes the Thrift compact protocol used by Parquet
+// metadata. Every struct, including list elements, is opened with begin
+// (or fieldStruct) and closed with stop; field ids are delta-encoded
+// against the previous field of the same struct.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // last field id of each open struct, innermost last
+}
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+// begin opens a struct.
+func (t *thriftWriter) begin() { t.last = append(t.last, 0) }
+
+// stop closes the innermost struct.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(uint64(uint16((id << 1) ^ (id >> 15))))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(v int32) { t.varint(uint64(uint32((v << 1) ^ (v >> 31)))) }
+func (t *thriftWriter) i64(v int64) { t.varint(uint64((v << 1) ^ (v >> 63))) }
+
+func (t *thriftWriter) string(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) { t.field(id, thriftI32); t.i32(v) }
+func (t *thriftWriter) fieldI64(id int16, v int64) { t.field(id, thriftI64); t.i64(v) }
+
+func (t *thriftWriter) fieldString(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.string(s)
+}
+
+// fieldStruct opens a nested struct field.
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// fieldList writes the header of a list field of n elements of type elem;
+// the elements follow.
+func (t *thriftWriter) fieldList(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes the Thrift compact protocol into generic values:
+// structs as maps keyed by field id, lists as []any, integers as int64 and
+// binaries as string.
+type thriftReader struct {
+	b   []byte
+	err error
+}
+
+func (r *thriftReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.b = nil
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.fail("thrift: unexpected end")
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail("thrift: bad varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := r.varint()
+		if uint64(len(r.b)) < n {
+			r.fail("thrift: binary of %d bytes past the end", n)
+			return ""
+		}
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case thriftList:
+		h := r.byte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = r.varint()
+		}
+		if n > uint64(len(r.b)) {
+			r.fail("thrift: list of %d past the end", n)
+			return nil
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	r.fail("thrift: unexpected type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	s := map[int16]any{}
+	var id int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+		s[id] = r.value(h & 0x0f)
+	}
+	return s
+}
+
+// parquetFile is a Parquet file as decoded by readParquet.
+type parquetFile struct {
+	cols   []parquetColumn
+	rows   [][]any // int64 or string values, by row
+	groups int
+	codec  int64
+}
+
+// readParquet decodes a file written by parquetWriter, checking its footer
+// against the pages it describes.
+func readParquet(t *testing.T, data []byte) parquetFile {
+	t.Helper()
+	n := len(data)
+	if n < 12 || string(data[:4]) != "PAR1" || string(data[n-4:]) != "PAR1" {
+		t.Fatalf("no PAR1 magic around %d bytes", n)
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[n-8:]))
+	if footerLen > n-12 {
+		t.Fatalf("footer of %d bytes in a file of %d", footerLen, n)
+	}
+	r := &thriftReader{b: data[n-8-footerLen : n-8]}
+	meta := r.structure()
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("footer: %v, %d bytes left", r.err, len(r.b))
+	}
+	if meta[1] != int64(1) || meta[6] != "noblemind-console" {
+		t.Errorf("version %v, created by %v", meta[1], meta[6])
+	}
+
+	var f parquetFile
+	schema, _ := meta[2].([]any)
+	if len(schema) == 0 {
+		t.Fatalf("no schema: %v", meta)
+	}
+	if root, _ := schema[0].(map[int16]any); root[4] != "schema" || root[5] != int64(len(schema)-1) {
+		t.Errorf("schema root %v", root)
+	}
+	for _, e := range schema[1:] {
+		e, _ := e.(map[int16]any)
+		name, _ := e[4].(string)
+		c := parquetColumn{name: name, isInt: e[1] == int64(parquetInt64)}
+		if e[3] != int64(parquetRequired) ||
+			c.isInt && e[6] != nil ||
+			!c.isInt && (e[1] != int64(parquetByteArray) || e[6] != int64(parquetUTF8)) {
+			t.Errorf("schema element %v", e)
+		}
+		f.cols = append(f.cols, c)
+	}
+
+	groups, _ := meta[4].([]any)
+	f.groups = len(groups)
+	for g, group := range groups {
+		group, _ := group.(map[int16]any)
+		chunks, _ := group[1].([]any)
+		rows, _ := group[3].(int64)
+		if len(chunks) != len(f.cols) {
+			t.Fatalf("row group %d: %d column chunks for %d columns", g, len(chunks), len(f.cols))
+		}
+		first := len(f.rows)
+		for range rows {
+			f.rows = append(f.rows, make([]any, len(f.cols)))
+		}
+		var size int64
+		for i, chunk := range chunks {
+			chunk, _ := chunk.(map[int16]any)
+			md, _ := chunk[3].(map[int16]any)
+			c := f.cols[i]
+			if g == 0 && i == 0 {
+				f.codec, _ = md[4].(int64)
+			}
+			wantType := int64(parquetByteArray)
+			if c.isInt {
+				wantType = parquetInt64
+			}
+			if md[1] != wantType || md[4] != f.codec || md[5] != rows ||
+				!reflect.DeepEqual(md[2], []any{int64(parquetPlain), int64(parquetRLE)}) ||
+				!reflect.DeepEqual(md[3], []any{c.name}) {
+				t.Fatalf("row group %d, column %s: metadata %v", g, c.name, md)
+			}
+			offset, _ := md[9].(int64)
+			if chunk[2] != offset || offset < 4 || offset >= int64(n-8-footerLen) {
+				t.Fatalf("row group %d, column %s: page at %v, chunk at %v", g, c.name, offset, chunk[2])
+			}
+
+			r := &thriftReader{b: data[offset : n-8-footerLen]}
+			h := r.structure()
+			header := int64(n-8-footerLen) - offset - int64(len(r.b))
+			dp, _ := h[5].(map[int16]any)
+			uncompressed, _ := h[2].(int64)
+			compressed, _ := h[3].(int64)
+			if r.err != nil || h[1] != int64(parquetDataPage) || dp[1] != rows || dp[2] != int64(parquetPlain) ||
+				md[6] != header+uncompressed || md[7] != header+compressed || compressed > int64(len(r.b)) {
+				t.Fatalf("row group %d, column %s: page header %v, %v; metadata %v", g, c.name, h, r.err, md)
+			}
+			size += header + uncompressed
+
+			page := r.b[:compressed]
+			if f.codec == parquetGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(page))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if int64(len(page)) != uncompressed {
+				t.Fatalf("row group %d, column %s: page of %d bytes, header says %d", g, c.name, len(page), uncompressed)
+			}
+			for j := range rows {
+				var v any
+				if c.isInt {
+					if len(page) < 8 {
+						t.Fatalf("row group %d, column %s: page ends at value %d", g, c.name, j)
+					}
+					v, page = int64(binary.LittleEndian.Uint64(page)), page[8:]
+				} else {
+					if len(page) < 4 || uint64(len(page)-4) < uint64(binary.LittleEndian.Uint32(page)) {
+						t.Fatalf("row group %d, column %s: page ends at value %d", g, c.name, j)
+					}
+					l := 4 + int(binary.LittleEndian.Uint32(page))
+					v, page = string(page[4:l]), page[l:]
+				}
+				f.rows[first+int(j)][i] = v
+			}
+			if len(page) != 0 {
+				t.Errorf("row group %d, column %s: %d bytes after the values", g, c.name, len(page))
+			}
+		}
+		if group[2] != size {
+			t.Errorf("row group %d: total size %v, want %d", g, group[2], size)
+		}
+	}
+	if meta[3] != int64(len(f.rows)) {
+		t.Errorf("%v rows in the footer, %d in the row groups", meta[3], len(f.rows))
+	}
+	return f
+}
+
+// exportBytes runs the export described by q and returns what it wrote.
+func exportBytes(t *testing.T, q url.Values) []byte {
+	t.Helper()
+	e, err := parseExport(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, cols, err := openExport(context.Background(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := writeExport(&b, e, rows, cols); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// TestParquetExports decodes each dataset's Parquet export, plain and
+// gzipped, and checks it against the CSV export of the same rows.
+func TestParquetExports(t *testing.T) {
+	openTestDB(t)
+	withMinVisitors(t, 1)
+	InsertPageView("/café", "https://example.com/", "v1", "203.0.113.7", "GB", "England", "Leeds", "Desktop", "Firefox", "Linux", "1920x1080")
+	InsertPageView("/pricing", "", "v1", "", "", "", "", "Desktop", "Firefox", "Linux", "")
+	InsertPageView("/", "", "v2", "2001:db8::1", "FR", "", "", "Mobile", "Safari", "iOS", "")
+	InsertEvent("signup", "v1", `{"plan":"pro"}`)
+	InsertEvent("signup", "v2", "")
+
+	today := time.Now().UTC().Format("2006-01-02")
+	tests := []struct {
+		query string
+		rows  int
+		check func(cols []parquetColumn, rows [][]any) bool
+	}{
+		{"dataset=pageviews", 3, func(cols []parquetColumn, rows [][]any) bool {
+			return len(cols) == 13 && rows[0][2] == "/café" && rows[0][5] == "203.0.113.0" &&
+				rows[1][3] == "" && rows[1][5] == "" && rows[2][5] == "2001:db8::"
+		}},
+		{"dataset=events", 2, func(cols []parquetColumn, rows [][]any) bool {
+			return len(cols) == 5 && rows[0][4] == `{"plan":"pro"}` && rows[1][4] == ""
+		}},
+		{"dataset=sessions", 2, func(cols []parquetColumn, rows [][]any) bool {
+			byVisitor := map[any][]any{rows[0][0]: rows[0], rows[1][0]: rows[1]}
+			v1 := byVisitor["v1"]
+			return len(cols) == 12 && v1 != nil && v1[4] == int64(2) && v1[5] == "/café" && v1[6] == "/pricing"
+		}},
+		{"dataset=breakdown&dimension=browser&pivot=os&metric=visitors", 2, func(cols []parquetColumn, rows [][]any) bool {
+			return len(cols) == 3 && cols[2] == parquetColumn{"visitors", true} &&
+				reflect.DeepEqual(rows[0], []any{"Firefox", "Linux", int64(1)})
+		}},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		q.Set("from", today)
+		q.Set("to", today)
+		q.Set("format", "csv")
+		records, err := csv.NewReader(bytes.NewReader(exportBytes(t, q))).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+
+		q.Set("format", "parquet")
+		for _, compress := range []bool{false, true} {
+			q.Set("gzip", strconv.FormatBool(compress))
+			name := fmt.Sprintf("%s, gzip %v", tt.query, compress)
+			f := readParquet(t, exportBytes(t, q))
+
+			if want := map[bool]int64{false: parquetUncompressed, true: parquetGzip}[compress]; f.codec != want {
+				t.Errorf("%s: codec %d, want %d", name, f.codec, want)
+			}
+			if len(f.rows) != tt.rows || f.groups != 1 {
+				t.Fatalf("%s: %d rows in %d row groups, want %d in 1", name, len(f.rows), f.groups, tt.rows)
+			}
+			if !tt.check(f.cols, f.rows) {
+				t.Errorf("%s: columns %v, rows %v", name, f.cols, f.rows)
+			}
+			got := [][]string{{}}
+			for _, c := range f.cols {
+				got[0] = append(got[0], c.name)
+			}
+			for _, row := range f.rows {
+				var record []string
+				for _, v := range row {
+					record = append(record, fmt.Sprint(v))
+				}
+				got = append(got, record)
+			}
+			if !reflect.DeepEqual(got, records) {
+				t.Errorf("%s: Parquet %v, CSV %v", name, got, records)
+			}
+		}
+	}
+}
+
+// TestParquetNulls checks that NULLs, which the schema refuses but a
+// hand-edited database may hold, are exported as zero values.
+func TestParquetNulls(t *testing.T) {
+	openTestDB(t)
+	rows, err := db.Query(`SELECT 1, 'a' UNION ALL SELECT NULL, NULL UNION ALL SELECT 3, ''`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	cols := []parquetColumn{{"n", true}, {"s", false}}
+	if n, err := writeExport(&b, Export{Format: "parquet"}, rows, cols); n != 3 || err != nil {
+		t.Fatalf("export: %d rows, %v", n, err)
+	}
+	f := readParquet(t, b.Bytes())
+	want := [][]any{{int64(1), "a"}, {int64(0), ""}, {int64(3), ""}}
+	if !reflect.DeepEqual(f.rows, want) {
+		t.Errorf("rows %v, want %v", f.rows, want)
+	}
+}
+
+// TestParquetRowGroups writes one row more than a row group holds and
+// checks that it starts a second group.
+func TestParquetRowGroups(t *testing.T) {
+	var b bytes.Buffer
+	pw, err := newParquetWriter(&b, []parquetColumn{{"n", true}, {"s", false}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := parquetRowGroupRows + 1
+	for i := range total {
+		if err := pw.WriteRow([]any{int64(i), strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f := readParquet(t, b.Bytes())
+	if f.groups != 2 || len(f.rows) != total {
+		t.Fatalf("%d rows in %d row groups, want %d in 2", len(f.rows), f.groups, total)
+	}
+	for i, row := range f.rows {
+		if row[0] != int64(i) || row[1] != strconv.Itoa(i) {
+			t.Fatalf("row %d: %v", i, row)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionMonthly stores page_views and events in one table per month
+// (page_views_202610, ...) behind UNION ALL views of the original names.
+// Reads are unchanged; purging an old month becomes a DROP TABLE.
+var partitionMonthly bool
+
+var partitions = struct {
+	sync.Mutex
+	current map[string]string // base table -> partition for the current month
+}{current: make(map[string]string)}
+
+var rawColumns = map[string]string{
+	"page_views": pageViewsColumns,
+	"events":     eventsColumns,
+}
+
+func partitionName(table string, t time.Time) string {
+	return table + "_" + t.UTC().Format("200601")
+}
+
+// setupPartitions converts between the plain and partitioned layouts so the
+// database matches the partitionMonthly setting. A partitioned database
+// cannot go back, so opening one turns the setting on: CLI commands, which
+// have no -partition-monthly flag, work on it as the server does.
+func setupPartitions() error {
+	if !partitionMonthly && isView("page_views") {
+		partitionMonthly = true
+	}
+	for _, table := range []string{"page_views", "events"} {
+		view := isView(table)
+		switch {
+		case partitionMonthly && !view:
+			if err := partitionTable(table); err != nil {
+				return fmt.Errorf("partition %s: %w", table, err)
+			}
+		case !partitionMonthly && view:
+			return fmt.Errorf("%s is partitioned by month; start with -partition-monthly", table)
+		}
+		if partitionMonthly {
+			if err := updatePartitions(table); err != nil {
+				return err
+			}
+			if _, err := insertTable(table); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updatePartitions brings partitions made by older versions up to date:
+// indexes added since, and ids offset per month.
+func updatePartitions(table string) error {
+	parts, err := listPartitions(db, table)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if err := createPartition(db, table, p); err != nil {
+			return fmt.Errorf("update partition %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func isView(name string) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'view' AND name = ?`, name).Scan(&n)
+	return n > 0
+}
+
+// partitionTable moves every row of a plain table into monthly partitions
+// and replaces the table with a view.
+func partitionTable(table string) error {
+	slog.Info("partitioning by month", "table", table)
+
+	rows, err := db.Query(`SELECT DISTINCT strftime('%Y%m', ts, 'unixepoch') FROM ` + table)
+	if err != nil {
+		return err
+	}
+	var months []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range months {
+		part := table + "_" + m
+		if err := createPartition(tx, table, part); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO `+part+` SELECT * FROM `+table+
+			` WHERE strftime('%Y%m', ts, 'unixepoch') = ?`, m); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE ` + table); err != nil {
+		return err
+	}
+	if err := createPartitionView(tx, table); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// listPartitions returns the partition tables of table, oldest first.
+func listPartitions(q dbtx, table string) ([]string, error) {
+	rows, err := q.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name GLOB ?`,
+		table+"_[0-9][0-9][0-9][0-9][0-9][0-9]")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
+// createPartition creates one monthly partition of table with its indexes,
+// if it does not exist, and starts its ids at partitionIDBase.
+func createPartition(tx dbtx, table, part string) error {
+	stmts := append([]string{`CREATE TABLE IF NOT EXISTS ` + part + ` (` + rawColumns[table] + `)`}, rawIndexes(part)...)
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	base := partitionIDBase(part)
+	if _, err := tx.Exec(`UPDATE sqlite_sequence SET seq = ? WHERE name = ? AND seq < ?`, base, part, base); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = ?)`, part, base, part)
+	return err
+}
+
+// partitionIDBase is the id after which a partition numbers its rows:
+// the month counted from year 0, shifted 32 bits. Each partition has its
+// own AUTOINCREMENT counter, so without an offset ids would repeat across
+// months of the view. Ids stay below 2^53, so JSON clients read them
+// exactly. Rows moved in when a table is first partitioned keep their ids,
+// which are all below any base.
+func partitionIDBase(part string) int64 {
+	month, _ := strconv.Atoi(part[len(part)-6:])
+	return int64(month/100*12+month%100-1) << 32
+}
+
+// createPartitionView (re)creates the UNION ALL view named table over its
+// partitions.
+func createPartitionView(tx dbtx, table string) error {
+	parts, err := listPartitions(tx, table)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DROP VIEW IF EXISTS ` + table); err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		// A view needs at least one source; create this month's partition
+		part := partitionName(table, time.Now())
+		if err := createPartition(tx, table, part); err != nil {
+			return err
+		}
+		parts = []string{part}
+	}
+
+	selects := make([]string, len(parts))
+	for i, p := range parts {
+		selects[i] = `SELECT * FROM ` + p
+	}
+	_, err = tx.Exec(`CREATE VIEW ` + table + ` AS ` + strings.Join(selects, " UNION ALL "))
+	return err
+}
+
+// insertTable returns the table new rows of table should be written to,
+// creating the current month's partition on first use.
+func insertTable(table string) (string, error) {
+	if !partitionMonthly {
+		return table, nil
+	}
+	part := partitionName(table, time.Now())
+
+	partitions.Lock()
+	defer partitions.Unlock()
+	if partitions.current[table] == part {
+		return part, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := createPartition(tx, table, part); err != nil {
+		return "", fmt.Errorf("create partition %s: %w", part, err)
+	}
+	if err := createPartitionView(tx, table); err != nil {
+		return "", fmt.Errorf("create partition view %s: %w", table, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	partitions.current[table] = part
+	return part, nil
+}
+
+// rawTables returns the physical tables of table that may hold rows older
+// than before: the table itself, or its partitions starting before before.
+func rawTables(table string, before int64) []string {
+	if !partitionMonthly {
+		return []string{table}
+	}
+	parts, err := listPartitions(db, table)
+	if err != nil {
+		slog.Error("list partitions", "table", table, "err", err)
+		return nil
+	}
+	cutoff := partitionName(table, time.Unix(before, 0))
+	var out []string
+	for _, p := range parts {
+		if p <= cutoff {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// dropPartitionsBefore drops partitions of table whose whole month lies
+// before the cutoff and returns how many rows they held.
+func dropPartitionsBefore(table string, before int64) (int64, error) {
+	if !partitionMonthly {
+		return 0, nil
+	}
+
+	partitions.Lock()
+	defer partitions.Unlock()
+
+	parts, err := listPartitions(db, table)
+	if err != nil {
+		return 0, err
+	}
+	// The partition containing the cutoff is only partly expired
+	boundary := partitionName(table, time.Unix(before, 0))
+
+	var dropped int64
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, p := range parts {
+		if p >= boundary {
+			continue
+		}
+		var n int64
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM ` + p).Scan(&n); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DROP TABLE ` + p); err != nil {
+			return 0, err
+		}
+		dropped += n
+		slog.Info("purge: dropped partition", "partition", p, "rows", n)
+	}
+	if err := createPartitionView(tx, table); err != nil {
+		return 0, err
+	}
+	return dropped, tx.Commit()
+}
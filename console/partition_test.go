@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCLIOpensPartitionedDatabase opens a database partitioned by the
+// server through CLI commands, which have no -partition-monthly flag.
+func TestCLIOpensPartitionedDatabase(t *testing.T) {
+	defer func(monthly bool) { partitionMonthly = monthly }(partitionMonthly)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "analytics.db")
+
+	partitionMonthly = true
+	if err := initDB(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertPageView("/", "", "v1", "", "", "", "", "Desktop", "Firefox", "Linux", ""); err != nil {
+		t.Fatal(err)
+	}
+	closeDB()
+
+	partitionMonthly = false
+	cmdUser([]string{"list", "-db", path})
+	cmdBackup([]string{"-db", path, "-out", filepath.Join(dir, "backups")})
+	if !partitionMonthly {
+		t.Error("opening a partitioned database left partitionMonthly off")
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "backups", backupPrefix+"*.db"))
+	if len(snapshots) != 1 {
+		t.Fatalf("backup wrote %d snapshots, want 1", len(snapshots))
+	}
+	if fi, err := os.Stat(snapshots[0]); err != nil || fi.Size() == 0 {
+		t.Errorf("empty snapshot: %v", err)
+	}
+}
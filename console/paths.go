@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionViews returns a CTE named nav over the page views in [from, to)
+// within the segment f, ordered per visitor. Consecutive views of the same
+// page in a session (reloads) are collapsed to one. Each row has its path,
+// whether it starts or ends a session (visits are split on sessionGap, as
+// for the sessions metric), the next two paths in the same session and its
+// visitor.
+func sessionViews(f Filter, from, to int64) (string, []any) {
+	fw, fargs := f.where("page_views", from, to)
+	gap := int64(sessionGap.Seconds())
+	cte := `
+		base AS (
+			SELECT id, ts, path, visitor_hash,
+				LAG(ts) OVER w AS prev_ts, LAG(path) OVER w AS prev_path
+			FROM page_views WHERE ts >= ? AND ts < ?` + fw + `
+			WINDOW w AS (PARTITION BY visitor_hash ORDER BY ts, id)
+		),
+		dedup AS (
+			SELECT id, ts, path, visitor_hash FROM base
+			WHERE prev_ts IS NULL OR ts - prev_ts > ? OR path != prev_path
+		),
+		seq AS (
+			SELECT path, ts, visitor_hash,
+				LAG(ts) OVER w AS prev_ts,
+				LEAD(ts) OVER w AS next_ts, LEAD(path) OVER w AS next_path,
+				LEAD(ts, 2) OVER w AS next2_ts, LEAD(path, 2) OVER w AS next2_path
+			FROM dedup
+			WINDOW w AS (PARTITION BY visitor_hash ORDER BY ts, id)
+		),
+		nav AS (
+			SELECT path, visitor_hash,
+				prev_ts IS NULL OR ts - prev_ts > ? AS is_entry,
+				next_ts IS NULL OR next_ts - ts > ? AS is_exit,
+				CASE WHEN next_ts - ts <= ? THEN next_path END AS next_path,
+				CASE WHEN next_ts - ts <= ? AND next2_ts - next_ts <= ? THEN next2_path END AS next2_path
+			FROM seq
+		)`
+	args := append([]any{from, to}, fargs...)
+	return cte, append(args, gap, gap, gap, gap, gap, gap)
+}
+
+// QueryPathsContext reports entry and exit pages, page-to-page transitions
+// and the most common three-page sequences over rng within the segment f.
+// If after is set, transitions are limited to those leaving pages with
+// that prefix. Each list holds at most limit entries. Entry and exit pages
+// of fewer than minVisitors visitors fold into "Other"; transitions and
+// sequences that few visitors followed are left out.
+func QueryPathsContext(ctx context.Context, rng TimeRange, f Filter, after string, limit int) (*PathsResult, error) {
+	from, to := rng.From.Unix(), rng.To.Unix()
+	nav, args := sessionViews(f, from, to)
+	withLimit := func(extra ...any) []any {
+		return append(append(append([]any{}, args...), extra...), limit)
+	}
+
+	result := &PathsResult{
+		From: rng.From.In(rng.Loc).Format(time.RFC3339),
+		To:   rng.To.In(rng.Loc).Format(time.RFC3339),
+	}
+	q := &statsQuery{ctx: ctx}
+	k := max(setting(&minVisitors), 1)
+
+	result.EntryPages = q.pathCounts(`WITH `+nav+`
+		SELECT CASE WHEN v >= ? THEN path ELSE ? END AS p, SUM(c) AS n FROM (
+			SELECT path, COUNT(*) AS c, COUNT(DISTINCT visitor_hash) AS v FROM nav WHERE is_entry GROUP BY path
+		) GROUP BY p ORDER BY n DESC, p LIMIT ?`, withLimit(k, otherBucket)...)
+
+	result.ExitPages = q.pathCounts(`WITH `+nav+`
+		SELECT CASE WHEN v >= ? THEN path ELSE ? END AS p, SUM(c) AS n FROM (
+			SELECT path, COUNT(*) AS c, COUNT(DISTINCT visitor_hash) AS v FROM nav WHERE is_exit GROUP BY path
+		) GROUP BY p ORDER BY n DESC, p LIMIT ?`, withLimit(k, otherBucket)...)
+
+	transitionArgs := withLimit(utf8.RuneCountInString(after), after, k)
+	q.rows(`WITH `+nav+`
+		SELECT path, next_path, COUNT(*) AS c FROM nav
+		WHERE next_path IS NOT NULL AND substr(path, 1, ?) = ?
+		GROUP BY path, next_path HAVING COUNT(DISTINCT visitor_hash) >= ?
+		ORDER BY c DESC, path, next_path LIMIT ?`, transitionArgs, func(rows *sql.Rows) error {
+		var t Transition
+		if err := rows.Scan(&t.From, &t.To, &t.Count); err != nil {
+			return err
+		}
+		result.Transitions = append(result.Transitions, t)
+		return nil
+	})
+
+	q.rows(`WITH `+nav+`
+		SELECT path, next_path, next2_path, COUNT(*) AS c FROM nav
+		WHERE next2_path IS NOT NULL
+		GROUP BY path, next_path, next2_path HAVING COUNT(DISTINCT visitor_hash) >= ?
+		ORDER BY c DESC, path, next_path, next2_path LIMIT ?`, withLimit(k), func(rows *sql.Rows) error {
+		s := PathSequence{Paths: make([]string, 3)}
+		if err := rows.Scan(&s.Paths[0], &s.Paths[1], &s.Paths[2], &s.Count); err != nil {
+			return err
+		}
+		result.TopPaths = append(result.TopPaths, s)
+		return nil
+	})
+
+	if q.err != nil {
+		return nil, q.err
+	}
+	return result, nil
+}
+
+// handlePaths serves /api/analytics/paths with the time range and filter
+// parameters of /api/analytics/stats, plus:
+//
+//	after  only report transitions leaving pages with this path prefix
+//	limit  entries per list, 1-100, default 20
+func handlePaths(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	rng, err := ParseTimeRange(params, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := ParseFilter(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if s := params.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 100 {
+			http.Error(w, "limit must be 1-100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	if !segmentAllowed(w, ctx, "paths", "page_views", rng, filter) {
+		return
+	}
+	result, err := QueryPathsContext(ctx, rng, filter, params.Get("after"), limit)
+	if err != nil {
+		queryFailed(w, ctx, "paths", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -5,7 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
@@ -54,7 +54,7 @@ func (sm *SaltManager) GetSalt() string {
 	// Generate new salt
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
-		log.Fatalf("failed to generate salt: %v", err)
+		fatal("failed to generate salt", "err", err)
 	}
 	salt = hex.EncodeToString(b)
 
@@ -185,6 +185,9 @@ type GeoLocation struct {
 
 var geoIP = &GeoIPDB{}
 
+// geoIPPath is the GeoIP file loaded at startup and on each reload.
+var geoIPPath string
+
 // LookupLocation returns the country, region, and city for an IPv4 address.
 func LookupLocation(ip string) GeoLocation {
 	geoIP.mu.RLock()
@@ -204,6 +207,7 @@ func LookupLocation(ip string) GeoLocation {
 	}
 
 	ipNum := uint32(ipv4[0])<<24 | uint32(ipv4[1])<<16 | uint32(ipv4[2])<<8 | uint32(ipv4[3])
+	metrics.geoLookups.Add(1)
 
 	lo, hi := 0, len(geoIP.records)-1
 	for lo <= hi {
@@ -214,6 +218,7 @@ func LookupLocation(ip string) GeoLocation {
 		} else if ipNum > rec.ipTo {
 			lo = mid + 1
 		} else {
+			metrics.geoHits.Add(1)
 			return GeoLocation{Country: rec.country, Region: rec.region, City: rec.city}
 		}
 	}
@@ -226,13 +231,16 @@ func LookupLocation(ip string) GeoLocation {
 //   - Numeric ranges: "16777216","16777471","AU","Australia" (IP2Location)
 func LoadGeoIP(path string) {
 	if path == "" {
-		log.Println("geoip: no database path configured, country lookup disabled")
+		geoIP.mu.Lock()
+		geoIP.records, geoIP.loaded = nil, false
+		geoIP.mu.Unlock()
+		slog.Info("geoip: no database path configured, country lookup disabled")
 		return
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		log.Printf("geoip: could not load %s: %v (country lookup disabled)", path, err)
+		slog.Error("geoip: could not load; country lookup disabled", "path", path, "err", err)
 		return
 	}
 	defer f.Close()
@@ -310,7 +318,8 @@ func LoadGeoIP(path string) {
 	geoIP.loaded = true
 	geoIP.mu.Unlock()
 
-	log.Printf("geoip: loaded %d records from %s", len(records), path)
+	slog.Info("geoip loaded", "records", len(records), "path", path)
+	Audit("system", "geoip.load", strconv.Itoa(len(records))+" records from "+path)
 }
 
 // parseCSVLine handles the quoted CSV format from IP2Location.
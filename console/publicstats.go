@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// publicStatsConfig configures the differentially private
+// /api/public/stats endpoint.
+type publicStatsConfig struct {
+	Enabled   bool
+	Mechanism string  // laplace or gaussian
+	Budget    float64 // epsilon each day of data may spend, over every release covering it
+	Delta     float64 // per noisy count for gaussian, and for listing a page
+}
+
+var publicCfg = publicStatsConfig{Mechanism: "laplace", Budget: 3, Delta: 1e-6}
+
+// Validate checks the configuration for nonsensical values.
+func (c publicStatsConfig) Validate() error {
+	if c.Mechanism != "laplace" && c.Mechanism != "gaussian" {
+		return fmt.Errorf("mechanism must be laplace or gaussian, not %q", c.Mechanism)
+	}
+	if c.Budget <= 0 || c.Budget > 30 {
+		return errors.New("epsilon budget must be above 0 and at most 30")
+	}
+	// The Gaussian mechanism's calibration only holds for epsilon below 1
+	if c.Mechanism == "gaussian" && c.countEpsilon() >= 1 {
+		return fmt.Errorf("gaussian noise needs an epsilon budget below %d, 1 per noisy count",
+			len(publicPeriods)*publicCountsPerRelease)
+	}
+	if c.Delta <= 0 || c.Delta > 1e-3 {
+		return errors.New("delta must be above 0 and at most 0.001")
+	}
+	return nil
+}
+
+// publicPeriods are the complete UTC windows published. They do not
+// overlap within a period, so each day of data is covered by exactly one
+// release per period and its budget splits evenly between them.
+var publicPeriods = []string{"day", "week", "month"}
+
+// publicCountsPerRelease is how many noisy counts a release splits its
+// epsilon between: visitors, views and the page counts.
+const publicCountsPerRelease = 3
+
+// countEpsilon is the epsilon each noisy count spends.
+func (c publicStatsConfig) countEpsilon() float64 {
+	return c.Budget / float64(len(publicPeriods)) / publicCountsPerRelease
+}
+
+// Contribution bounds: a visitor adds at most this many views, and is
+// counted on at most this many pages (their most viewed). Visitor hashes
+// are salted daily, so a visitor is one person on one day and a person
+// contributes up to these bounds for every day in the window.
+const (
+	publicViewsPerVisitor = 20
+	publicPagesPerVisitor = 3
+	publicTopPages        = 10
+)
+
+// errBudgetSpent refuses a release that would overspend a day's budget,
+// as can happen after the budget is lowered.
+var errBudgetSpent = errors.New("privacy budget for this period is spent")
+
+// publicMu serialises releases so that a window is computed and paid for
+// once.
+var publicMu sync.Mutex
+
+// publicWindow returns the last complete window of period before now: for
+// day yesterday, for week the last Monday-to-Monday week, for month the
+// last calendar month.
+func publicWindow(period string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "week":
+		monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+		return monday.AddDate(0, 0, -7), monday
+	case "month":
+		first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return first.AddDate(0, -1, 0), first
+	}
+	return today.AddDate(0, 0, -1), today
+}
+
+// PublicRelease returns the release of period's last complete window,
+// computing and paying for it the first time it is asked for. Releases
+// are stored, as a window answered twice with fresh noise could be
+// averaged back to its true counts.
+func PublicRelease(ctx context.Context, period string, now time.Time) (*api.PublicStats, error) {
+	publicMu.Lock()
+	defer publicMu.Unlock()
+
+	from, to := publicWindow(period, now)
+	start := from.Format("2006-01-02")
+	var stored string
+	err := readDB.QueryRowContext(ctx, `SELECT result FROM public_releases WHERE period = ? AND start = ?`, period, start).Scan(&stored)
+	if err == nil {
+		s := new(api.PublicStats)
+		return s, json.Unmarshal([]byte(stored), s)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	cfg := setting(&publicCfg)
+	s, err := cfg.compute(ctx, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	s.ReleasedAt = now.UTC().Format(time.RFC3339)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := spendBudget(period, start, from, to, s.Privacy.Epsilon, cfg.Budget, data); err != nil {
+		return nil, err
+	}
+	Audit("system", "public.release", fmt.Sprintf("%s from %s to %s at epsilon %g", period, start, to.Format("2006-01-02"), s.Privacy.Epsilon))
+	return s, nil
+}
+
+// spendBudget charges eps to every day in [from, to) and stores the
+// release, refusing both if any day would go over budget.
+func spendBudget(period, start string, from, to time.Time, eps, budget float64, release []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		var spent float64
+		err := tx.QueryRow(`SELECT spent FROM privacy_budget WHERE day = ?`, day).Scan(&spent)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Allow for rounding in the even split of the budget
+		if spent+eps > budget*(1+1e-9) {
+			return errBudgetSpent
+		}
+		if _, err := tx.Exec(`INSERT INTO privacy_budget (day, spent) VALUES (?, ?)
+			ON CONFLICT(day) DO UPDATE SET spent = spent + excluded.spent`, day, eps); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO public_releases (period, start, result) VALUES (?, ?, ?)`, period, start, string(release)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// compute counts visitors, views and visitors per page in [from, to) with
+// bounded contributions, and adds noise to each. The release's epsilon is
+// its share of the daily budget, split evenly between the three. As a
+// person is a new visitor each day, the sensitivities are the per-visitor
+// bounds times the days in the window.
+func (c publicStatsConfig) compute(ctx context.Context, period string, from, to time.Time) (*api.PublicStats, error) {
+	f, t := from.Unix(), to.Unix()
+	q := &statsQuery{ctx: ctx}
+	var visitors, views int
+	q.scalar(&visitors, `SELECT COUNT(DISTINCT visitor_hash) FROM page_views WHERE ts >= ? AND ts < ?`, f, t)
+	q.scalar(&views, `SELECT COALESCE(SUM(MIN(n, ?)), 0) FROM (
+		SELECT COUNT(*) AS n FROM page_views WHERE ts >= ? AND ts < ? GROUP BY visitor_hash
+	)`, publicViewsPerVisitor, f, t)
+	pages := q.pathCounts(`SELECT path, COUNT(*) FROM (
+		SELECT path, ROW_NUMBER() OVER (PARTITION BY visitor_hash ORDER BY COUNT(*) DESC, path) AS rank
+		FROM page_views WHERE ts >= ? AND ts < ? GROUP BY visitor_hash, path
+	) WHERE rank <= ? GROUP BY path`, f, t, publicPagesPerVisitor)
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	days := int(math.Round(to.Sub(from).Hours() / 24))
+	d := float64(days)
+	eps := c.Budget / float64(len(publicPeriods))
+	each := c.countEpsilon()
+	s := &api.PublicStats{
+		Period:   period,
+		From:     from.Format(time.RFC3339),
+		To:       to.Format(time.RFC3339),
+		Visitors: c.noisyCount(visitors, d, d, each),
+		Views:    c.noisyCount(views, d*publicViewsPerVisitor, d*publicViewsPerVisitor, each),
+		TopPages: []PathCount{},
+		Privacy: api.PublicPrivacy{
+			Mechanism:       c.Mechanism,
+			Epsilon:         eps,
+			Delta:           c.Delta,
+			EpsilonPerDay:   c.Budget,
+			ViewsPerVisitor: publicViewsPerVisitor,
+			PagesPerVisitor: publicPagesPerVisitor,
+			VisitorsPerUser: days,
+		},
+	}
+	if c.Mechanism == "gaussian" {
+		s.Privacy.Delta = 4 * c.Delta // three noisy counts and the page threshold
+	}
+
+	// A person is counted on at most publicPagesPerVisitor pages a day,
+	// and on any one page once a day. Which pages exist is itself
+	// private: only pages whose noisy count clears a threshold that a page
+	// seen by one person passes with probability at most delta are listed
+	l1, l2 := d*publicPagesPerVisitor, d*math.Sqrt(publicPagesPerVisitor)
+	threshold := d + c.tail(l1, l2, each)
+	s.Privacy.MinPageCount = int(math.Ceil(threshold))
+	for _, p := range pages {
+		n := float64(p.Count) + c.noise(l1, l2, each)
+		if n >= threshold {
+			s.TopPages = append(s.TopPages, PathCount{Name: p.Name, Count: int(math.Round(n))})
+		}
+	}
+	sort.Slice(s.TopPages, func(i, j int) bool {
+		if s.TopPages[i].Count != s.TopPages[j].Count {
+			return s.TopPages[i].Count > s.TopPages[j].Count
+		}
+		return s.TopPages[i].Name < s.TopPages[j].Name
+	})
+	if len(s.TopPages) > publicTopPages {
+		s.TopPages = s.TopPages[:publicTopPages]
+	}
+	return s, nil
+}
+
+// noisyCount adds noise for a count with the given L1 and L2
+// sensitivities at epsilon eps, rounded and clamped at zero.
+func (c publicStatsConfig) noisyCount(n int, l1, l2, eps float64) int {
+	return max(0, int(math.Round(float64(n)+c.noise(l1, l2, eps))))
+}
+
+// scale is the Laplace scale b, or the Gaussian standard deviation, for a
+// query with sensitivities l1 and l2 at epsilon eps.
+func (c publicStatsConfig) scale(l1, l2, eps float64) float64 {
+	if c.Mechanism == "gaussian" {
+		return l2 * math.Sqrt(2*math.Log(1.25/c.Delta)) / eps
+	}
+	return l1 / eps
+}
+
+// noise draws one sample of the configured mechanism.
+func (c publicStatsConfig) noise(l1, l2, eps float64) float64 {
+	b := c.scale(l1, l2, eps)
+	if c.Mechanism == "gaussian" {
+		return b * math.Sqrt(-2*math.Log(uniform())) * math.Cos(2*math.Pi*uniform())
+	}
+	u := uniform() - 0.5
+	return -b * math.Copysign(1, u) * math.Log(1-2*math.Abs(u))
+}
+
+// tail is the noise exceeded with probability at most Delta.
+func (c publicStatsConfig) tail(l1, l2, eps float64) float64 {
+	b := c.scale(l1, l2, eps)
+	if c.Mechanism == "gaussian" {
+		return b * math.Sqrt2 * math.Erfinv(1-2*c.Delta)
+	}
+	return b * math.Log(1/(2*c.Delta))
+}
+
+// uniform returns a uniformly distributed float64 in (0, 1) from the
+// system's secure source, so that noise cannot be predicted.
+func uniform() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return (float64(binary.BigEndian.Uint64(b[:])>>11) + 0.5) / (1 << 53)
+}
+
+// handlePublicStats serves /api/public/stats without credentials. period
+// is day, week (default) or month, always the last complete one in UTC.
+func handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "week"
+	}
+	if !slices.Contains(publicPeriods, period) {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	s, err := PublicRelease(ctx, period, time.Now())
+	if errors.Is(err, errBudgetSpent) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		queryFailed(w, ctx, "public stats", err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
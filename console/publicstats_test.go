@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withPublicStats sets the public stats configuration for one test.
+func withPublicStats(t *testing.T, cfg publicStatsConfig) {
+	t.Helper()
+	saved := publicCfg
+	t.Cleanup(func() { publicCfg = saved })
+	publicCfg = cfg
+}
+
+// spentOn returns the epsilon charged to day.
+func spentOn(t *testing.T, day string) float64 {
+	t.Helper()
+	var spent float64
+	db.QueryRow(`SELECT spent FROM privacy_budget WHERE day = ?`, day).Scan(&spent)
+	return spent
+}
+
+func approx(a, b float64) bool { return a-b < 1e-9 && b-a < 1e-9 }
+
+// A Monday that starts a month, so that yesterday is in the last complete
+// day, week and month alike
+var releaseNow = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// TestPublicReleaseStored checks that a window is computed and paid for
+// once, and answered from the stored release after.
+func TestPublicReleaseStored(t *testing.T) {
+	openTestDB(t)
+	withPublicStats(t, publicStatsConfig{Enabled: true, Mechanism: "laplace", Budget: 3, Delta: 1e-6})
+	ctx := context.Background()
+
+	first, err := PublicRelease(ctx, "week", releaseNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := PublicRelease(ctx, "week", releaseNow.Add(36*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("second request recomputed the release: %+v, then %+v", first, again)
+	}
+	for _, day := range []string{"2026-05-25", "2026-05-31"} {
+		if spent := spentOn(t, day); !approx(spent, 1) {
+			t.Errorf("%s: spent %g, want 1 after one weekly release", day, spent)
+		}
+	}
+	if spent := spentOn(t, "2026-06-01"); spent != 0 {
+		t.Errorf("2026-06-01, outside the window: spent %g", spent)
+	}
+	if first.Privacy.VisitorsPerUser != 7 || !approx(first.Privacy.Epsilon, 1) {
+		t.Errorf("privacy %+v, want 7 visitors per person at epsilon 1", first.Privacy)
+	}
+}
+
+// TestPublicBudget checks that a day covered by the day, week and month
+// releases spends exactly the budget, and that a lowered budget refuses
+// what would overspend.
+func TestPublicBudget(t *testing.T) {
+	openTestDB(t)
+	withPublicStats(t, publicStatsConfig{Enabled: true, Mechanism: "laplace", Budget: 3, Delta: 1e-6})
+	ctx := context.Background()
+
+	if _, err := PublicRelease(ctx, "day", releaseNow); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowered so that May 31, 1 spent, cannot take the week's 0.4
+	publicCfg.Budget = 1.2
+	if _, err := PublicRelease(ctx, "week", releaseNow); !errors.Is(err, errBudgetSpent) {
+		t.Fatalf("week over a lowered budget: %v, want %v", err, errBudgetSpent)
+	}
+	if spent := spentOn(t, "2026-05-25"); spent != 0 {
+		t.Errorf("refused release charged 2026-05-25 %g", spent)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM public_releases WHERE period = 'week'`).Scan(&n)
+	if n != 0 {
+		t.Errorf("refused release stored")
+	}
+
+	publicCfg.Budget = 3
+	for _, period := range []string{"week", "month"} {
+		if _, err := PublicRelease(ctx, period, releaseNow); err != nil {
+			t.Fatalf("%s: %v", period, err)
+		}
+	}
+	want := map[string]float64{"2026-05-31": 3, "2026-05-25": 2, "2026-05-24": 1, "2026-05-01": 1}
+	for day, w := range want {
+		if spent := spentOn(t, day); !approx(spent, w) {
+			t.Errorf("%s: spent %g, want %g", day, spent, w)
+		}
+	}
+
+	// Nothing is left of May 31 for a fresh release covering it
+	may31 := time.Date(2026, 5, 31, 0, 0, 0, 0, time.UTC)
+	if err := spendBudget("day", "2026-05-31", may31, may31.AddDate(0, 0, 1), 0.01, publicCfg.Budget, []byte("{}")); !errors.Is(err, errBudgetSpent) {
+		t.Errorf("spending past the budget: %v, want %v", err, errBudgetSpent)
+	}
+}
+
+func TestPublicStatsValidate(t *testing.T) {
+	tests := []struct {
+		cfg publicStatsConfig
+		ok  bool
+	}{
+		{publicStatsConfig{Mechanism: "laplace", Budget: 3, Delta: 1e-6}, true},
+		{publicStatsConfig{Mechanism: "laplace", Budget: 30, Delta: 1e-6}, true},
+		{publicStatsConfig{Mechanism: "gaussian", Budget: 3, Delta: 1e-6}, true},
+		{publicStatsConfig{Mechanism: "gaussian", Budget: 8.9, Delta: 1e-6}, true},
+		// 9 over three releases of three counts is epsilon 1 a count
+		{publicStatsConfig{Mechanism: "gaussian", Budget: 9, Delta: 1e-6}, false},
+		{publicStatsConfig{Mechanism: "gaussian", Budget: 20, Delta: 1e-6}, false},
+		{publicStatsConfig{Mechanism: "exponential", Budget: 3, Delta: 1e-6}, false},
+		{publicStatsConfig{Mechanism: "laplace", Budget: 0, Delta: 1e-6}, false},
+		{publicStatsConfig{Mechanism: "laplace", Budget: 31, Delta: 1e-6}, false},
+		{publicStatsConfig{Mechanism: "laplace", Budget: 3, Delta: 0}, false},
+		{publicStatsConfig{Mechanism: "laplace", Budget: 3, Delta: 0.01}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: %v, want ok %v", tt.cfg, err, tt.ok)
+		}
+	}
+}
+
+// TestPublicSensitivityScales checks that longer windows, in which a person
+// is a new visitor each day, are noised and thresholded for every day.
+func TestPublicSensitivityScales(t *testing.T) {
+	openTestDB(t)
+	cfg := publicStatsConfig{Mechanism: "laplace", Budget: 3, Delta: 1e-6}
+	prev := 0
+	for _, tt := range []struct {
+		period string
+		days   int
+	}{{"day", 1}, {"week", 7}, {"month", 31}} {
+		from, to := publicWindow(tt.period, releaseNow)
+		s, err := cfg.compute(context.Background(), tt.period, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Privacy.VisitorsPerUser != tt.days || s.Privacy.MinPageCount <= prev {
+			t.Errorf("%s: privacy %+v, want %d visitors per person and a threshold above %d", tt.period, s.Privacy, tt.days, prev)
+		}
+		prev = s.Privacy.MinPageCount
+	}
+}
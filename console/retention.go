@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy sets how many days each kind of data is kept.
+// Zero keeps that data forever.
+type RetentionPolicy struct {
+	PageViews  int    // raw page_views rows
+	Events     int    // raw events rows
+	IPAddress  int    // ip_address column on page_views, blanked in place
+	Salts      int    // daily_salt rows
+	Aggregates int    // daily_aggregates rows
+	Audit      int    // audit_log rows
+	PurgeAt    string // daily purge time, "HH:MM" UTC
+	ChunkSize  int    // rows deleted per statement
+}
+
+var retention = RetentionPolicy{
+	PageViews:  90,
+	Events:     90,
+	IPAddress:  90,
+	Salts:      90,
+	Aggregates: 0,
+	Audit:      365,
+	PurgeAt:    "03:30",
+	ChunkSize:  5000,
+}
+
+// Validate checks the policy for nonsensical values.
+func (p RetentionPolicy) Validate() error {
+	for name, days := range map[string]int{
+		"pageviews": p.PageViews, "events": p.Events, "ip": p.IPAddress,
+		"salts": p.Salts, "aggregates": p.Aggregates, "audit": p.Audit,
+	} {
+		if days < 0 {
+			return fmt.Errorf("retention for %s must not be negative", name)
+		}
+	}
+	if p.Aggregates > 0 && (p.PageViews == 0 || p.Aggregates < p.PageViews) {
+		return fmt.Errorf("aggregate retention must be at least the page view retention")
+	}
+	if p.ChunkSize < 1 {
+		return fmt.Errorf("purge chunk size must be positive")
+	}
+	if _, err := time.Parse("15:04", p.PurgeAt); err != nil {
+		return fmt.Errorf("purge time %q must be HH:MM", p.PurgeAt)
+	}
+	return nil
+}
+
+// PurgeOldData applies the retention policy. When an archive directory is
+// configured, raw rows are archived first and a table is left untouched if
+// archiving it fails.
+func PurgeOldData(p RetentionPolicy, dryRun bool) (PurgeReport, error) {
+	start := time.Now()
+	report, err := purgeOldData(p, dryRun)
+	if !dryRun {
+		metrics.purge.record(time.Since(start), err)
+	}
+	return report, err
+}
+
+func purgeOldData(p RetentionPolicy, dryRun bool) (PurgeReport, error) {
+	start := time.Now()
+	report := PurgeReport{DryRun: dryRun}
+	var err error
+
+	if p.PageViews > 0 {
+		if report.PageViews, err = purgeRaw("page_views", p.PageViews, p.ChunkSize, dryRun); err != nil {
+			return report, err
+		}
+	}
+	if p.Events > 0 {
+		if report.Events, err = purgeRaw("events", p.Events, p.ChunkSize, dryRun); err != nil {
+			return report, err
+		}
+	}
+	if p.IPAddress > 0 {
+		report.IPAddresses, err = clearIPAddresses(p.IPAddress, p.ChunkSize, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("clear ip addresses: %w", err)
+		}
+	}
+	if p.Salts > 0 {
+		if report.Salts, err = purgeByDate("daily_salt", p.Salts, dryRun); err != nil {
+			return report, err
+		}
+	}
+	if p.Aggregates > 0 {
+		if report.Aggregates, err = purgeByDate("daily_aggregates", p.Aggregates, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	if p.Audit > 0 {
+		if report.Audit, err = pruneAudit(p.Audit, p.ChunkSize, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report, nil
+}
+
+// purgeRaw deletes rows of a raw table older than days, archiving them first
+// when archiving is enabled. Monthly partitions that fall entirely before
+// the cutoff are dropped whole.
+func purgeRaw(table string, days, chunk int, dryRun bool) (int64, error) {
+	day := cutoffDate(days)
+	cutoff := dayStart(days)
+	if dryRun {
+		return countRows(table, `ts < ?`, cutoff)
+	}
+
+	if dir := setting(&archiveDir); dir != "" {
+		if err := ArchiveBefore(dir, table, day); err != nil {
+			return 0, fmt.Errorf("%s not purged, archive failed: %w", table, err)
+		}
+	}
+
+	total, err := dropPartitionsBefore(table, cutoff)
+	if err != nil {
+		return total, fmt.Errorf("purge %s: %w", table, err)
+	}
+	for _, t := range rawTables(table, cutoff) {
+		n, err := chunked(`DELETE FROM `+t+` WHERE id IN
+			(SELECT id FROM `+t+` WHERE ts < ? LIMIT ?)`, cutoff, chunk)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("purge %s: %w", t, err)
+		}
+	}
+	return total, nil
+}
+
+// clearIPAddresses blanks ip_address on page views older than days.
+func clearIPAddresses(days, chunk int, dryRun bool) (int64, error) {
+	where := `ts < ? AND ip_address != ''`
+	cutoff := dayStart(days)
+	if dryRun {
+		return countRows("page_views", where, cutoff)
+	}
+
+	var total int64
+	for _, t := range rawTables("page_views", cutoff) {
+		n, err := chunked(`UPDATE `+t+` SET ip_address = '' WHERE id IN
+			(SELECT id FROM `+t+` WHERE `+where+` LIMIT ?)`, cutoff, chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// purgeByDate deletes rows of a table keyed by a YYYY-MM-DD date column.
+// These tables hold one row per day (or per day and path), so a single
+// statement is small enough.
+func purgeByDate(table string, days int, dryRun bool) (int64, error) {
+	cutoff := cutoffDate(days)
+	if dryRun {
+		return countRows(table, `date < ?`, cutoff)
+	}
+	res, err := db.Exec(`DELETE FROM `+table+` WHERE date < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("purge %s: %w", table, err)
+	}
+	return res.RowsAffected()
+}
+
+// chunked runs a statement with (cutoff, limit) arguments until it affects
+// fewer than limit rows, so no single transaction holds the write lock long.
+// Each chunk counts as a beat of the aggregation loop, so that a long purge
+// does not read as a stalled one.
+func chunked(query string, cutoff any, limit int) (int64, error) {
+	var total int64
+	for {
+		res, err := db.Exec(query, cutoff, limit)
+		if err != nil {
+			return total, err
+		}
+		heartbeat()
+		n, _ := res.RowsAffected()
+		total += n
+		if n < int64(limit) {
+			return total, nil
+		}
+	}
+}
+
+func countRows(table, where string, arg any) (int64, error) {
+	var n int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE `+where, arg).Scan(&n)
+	return n, err
+}
+
+func cutoffDate(days int) string {
+	return time.Now().UTC().AddDate(0, 0, -days).Format("2006-01-02")
+}
+
+// dayStart returns the epoch second of UTC midnight days ago.
+func dayStart(days int) int64 {
+	t, _ := time.Parse("2006-01-02", cutoffDate(days))
+	return t.Unix()
+}
+
+// nextPurgeTime returns the next wall-clock occurrence of retention.PurgeAt
+// after now.
+func nextPurgeTime(now time.Time) time.Time {
+	at, err := time.Parse("15:04", setting(&retention).PurgeAt)
+	if err != nil {
+		return now.Add(24 * time.Hour)
+	}
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func runScheduledPurge() {
+	report, err := PurgeOldData(setting(&retention), false)
+	if err != nil {
+		slog.Error("purge failed", "err", err)
+		Audit("system", "purge", "failed: "+err.Error())
+		return
+	}
+	slog.Info("purge", "report", report.String())
+	Audit("system", "purge", report.String())
+}
+
+// handlePurge runs the retention purge on demand. Pass ?dry_run=1 to only
+// count what would be removed.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	dryRun := parseBool(r.URL.Query().Get("dry_run"))
+
+	report, err := PurgeOldData(setting(&retention), dryRun)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "purge failed", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("purge", "report", report.String())
+	noteAudit(r, "purge", report.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func parseBool(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"noblemind-console/api"
+)
+
+// shareSections are the parts of StatsResult a share link can expose.
+// Realtime counts and comparisons are never shared.
+var shareSections = []string{"totals", "timeseries", "pages", "referrers", "browsers", "devices", "os", "countries", "events", "screens"}
+
+// defaultShareMinVisitors is the k of a link's k-anonymity when none is
+// given.
+const defaultShareMinVisitors = 5
+
+// validateShareLink checks a link to be created and normalises its
+// sections, threshold and expiry.
+func validateShareLink(l *ShareLink, now time.Time) error {
+	if l.Name = strings.TrimSpace(l.Name); l.Name == "" || len(l.Name) > 64 {
+		return errors.New("name must be 1-64 characters")
+	}
+	if len(l.Sections) == 0 {
+		return fmt.Errorf("at least one section is required: %s", strings.Join(shareSections, ", "))
+	}
+	for _, s := range l.Sections {
+		if !slices.Contains(shareSections, s) {
+			return fmt.Errorf("unknown section %q: use %s", s, strings.Join(shareSections, ", "))
+		}
+	}
+	slices.Sort(l.Sections)
+	l.Sections = slices.Compact(l.Sections)
+	if l.PathPrefix != "" && (!strings.HasPrefix(l.PathPrefix, "/") || strings.Contains(l.PathPrefix, ",") || len(l.PathPrefix) > 200) {
+		return errors.New("path prefix must start with / and not contain commas")
+	}
+	if l.MinVisitors == 0 {
+		l.MinVisitors = defaultShareMinVisitors
+	}
+	if l.MinVisitors < 2 || l.MinVisitors > 1000 {
+		return errors.New("min_visitors must be 2-1000")
+	}
+	if l.ExpiresAt != "" {
+		t, err := parseExpiry(l.ExpiresAt, now)
+		if err != nil {
+			return err
+		}
+		if !t.After(now) {
+			return errors.New("expiry is in the past")
+		}
+		l.ExpiresAt = t.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+var shareKey struct {
+	sync.Mutex
+	key []byte
+}
+
+// shareSecret returns the key share links are signed with, creating and
+// storing it on first use.
+func shareSecret() ([]byte, error) {
+	shareKey.Lock()
+	defer shareKey.Unlock()
+	if shareKey.key != nil {
+		return shareKey.key, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	// Another process may have stored one first; whichever won is used
+	if _, err := db.Exec(`INSERT OR IGNORE INTO secrets (name, value) VALUES ('share', ?)`, b); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`SELECT value FROM secrets WHERE name = 'share'`).Scan(&b); err != nil {
+		return nil, err
+	}
+	shareKey.key = b
+	return b, nil
+}
+
+// shareToken signs a link's ID and creation time. The token is
+// deterministic, so a link's URL can be shown again later.
+func shareToken(id, created int64) (string, error) {
+	key, err := shareSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "share:%d:%d", id, created)
+	return strconv.FormatInt(id, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18]), nil
+}
+
+// CreateShareLink stores a new link and sets its ID and URL.
+func CreateShareLink(l *ShareLink) error {
+	now := time.Now()
+	if err := validateShareLink(l, now); err != nil {
+		return err
+	}
+	var expires sql.NullInt64
+	if l.ExpiresAt != "" {
+		t, _ := time.Parse(time.RFC3339, l.ExpiresAt)
+		expires = sql.NullInt64{Int64: t.Unix(), Valid: true}
+	}
+	res, err := db.Exec(`INSERT INTO share_links (name, sections, path_prefix, min_visitors, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		l.Name, strings.Join(l.Sections, " "), l.PathPrefix, l.MinVisitors, expires, now.Unix())
+	if err != nil {
+		return err
+	}
+	l.ID, _ = res.LastInsertId()
+	l.CreatedAt = now.UTC().Format(time.RFC3339)
+	token, err := shareToken(l.ID, now.Unix())
+	l.URL = "/share/" + token
+	return err
+}
+
+const shareLinkColumns = `id, name, sections, path_prefix, min_visitors, expires_at, created_at`
+
+func scanShareLink(row interface{ Scan(...any) error }) (*ShareLink, error) {
+	var l ShareLink
+	var sections string
+	var expires sql.NullInt64
+	var created int64
+	if err := row.Scan(&l.ID, &l.Name, &sections, &l.PathPrefix, &l.MinVisitors, &expires, &created); err != nil {
+		return nil, err
+	}
+	l.Sections = strings.Fields(sections)
+	if expires.Valid {
+		l.ExpiresAt = time.Unix(expires.Int64, 0).UTC().Format(time.RFC3339)
+	}
+	l.CreatedAt = time.Unix(created, 0).UTC().Format(time.RFC3339)
+	token, err := shareToken(l.ID, created)
+	l.URL = "/share/" + token
+	return &l, err
+}
+
+// ListShareLinks returns every link, expired ones included, by name.
+func ListShareLinks() ([]ShareLink, error) {
+	// Load the secret first: signing inside the loop would wait for the
+	// writer connection the rows hold
+	if _, err := shareSecret(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT ` + shareLinkColumns + ` FROM share_links ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []ShareLink{}
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, *l)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink deletes a link by ID, reporting whether it existed.
+func RevokeShareLink(id int64) (bool, error) {
+	res, err := db.Exec(`DELETE FROM share_links WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// lookupShareLink returns the unexpired link a token signs, or nil.
+func lookupShareLink(ctx context.Context, token string) (*ShareLink, error) {
+	idStr, _, _ := strings.Cut(token, ".")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	row := readDB.QueryRowContext(ctx, `SELECT `+shareLinkColumns+` FROM share_links
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > unixepoch())`, id)
+	l, err := scanShareLink(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(l.URL), []byte("/share/"+token)) {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// shareView keeps only the sections a link shares.
+func shareView(s *StatsResult, sections []string) StatsResult {
+	has := func(name string) bool { return slices.Contains(sections, name) }
+	v := StatsResult{From: s.From, To: s.To, Timezone: s.Timezone, Interval: s.Interval}
+	if has("totals") {
+		v.TotalViews, v.UniqueVisitors = s.TotalViews, s.UniqueVisitors
+	}
+	if has("timeseries") {
+		v.TimeSeries = s.TimeSeries
+	}
+	if has("pages") {
+		v.TopPages = s.TopPages
+	}
+	if has("referrers") {
+		v.TopReferrers = s.TopReferrers
+	}
+	if has("browsers") {
+		v.Browsers = s.Browsers
+	}
+	if has("devices") {
+		v.Devices = s.Devices
+	}
+	if has("os") {
+		v.OSStats = s.OSStats
+	}
+	if has("countries") {
+		v.Countries = s.Countries
+	}
+	if has("events") {
+		v.Events = s.Events
+	}
+	if has("screens") {
+		v.Screens = s.Screens
+	}
+	return v
+}
+
+// shareCache keeps each shared view for a minute, so that a popular link
+// costs one query a minute however often it is opened.
+var shareCache = struct {
+	sync.Mutex
+	entries map[string]shareCacheEntry
+}{entries: map[string]shareCacheEntry{}}
+
+type shareCacheEntry struct {
+	stats   api.SharedStats
+	expires time.Time
+}
+
+const shareCacheTTL = time.Minute
+
+// QuerySharedStats returns what link shows over the range in q.
+func QuerySharedStats(ctx context.Context, l *ShareLink, q url.Values) (api.SharedStats, error) {
+	key := fmt.Sprintf("%d|%s|%s|%s|%s|%s", l.ID, q.Get("preset"), q.Get("from"), q.Get("to"), q.Get("period"), q.Get("tz"))
+	shareCache.Lock()
+	e, ok := shareCache.entries[key]
+	shareCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.stats, nil
+	}
+
+	rng, err := ParseTimeRange(q, time.Now())
+	if err != nil {
+		return api.SharedStats{}, errBadShareRange{err}
+	}
+	var f Filter
+	if l.PathPrefix != "" {
+		if f, err = ParseFilter(url.Values{"path_prefix": {l.PathPrefix}}); err != nil {
+			return api.SharedStats{}, err
+		}
+	}
+	stats, err := QueryStatsContext(ctx, rng, f)
+	if err == nil {
+		err = suppressStats(ctx, stats, rng, f, max(l.MinVisitors, setting(&minVisitors)))
+	}
+	if err != nil {
+		return api.SharedStats{}, err
+	}
+	shared := api.SharedStats{Name: l.Name, Sections: l.Sections, PathPrefix: l.PathPrefix,
+		MinVisitors: l.MinVisitors, Stats: shareView(stats, l.Sections)}
+
+	shareCache.Lock()
+	now := time.Now()
+	if len(shareCache.entries) >= 1000 {
+		for k, e := range shareCache.entries {
+			if now.After(e.expires) {
+				delete(shareCache.entries, k)
+			}
+		}
+	}
+	if len(shareCache.entries) < 1000 {
+		shareCache.entries[key] = shareCacheEntry{shared, now.Add(shareCacheTTL)}
+	}
+	shareCache.Unlock()
+	return shared, nil
+}
+
+// errBadShareRange is a time range the viewer got wrong.
+type errBadShareRange struct{ error }
+
+// handleListShareLinks returns every share link with its URL.
+func handleListShareLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := ListShareLinks()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "list share links", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+// handleCreateShareLink creates a link from a JSON body.
+func handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var l ShareLink
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&l); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	l.ID, l.URL = 0, ""
+	if err := validateShareLink(&l, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CreateShareLink(&l); err != nil {
+		definitionFailed(w, r, "share link", err)
+		return
+	}
+	noteAudit(r, "share.create", shareLinkDetail(l))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// handleRevokeShareLink deletes a link; its URL stops working at once.
+func handleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := RevokeShareLink(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoke share link", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	noteAudit(r, "share.revoke", "id "+strconv.FormatInt(id, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareLinkDetail describes a link for the audit log.
+func shareLinkDetail(l ShareLink) string {
+	d := fmt.Sprintf("%s (id %d) sections %s, min visitors %d", l.Name, l.ID, strings.Join(l.Sections, ","), l.MinVisitors)
+	if l.PathPrefix != "" {
+		d += ", path prefix " + l.PathPrefix
+	}
+	return d
+}
+
+// setShareHeaders keeps shared pages out of search engines and their
+// tokens out of Referer headers.
+func setShareHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// handleSharePage serves the dashboard in read-only mode for a valid link.
+func handleSharePage(w http.ResponseWriter, r *http.Request) {
+	setShareHeaders(w)
+	l, err := lookupShareLink(r.Context(), r.PathValue("token"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "share link", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if l == nil {
+		http.Error(w, "this link has expired or been revoked", http.StatusNotFound)
+		return
+	}
+	handleDashboard(w, r)
+}
+
+// handleShareStats returns a link's stats over the preset, from/to or
+// period in the query. Filters are fixed by the link.
+func handleShareStats(w http.ResponseWriter, r *http.Request) {
+	setShareHeaders(w)
+	l, err := lookupShareLink(r.Context(), r.PathValue("token"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "share link", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if l == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), setting(&queryTimeouts).Stats)
+	defer cancel()
+
+	shared, err := QuerySharedStats(ctx, l, r.URL.Query())
+	var bad errBadShareRange
+	if errors.As(err, &bad) {
+		http.Error(w, bad.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		queryFailed(w, ctx, "share stats", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	json.NewEncoder(w).Encode(shared)
+}
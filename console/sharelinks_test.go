@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateShares starts a test with no cached signing key or shared views,
+// as those outlive the database they came from.
+func isolateShares(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		shareKey.Lock()
+		shareKey.key = nil
+		shareKey.Unlock()
+		shareCache.Lock()
+		clear(shareCache.entries)
+		shareCache.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func createTestShare(t *testing.T, l ShareLink) ShareLink {
+	t.Helper()
+	if err := CreateShareLink(&l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// TestShareLinkRefused checks that every token but the one a live link
+// was given answers 404, as revoked and expired links do.
+func TestShareLinkRefused(t *testing.T) {
+	openTestDB(t)
+	isolateShares(t)
+	mux := http.NewServeMux()
+	SetupRoutes(mux)
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/share/"+token+"/stats?period=7d", nil))
+		return w.Code
+	}
+	tokenOf := func(l ShareLink) string { return strings.TrimPrefix(l.URL, "/share/") }
+
+	first := createTestShare(t, ShareLink{Name: "first", Sections: []string{"totals"}})
+	second := createTestShare(t, ShareLink{Name: "second", Sections: []string{"totals"}})
+	expired := createTestShare(t, ShareLink{Name: "expired", Sections: []string{"totals"}})
+	revoked := createTestShare(t, ShareLink{Name: "revoked", Sections: []string{"totals"}})
+	if _, err := db.Exec(`UPDATE share_links SET expires_at = unixepoch() - 1 WHERE id = ?`, expired.ID); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := RevokeShareLink(revoked.ID); !found || err != nil {
+		t.Fatalf("revoke: %v, %v", found, err)
+	}
+
+	token := tokenOf(first)
+	if code := get(token); code != http.StatusOK {
+		t.Fatalf("valid link: status %d", code)
+	}
+
+	_, mac, _ := strings.Cut(token, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(mac)
+	raw[0] ^= 1
+	_, otherMAC, _ := strings.Cut(tokenOf(second), ".")
+	refused := map[string]string{
+		"altered MAC":        fmt.Sprintf("%d.%s", first.ID, base64.RawURLEncoding.EncodeToString(raw)),
+		"truncated MAC":      token[:len(token)-1],
+		"no MAC":             fmt.Sprintf("%d", first.ID),
+		"empty MAC":          fmt.Sprintf("%d.", first.ID),
+		"another link's ID":  fmt.Sprintf("%d.%s", second.ID, mac),
+		"another link's MAC": fmt.Sprintf("%d.%s", first.ID, otherMAC),
+		"unknown ID":         fmt.Sprintf("%d.%s", revoked.ID+1, mac),
+		"not an ID":          "x." + mac,
+		"expired":            tokenOf(expired),
+		"revoked":            tokenOf(revoked),
+	}
+	for name, token := range refused {
+		if code := get(token); code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want %d", name, code, http.StatusNotFound)
+		}
+	}
+
+	// A key other than the database's signs nothing it accepts
+	created, _ := time.Parse(time.RFC3339, first.CreatedAt)
+	if resigned, err := shareToken(first.ID, created.Unix()); err != nil || resigned != token {
+		t.Fatalf("token not reproduced: %q, %v", resigned, err)
+	}
+	shareKey.Lock()
+	shareKey.key = []byte("forged key")
+	shareKey.Unlock()
+	forged, err := shareToken(first.ID, created.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareKey.Lock()
+	shareKey.key = nil
+	shareKey.Unlock()
+	if code := get(forged); code != http.StatusNotFound {
+		t.Errorf("forged MAC: status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+// shareSectionFields are the StatsResult fields each section exposes.
+var shareSectionFields = map[string][]string{
+	"totals":     {"TotalViews", "UniqueVisitors"},
+	"timeseries": {"TimeSeries"},
+	"pages":      {"TopPages"},
+	"referrers":  {"TopReferrers"},
+	"browsers":   {"Browsers"},
+	"devices":    {"Devices"},
+	"os":         {"OSStats"},
+	"countries":  {"Countries"},
+	"events":     {"Events"},
+	"screens":    {"Screens"},
+}
+
+// TestShareView checks that each section exposes its own fields and no
+// others, and that realtime counts and comparisons are never shared.
+func TestShareView(t *testing.T) {
+	rows := []PathCount{{Name: "a", Count: 9}}
+	s := &StatsResult{
+		From: "2026-01-01", To: "2026-01-08", Timezone: "UTC", Interval: "day",
+		TotalViews: 90, UniqueVisitors: 30, ActiveNow: 3,
+		TimeSeries: []TimePoint{{Date: "2026-01-01", Views: 90, Uniq: 30}},
+		TopPages:   rows, TopReferrers: rows, Browsers: rows, Devices: rows,
+		OSStats: rows, Countries: rows, Screens: rows,
+		Events:     []EventSummary{{Type: "signup", Count: 9}},
+		Comparison: &Comparison{},
+	}
+	if len(shareSectionFields) != len(shareSections) {
+		t.Fatalf("shareSectionFields covers %d sections of %d", len(shareSectionFields), len(shareSections))
+	}
+
+	for _, shared := range [][]string{{"totals"}, {"pages", "countries"}, shareSections} {
+		v := reflect.ValueOf(shareView(s, shared))
+		want := []string{"From", "To", "Timezone", "Interval"}
+		for _, section := range shared {
+			want = append(want, shareSectionFields[section]...)
+		}
+		for i := range v.NumField() {
+			name := v.Type().Field(i).Name
+			if exposed := !v.Field(i).IsZero(); exposed != slices.Contains(want, name) {
+				t.Errorf("sharing %v: %s exposed %v", shared, name, exposed)
+			}
+		}
+	}
+}
+
+// TestSharedStatsSuppressed checks that a link's path prefix and k are
+// applied, and that the cached view is the suppressed one.
+func TestSharedStatsSuppressed(t *testing.T) {
+	openTestDB(t)
+	isolateShares(t)
+	view := func(path, visitor string) {
+		t.Helper()
+		if err := InsertPageView(path, "", visitor, "", "", "", "", "Desktop", "Firefox", "Linux", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 6 {
+		view("/blog/popular", fmt.Sprintf("v%d", i))
+	}
+	view("/blog/rare", "v0")
+	for i := range 20 {
+		view("/about", fmt.Sprintf("w%d", i))
+	}
+
+	l := createTestShare(t, ShareLink{Name: "blog", Sections: []string{"pages", "totals"}, PathPrefix: "/blog", MinVisitors: 6})
+	today := time.Now().UTC().Format("2006-01-02")
+	q := url.Values{"from": {today}, "to": {today}}
+	shared, err := QuerySharedStats(context.Background(), &l, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := shared.Stats
+	if s.TotalViews != 7 || s.UniqueVisitors != 6 {
+		t.Errorf("totals: %d views by %d visitors, want 7 by 6 under /blog", s.TotalViews, s.UniqueVisitors)
+	}
+	want := []PathCount{{Name: "/blog/popular", Count: 6}, {Name: otherBucket, Count: 1}}
+	if !reflect.DeepEqual(s.TopPages, want) {
+		t.Errorf("pages: %v, want %v", s.TopPages, want)
+	}
+	if s.Browsers != nil || s.TimeSeries != nil {
+		t.Errorf("unshared sections exposed: %v, %v", s.Browsers, s.TimeSeries)
+	}
+
+	// The rare page now has enough visitors, but the cached view is served
+	for i := 1; i < 6; i++ {
+		view("/blog/rare", fmt.Sprintf("v%d", i))
+	}
+	again, err := QuerySharedStats(context.Background(), &l, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again.Stats.TopPages, want) {
+		t.Errorf("cached pages: %v, want %v", again.Stats.TopPages, want)
+	}
+
+	// A link whose prefix covers fewer than k visitors shows nothing
+	small := createTestShare(t, ShareLink{Name: "small", Sections: []string{"pages", "totals"}, PathPrefix: "/blog/rare", MinVisitors: 10})
+	shared, err = QuerySharedStats(context.Background(), &small, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := shared.Stats; s.TotalViews != 0 || s.UniqueVisitors != 0 || s.TopPages != nil {
+		t.Errorf("below k: %+v, want nothing", s)
+	}
+}
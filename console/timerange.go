@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	_ "time/tzdata" // IANA zones even on hosts without zoneinfo
+)
+
+// TimeRange is a half-open [From, To) reporting window. Day and hour
+// buckets are computed in Loc.
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+	Loc  *time.Location
+}
+
+// Interval is the time series bucket for the range: "hour" for windows of
+// up to two days, "day" otherwise.
+func (r TimeRange) Interval() string {
+	if r.To.Sub(r.From) <= 48*time.Hour {
+		return "hour"
+	}
+	return "day"
+}
+
+// ParseTimeRange reads the reporting window from query parameters:
+//
+//	tz      IANA zone name for bucketing and date parsing (default UTC)
+//	preset  today, yesterday, this_week, last_week, this_month,
+//	        last_month, year_to_date or last_year
+//	from,to dates (YYYY-MM-DD, to inclusive) or RFC 3339 timestamps
+//	period  Nd, counted back from now (the original parameter)
+//
+// Presets take precedence over from/to, which take precedence over period.
+func ParseTimeRange(q url.Values, now time.Time) (TimeRange, error) {
+	loc := time.UTC
+	if tz := strings.TrimSpace(q.Get("tz")); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("unknown time zone %q", tz)
+		}
+		loc = l
+	}
+	now = now.In(loc)
+
+	if preset := strings.TrimSpace(strings.ToLower(q.Get("preset"))); preset != "" {
+		from, to, err := presetRange(preset, now)
+		if err != nil {
+			return TimeRange{}, err
+		}
+		return TimeRange{From: from, To: to, Loc: loc}, nil
+	}
+
+	fromStr, toStr := strings.TrimSpace(q.Get("from")), strings.TrimSpace(q.Get("to"))
+	if fromStr != "" || toStr != "" {
+		r := TimeRange{To: now, Loc: loc}
+		if fromStr == "" {
+			return TimeRange{}, fmt.Errorf("from is required when to is given")
+		}
+		from, err := parseBound(fromStr, loc, false)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid from: %w", err)
+		}
+		r.From = from
+		if toStr != "" {
+			if r.To, err = parseBound(toStr, loc, true); err != nil {
+				return TimeRange{}, fmt.Errorf("invalid to: %w", err)
+			}
+		}
+		if !r.From.Before(r.To) {
+			return TimeRange{}, fmt.Errorf("from must be before to")
+		}
+		if r.To.Sub(r.From) > 366*24*time.Hour {
+			return TimeRange{}, fmt.Errorf("range must not exceed 366 days")
+		}
+		return r, nil
+	}
+
+	days := parsePeriod(q.Get("period"))
+	return TimeRange{From: now.AddDate(0, 0, -days), To: now, Loc: loc}, nil
+}
+
+// parseBound parses a date or RFC 3339 timestamp. A bare date used as the
+// upper bound means the end of that day.
+func parseBound(s string, loc *time.Location, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.In(loc), nil
+	}
+	d, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want YYYY-MM-DD or RFC 3339, got %q", s)
+	}
+	if upper {
+		d = d.AddDate(0, 0, 1)
+	}
+	return d, nil
+}
+
+// presetNames lists the presets presetRange accepts.
+var presetNames = []string{"today", "yesterday", "this_week", "last_week", "this_month", "last_month", "year_to_date", "last_year"}
+
+// presetRange computes a named window relative to now, in now's location.
+// Weeks start on Sunday. Windows that include today end at now.
+func presetRange(name string, now time.Time) (time.Time, time.Time, error) {
+	loc := now.Location()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	week := today.AddDate(0, 0, -int(today.Weekday()))
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	year := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc)
+
+	switch name {
+	case "today":
+		return today, now, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, nil
+	case "this_week":
+		return week, now, nil
+	case "last_week":
+		return week.AddDate(0, 0, -7), week, nil
+	case "this_month":
+		return month, now, nil
+	case "last_month":
+		return month.AddDate(0, -1, 0), month, nil
+	case "year_to_date":
+		return year, now, nil
+	case "last_year":
+		return year.AddDate(-1, 0, 0), year, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown preset %q", name)
+}
+
+// localTS returns an SQL expression, with its arguments, that converts the
+// ts column to local epoch seconds in r.Loc over the range. Each UTC offset
+// in effect during the range (one per DST transition) becomes a CASE arm,
+// so date() and strftime() on the result give local days and hours.
+func (r TimeRange) localTS() (string, []any) {
+	type span struct {
+		start  int64
+		offset int
+	}
+	var spans []span
+	for t := r.From.In(r.Loc); t.Before(r.To); {
+		_, off := t.Zone()
+		spans = append(spans, span{t.Unix(), off})
+		_, end := t.ZoneBounds()
+		if end.IsZero() || !end.After(t) {
+			break
+		}
+		t = end
+	}
+	if len(spans) == 0 {
+		return "ts", nil
+	}
+	if len(spans) == 1 {
+		if spans[0].offset == 0 {
+			return "ts", nil
+		}
+		return "(ts + ?)", []any{spans[0].offset}
+	}
+
+	var b strings.Builder
+	var args []any
+	b.WriteString("(ts + CASE")
+	for i := len(spans) - 1; i > 0; i-- {
+		b.WriteString(" WHEN ts >= ? THEN ?")
+		args = append(args, spans[i].start, spans[i].offset)
+	}
+	b.WriteString(" ELSE ? END)")
+	args = append(args, spans[0].offset)
+	return b.String(), args
+}
+
+// bucketExpr returns the SQL expression and arguments labelling each row
+// with its local day ("2006-01-02") or hour ("2006-01-02 15:00").
+func (r TimeRange) bucketExpr() (string, []any) {
+	return r.bucketAt(r.Interval())
+}
+
+// granularities lists the bucket sizes bucketAt accepts.
+var granularities = []string{"minute", "hour", "day", "week", "month"}
+
+// bucketAt returns the SQL expression and arguments labelling each row with
+// its local bucket of the given granularity. Labels are "2006-01-02 15:04"
+// for minutes, "2006-01-02 15:00" for hours, and the first day of the day,
+// week (starting Sunday) or month otherwise.
+func (r TimeRange) bucketAt(granularity string) (string, []any) {
+	expr, args := r.localTS()
+	switch granularity {
+	case "minute":
+		return "strftime('%Y-%m-%d %H:%M', " + expr + ", 'unixepoch')", args
+	case "hour":
+		return "strftime('%Y-%m-%d %H:00', " + expr + ", 'unixepoch')", args
+	case "week":
+		return "date(" + expr + ", 'unixepoch', '-6 days', 'weekday 0')", args
+	case "month":
+		return "strftime('%Y-%m-01', " + expr + ", 'unixepoch')", args
+	}
+	return "date(" + expr + ", 'unixepoch')", args
+}
+
+// bucketLabels lists every bucket label of the given granularity that
+// overlaps the range, in order, matching the labels of bucketAt.
+func (r TimeRange) bucketLabels(granularity string, max int) ([]string, error) {
+	start := r.From.In(r.Loc)
+	y, m, d := start.Date()
+	t := time.Date(y, m, d, start.Hour(), start.Minute(), 0, 0, r.Loc)
+	layout := "2006-01-02"
+	switch granularity {
+	case "minute":
+		layout = "2006-01-02 15:04"
+	case "hour":
+		layout = "2006-01-02 15:00"
+		t = time.Date(y, m, d, start.Hour(), 0, 0, 0, r.Loc)
+	case "day":
+		t = time.Date(y, m, d, 0, 0, 0, 0, r.Loc)
+	case "week":
+		t = time.Date(y, m, d-int(start.Weekday()), 0, 0, 0, 0, r.Loc)
+	case "month":
+		t = time.Date(y, m, 1, 0, 0, 0, 0, r.Loc)
+	}
+
+	var labels []string
+	for t.Before(r.To) {
+		label := t.Format(layout)
+		// Repeated wall-clock hours at a DST change share a label
+		if len(labels) == 0 || labels[len(labels)-1] != label {
+			labels = append(labels, label)
+		}
+		if len(labels) > max {
+			return nil, fmt.Errorf("more than %d %s buckets; use a coarser granularity", max, granularity)
+		}
+		y, m, d := t.Date()
+		switch granularity {
+		case "minute":
+			t = time.Date(y, m, d, t.Hour(), t.Minute()+1, 0, 0, r.Loc)
+		case "hour":
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, r.Loc)
+		case "week":
+			t = time.Date(y, m, d+7, 0, 0, 0, 0, r.Loc)
+		case "month":
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, r.Loc)
+		default:
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, r.Loc)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from least to most privileged. Each role may do everything the
+// ones before it may.
+const (
+	roleViewer  = "viewer"  // reports and the live feed
+	roleAnalyst = "analyst" // exports, goals and funnels
+	roleAdmin   = "admin"   // backups, purges and raw IP addresses
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleAnalyst: 2, roleAdmin: 3}
+
+// sessionTTL is how long a login lasts.
+var sessionTTL = 7 * 24 * time.Hour
+
+const sessionCookie = "nm_session"
+
+// haveUsers is set once any user exists. Until then, without a legacy
+// token or single sign-on, the dashboard is open as before (dev mode).
+var haveUsers atomic.Bool
+
+var (
+	usernameRe  = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+	errBadLogin = errors.New("invalid username or password")
+
+	// dummyHash is compared against when a username does not exist, so
+	// failed logins take as long whether or not the user is known. It is
+	// a bcrypt hash at bcrypt.DefaultCost.
+	dummyHash = []byte("$2a$10$Wzkx/oPxNrg7it/w.XEJEOjsh0FC.MVOa7jBqXLyfStIZRsALhNAW")
+)
+
+func validatePassword(password string) error {
+	// bcrypt ignores everything past 72 bytes
+	if len(password) < 8 || len(password) > 72 {
+		return errors.New("password must be 8-72 bytes")
+	}
+	return nil
+}
+
+// loadUsers records whether any user exists.
+func loadUsers() error {
+	var n int
+	if err := readDB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users)`).Scan(&n); err != nil {
+		return err
+	}
+	haveUsers.Store(n > 0)
+	return nil
+}
+
+// CreateUser adds a user with a bcrypt-hashed password.
+func CreateUser(username, password, role string) (*User, error) {
+	if !usernameRe.MatchString(username) {
+		return nil, errors.New("username must be 1-64 letters, digits or ._@-")
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	if _, ok := roleRanks[role]; !ok {
+		return nil, fmt.Errorf("role must be %s, %s or %s", roleViewer, roleAnalyst, roleAdmin)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)`,
+		username, string(hash), role)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, fmt.Errorf("user %q already exists", username)
+		}
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	haveUsers.Store(true)
+	return &User{ID: id, Username: username, Role: role}, nil
+}
+
+// SetPassword changes a user's password and ends their sessions.
+func SetPassword(username, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`UPDATE users SET password_hash = ? WHERE username = ?`, string(hash), username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no user %q", username)
+	}
+	_, err = db.Exec(`DELETE FROM sessions WHERE user_id = (SELECT id FROM users WHERE username = ?)`, username)
+	return err
+}
+
+// DeleteUser removes a user, their sessions and single sign-on links.
+func DeleteUser(username string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"sessions", "user_identities"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = (SELECT id FROM users WHERE username = ?)`, username); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, loadUsers()
+}
+
+// ListUsers returns every user by name.
+func ListUsers() ([]User, error) {
+	rows, err := db.Query(`SELECT id, username, role FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Authenticate checks a username and password.
+func Authenticate(username, password string) (*User, error) {
+	var u User
+	var hash string
+	err := readDB.QueryRow(`SELECT id, username, role, password_hash FROM users WHERE username = ?`,
+		username).Scan(&u.ID, &u.Username, &u.Role, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errBadLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, errBadLogin
+	}
+	return &u, nil
+}
+
+// hashToken returns the form of a secret token that is stored or compared.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession starts a session for a user and returns its cookie value.
+// Only a hash of the value is stored.
+func NewSession(userID int64) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(setting(&sessionTTL))
+
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= unixepoch()`); err != nil {
+		slog.Error("session cleanup", "err", err)
+	}
+	_, err := db.Exec(`INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), userID, expires.Unix())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+// sessionUser returns the user of an unexpired session, or nil.
+func sessionUser(ctx context.Context, token string) (*User, error) {
+	var u User
+	err := readDB.QueryRowContext(ctx, `
+		SELECT u.id, u.username, u.role FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > unixepoch()`,
+		hashToken(token)).Scan(&u.ID, &u.Username, &u.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// EndSession deletes a session.
+func EndSession(token string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(token))
+	return err
+}
+
+// legacyTokenMatches compares a bearer token with -token in constant time.
+func legacyTokenMatches(token string) bool {
+	if authToken == "" || token == "" {
+		return false
+	}
+	a, b := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(authToken))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+type (
+	userKey   struct{}
+	apiKeyKey struct{}
+)
+
+// requestUser returns the user a request was authenticated as. For API
+// keys it is a pseudo-user named key:<name> with no role.
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+	return u
+}
+
+// hasRole reports whether u may act with role.
+func hasRole(u *User, role string) bool {
+	return u != nil && roleRanks[u.Role] >= roleRanks[role]
+}
+
+// permitted reports whether the caller may act with role, or for an API
+// key, scope.
+func permitted(r *http.Request, role, scope string) bool {
+	if k, _ := r.Context().Value(apiKeyKey{}).(*APIKey); k != nil {
+		return keyAllows(k.Scopes, scope)
+	}
+	return hasRole(requestUser(r), role)
+}
+
+// authenticate identifies the caller by session cookie, then by bearer
+// token: an API key or the legacy token. It returns nil if neither is
+// valid.
+func authenticate(r *http.Request) (*User, *APIKey, error) {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		u, err := sessionUser(r.Context(), c.Value)
+		if u != nil || err != nil {
+			return u, nil, err
+		}
+	}
+	if bearer := extractBearerToken(r.Header.Get("Authorization")); bearer != "" {
+		if strings.HasPrefix(bearer, apiKeyPrefix) {
+			k, err := lookupAPIKey(r, bearer)
+			if k == nil || err != nil {
+				return nil, nil, err
+			}
+			return &User{Username: "key:" + k.Name}, k, nil
+		}
+		if legacyTokenMatches(bearer) {
+			return &User{Username: "token", Role: roleAdmin}, nil, nil
+		}
+		return nil, nil, nil
+	}
+	if authToken == "" && !oidcCfg.enabled() && !haveUsers.Load() {
+		// The first user may have been added by the CLI since startup
+		if err := loadUsers(); err != nil || haveUsers.Load() {
+			return nil, nil, err
+		}
+		return &User{Username: "anonymous", Role: roleAdmin}, nil, nil
+	}
+	return nil, nil, nil
+}
+
+// requireAuth wraps a handler so only users with at least role, or API
+// keys with scope, reach it. Unauthenticated browsers are sent to the
+// login page; API callers get 401. Authenticated requests, allowed or
+// not, are recorded in the audit log.
+func requireAuth(role, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, k, err := authenticate(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "auth", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			if !strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userKey{}, u)
+		if k != nil {
+			ctx = context.WithValue(ctx, apiKeyKey{}, k)
+		}
+		r = r.WithContext(ctx)
+		auditRequest(w, r, u.Username, func(w http.ResponseWriter, r *http.Request) {
+			if !permitted(r, role, scope) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		})
+	}
+}
+
+// handleMe returns the signed-in user.
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestUser(r))
+}
+
+var loginPage = template.Must(template.ParseFS(dashboardFS, "login.html"))
+
+// safeNext returns next if it is a path on this site, else the dashboard.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/console"
+	}
+	return next
+}
+
+func renderLogin(w http.ResponseWriter, status int, next, username, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	var sso string
+	if oidcCfg.enabled() {
+		sso = oidcCfg.Name
+	}
+	loginPage.Execute(w, map[string]string{"Next": next, "Username": username, "Error": msg, "SSO": sso})
+}
+
+// handleLoginPage serves the login form.
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	renderLogin(w, http.StatusOK, safeNext(r.URL.Query().Get("next")), "", "")
+}
+
+// handleLogin checks the submitted credentials and starts a session.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	username, next := r.PostForm.Get("username"), safeNext(r.PostForm.Get("next"))
+
+	u, err := Authenticate(username, r.PostForm.Get("password"))
+	if errors.Is(err, errBadLogin) {
+		slog.WarnContext(r.Context(), "failed login", "user", username, "ip", clientIP(r))
+		Audit(username, "login.failed", "from "+clientIP(r))
+		renderLogin(w, http.StatusUnauthorized, next, username, "Invalid username or password.")
+		return
+	}
+	if err == nil {
+		err = startSession(w, r, u.ID)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "login", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	Audit(u.Username, "login", fmt.Sprintf("%s with password from %s", u.Role, clientIP(r)))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// startSession starts a session for a user and sets its cookie.
+func startSession(w http.ResponseWriter, r *http.Request, userID int64) error {
+	token, expires, err := NewSession(userID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(setting(&sessionTTL).Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// handleLogout ends the session and clears its cookie.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		if u, _ := sessionUser(r.Context(), c.Value); u != nil {
+			Audit(u.Username, "logout", "")
+		}
+		if err := EndSession(c.Value); err != nil {
+			slog.ErrorContext(r.Context(), "logout", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// clientIP returns the address of the client, through the reverse proxy.
+func clientIP(r *http.Request) string {
+	return ExtractIP(r.Header.Get("X-Forwarded-For"), r.RemoteAddr)
+}
+
+// isHTTPS reports whether the client connected over TLS, directly or via
+// the reverse proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
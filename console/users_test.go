@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB opens a new database for one test and closes it afterwards.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if err := initDB(filepath.Join(t.TempDir(), "analytics.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeDB)
+}
+
+// isolateAuth clears the legacy token, single sign-on and the record of
+// users for one test, restoring them afterwards.
+func isolateAuth(t *testing.T) {
+	t.Helper()
+	token, issuer, users := authToken, oidcCfg.Issuer, haveUsers.Load()
+	t.Cleanup(func() {
+		authToken, oidcCfg.Issuer = token, issuer
+		haveUsers.Store(users)
+	})
+	authToken, oidcCfg.Issuer = "", ""
+	haveUsers.Store(false)
+}
+
+// testSession creates a user with role and returns a cookie signing them in.
+func testSession(t *testing.T, role string) *http.Cookie {
+	t.Helper()
+	u, err := CreateUser("user-"+role, "correct horse", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := NewSession(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: sessionCookie, Value: token}
+}
+
+var testRoles = []string{roleViewer, roleAnalyst, roleAdmin}
+
+// okHandler stands in for a route's handler.
+func okHandler(w http.ResponseWriter, r *http.Request) {}
+
+// TestRoleRanks checks that each role reaches routes needing it or a
+// lesser role, and no others.
+func TestRoleRanks(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	sessions := map[string]*http.Cookie{}
+	for _, role := range testRoles {
+		sessions[role] = testSession(t, role)
+	}
+
+	for _, need := range testRoles {
+		h := requireAuth(need, scopeReadStats, okHandler)
+		for _, role := range testRoles {
+			r := httptest.NewRequest("GET", "/api/analytics/stats", nil)
+			r.AddCookie(sessions[role])
+			w := httptest.NewRecorder()
+			h(w, r)
+			want := http.StatusForbidden
+			if roleRanks[role] >= roleRanks[need] {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("%s on a %s route: status %d, want %d", role, need, w.Code, want)
+			}
+		}
+	}
+}
+
+// TestRoutesRefuseLowerRoles sends every documented route a request from
+// each role below the one it needs, and expects it to be refused before
+// its handler runs.
+func TestRoutesRefuseLowerRoles(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	sessions := map[string]*http.Cookie{}
+	for _, role := range testRoles {
+		sessions[role] = testSession(t, role)
+	}
+	mux := http.NewServeMux()
+	SetupRoutes(mux)
+
+	for _, op := range apiOperations() {
+		if op.public {
+			continue
+		}
+		need := op.role
+		if need == "" {
+			need = roleViewer
+		}
+		for _, role := range testRoles {
+			if roleRanks[role] >= roleRanks[need] {
+				continue
+			}
+			r := httptest.NewRequest(op.method, strings.ReplaceAll(op.path, "{id}", "1"), nil)
+			r.AddCookie(sessions[role])
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s as %s: status %d, want %d", op.method, op.path, role, w.Code, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+// TestSessionExpiryAndLogout checks that a session stops working when it
+// expires or is logged out, and that browsers are then sent to log in.
+func TestSessionExpiryAndLogout(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	h := requireAuth(roleViewer, scopeReadStats, okHandler)
+	get := func(path string, c *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(c)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	expiring := testSession(t, roleViewer)
+	if w := get("/api/analytics/stats", expiring); w.Code != http.StatusOK {
+		t.Fatalf("live session: status %d", w.Code)
+	}
+	if _, err := db.Exec(`UPDATE sessions SET expires_at = unixepoch() - 1 WHERE token_hash = ?`, hashToken(expiring.Value)); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/api/analytics/stats", expiring); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired session on the API: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := get("/console?tab=pages", expiring)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fconsole%3Ftab%3Dpages" {
+		t.Errorf("expired session in a browser: status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	session := testSession(t, roleAdmin)
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	handleLogout(w, r)
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		cleared = cleared || c.Name == sessionCookie && c.MaxAge < 0
+	}
+	if !cleared {
+		t.Error("logout did not clear the session cookie")
+	}
+	if w := get("/api/analytics/stats", session); w.Code != http.StatusUnauthorized {
+		t.Errorf("session after logout: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestCookieBeforeBearer checks that a valid session decides who the
+// caller is even alongside a bearer token, and that an invalid one falls
+// through to the token.
+func TestCookieBeforeBearer(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	authToken = "legacy-secret"
+	viewer := testSession(t, roleViewer)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   string // username
+	}{
+		{"session and token", viewer, "user-viewer"},
+		{"unknown session and token", &http.Cookie{Name: sessionCookie, Value: "forged"}, "token"},
+		{"token alone", nil, "token"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/analytics/stats", nil)
+		r.Header.Set("Authorization", "Bearer legacy-secret")
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		u, k, err := authenticate(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if u == nil || u.Username != tt.want || k != nil {
+			t.Errorf("%s: authenticated as %+v, want %s", tt.name, u, tt.want)
+		}
+	}
+
+	// The viewer's session keeps them from admin routes the token reaches
+	r := httptest.NewRequest("POST", "/api/admin/backup", nil)
+	r.Header.Set("Authorization", "Bearer legacy-secret")
+	r.AddCookie(viewer)
+	w := httptest.NewRecorder()
+	requireAuth(roleAdmin, scopeAdmin, okHandler)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("viewer session with the admin token: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// TestAnonymousAdmin checks that the dashboard is open without users,
+// credentials or single sign-on, and closes once a user exists, even one
+// added by another process.
+func TestAnonymousAdmin(t *testing.T) {
+	isolateAuth(t)
+	openTestDB(t)
+	u, _, err := authenticate(httptest.NewRequest("GET", "/api/analytics/stats", nil))
+	if err != nil || u == nil || u.Username != "anonymous" || u.Role != roleAdmin {
+		t.Fatalf("without users: %+v, %v; want the anonymous admin", u, err)
+	}
+
+	if _, err := CreateUser("alice", "correct horse", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	// As if the CLI had added the user after the server started
+	haveUsers.Store(false)
+	u, _, err = authenticate(httptest.NewRequest("GET", "/api/analytics/stats", nil))
+	if err != nil || u != nil {
+		t.Errorf("with a user: %+v, %v; want no one", u, err)
+	}
+	if !haveUsers.Load() {
+		t.Error("haveUsers not set after finding a user")
+	}
+
+	haveUsers.Store(false)
+	if _, err := db.Exec(`DELETE FROM users`); err != nil {
+		t.Fatal(err)
+	}
+	authToken = "legacy-secret"
+	if u, _, _ := authenticate(httptest.NewRequest("GET", "/api/analytics/stats", nil)); u != nil {
+		t.Errorf("with a legacy token: %+v, want no one", u)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct{ next, want string }{
+		{"/console", "/console"},
+		{"/console?tab=pages#top", "/console?tab=pages#top"},
+		{"", "/console"},
+		{"//evil.example", "/console"},
+		{"/\\evil.example", "/console"},
+		{"https://evil.example/console", "/console"},
+		{"javascript:alert(1)", "/console"},
+		{"console", "/console"},
+	}
+	for _, tt := range tests {
+		if got := safeNext(tt.next); got != tt.want {
+			t.Errorf("safeNext(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyTokenMatches(t *testing.T) {
+	defer func(token string) { authToken = token }(authToken)
+	tests := []struct {
+		configured, token string
+		want              bool
+	}{
+		{"", "", false},
+		{"", "anything", false},
+		{"secret", "", false},
+		{"secret", "Secret", false},
+		{"secret", "secret ", false},
+		{"secret", "secret", true},
+	}
+	for _, tt := range tests {
+		authToken = tt.configured
+		if got := legacyTokenMatches(tt.token); got != tt.want {
+			t.Errorf("token %q against %q: %v, want %v", tt.token, tt.configured, got, tt.want)
+		}
+	}
+}